@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// ctxKeyAccessLog holds the *accessLogEntry of a proxied request.
+const ctxKeyAccessLog ctxKey = `access-log`
+
+// accessLogEntry is a structured log line for a proxied request. The
+// httpRequest field follows the Cloud Logging LogEntry format.
+type accessLogEntry struct {
+	Severity      string               `json:"severity"`
+	Message       string               `json:"message"`
+	HTTPRequest   accessLogHTTPRequest `json:"httpRequest"`
+	RequestID     string               `json:"requestId"`
+	Host          string               `json:"host"`
+	TargetHost    string               `json:"targetHost,omitempty"`
+	TokenInjected bool                 `json:"tokenInjected"`
+	Error         string               `json:"error,omitempty"`
+}
+
+type accessLogHTTPRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status,omitempty"`
+	ResponseSize  string `json:"responseSize"`
+	Latency       string `json:"latency"`
+}
+
+// accessLogFromContext returns the access log entry of the request, if it is
+// being logged.
+func accessLogFromContext(ctx context.Context) *accessLogEntry {
+	v, _ := ctx.Value(ctxKeyAccessLog).(*accessLogEntry)
+	return v
+}
+
+// accessLogger writes access log entries as JSON lines.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAccessLogger(w io.Writer) *accessLogger {
+	return &accessLogger{w: w}
+}
+
+func (a *accessLogger) log(e *accessLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		klog.V(1).Infof("WARN: failed to encode access log: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(append(b, '\n'))
+}
+
+// roundTrip runs the request through next and logs it once the response body
+// is closed (or immediately if there is no response).
+func (a *accessLogger) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	e := &accessLogEntry{
+		Message:   "proxied request",
+		RequestID: requestID(req.Context()),
+		Host:      req.Host,
+		HTTPRequest: accessLogHTTPRequest{
+			RequestMethod: req.Method,
+			RequestURL:    req.URL.String(),
+		},
+	}
+	if target, ok := targetFromContext(req.Context()); ok {
+		e.Host, e.TargetHost = target.hostname, target.host
+	}
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyAccessLog, e))
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		e.Error = err.Error()
+		a.finish(e, start, 0)
+		return resp, err
+	}
+	e.HTTPRequest.Status = resp.StatusCode
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the body of upgraded connections must stay an io.ReadWriteCloser
+		a.finish(e, start, 0)
+		return resp, err
+	}
+	resp.Body = &accessLogBody{ReadCloser: resp.Body, done: func(n int64) { a.finish(e, start, n) }}
+	return resp, err
+}
+
+func (a *accessLogger) finish(e *accessLogEntry, start time.Time, size int64) {
+	e.Severity = "INFO"
+	if e.Error != "" || e.HTTPRequest.Status >= http.StatusInternalServerError {
+		e.Severity = "ERROR"
+	}
+	e.HTTPRequest.ResponseSize = fmt.Sprint(size)
+	e.HTTPRequest.Latency = fmt.Sprintf("%.6fs", time.Since(start).Seconds())
+	a.log(e)
+}
+
+// accessLogBody counts the bytes read from the response body and calls done
+// when it is closed.
+type accessLogBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *accessLogBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAccessLog(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name   string
+		host   string
+		authz  string
+		noAuth []string
+		resp   func(*http.Request) (*http.Response, error)
+		want   accessLogEntry
+	}{
+		{
+			name: "ok",
+			host: "hello",
+			resp: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("hello world")), Request: req}, nil
+			},
+			want: accessLogEntry{Severity: "INFO", Message: "proxied request", Host: "hello",
+				TargetHost: "hello-hash-uc.a.run.app", TokenInjected: true,
+				HTTPRequest: accessLogHTTPRequest{RequestMethod: "GET", RequestURL: "https://hello-hash-uc.a.run.app/path", Status: 200, ResponseSize: "11"}},
+		},
+		{
+			name:  "existing authorization",
+			host:  "hello:80",
+			authz: "Bearer user",
+			resp: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+			},
+			want: accessLogEntry{Severity: "INFO", Message: "proxied request", Host: "hello",
+				TargetHost:  "hello-hash-uc.a.run.app",
+				HTTPRequest: accessLogHTTPRequest{RequestMethod: "GET", RequestURL: "https://hello-hash-uc.a.run.app/path", Status: 404, ResponseSize: "0"}},
+		},
+		{
+			name:   "no auth service",
+			host:   "public",
+			noAuth: []string{"public"},
+			resp: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			},
+			want: accessLogEntry{Severity: "INFO", Message: "proxied request", Host: "public",
+				TargetHost:  "public-hash-uc.a.run.app",
+				HTTPRequest: accessLogHTTPRequest{RequestMethod: "GET", RequestURL: "https://public-hash-uc.a.run.app/path", Status: 200, ResponseSize: "0"}},
+		},
+		{
+			name: "upstream error",
+			host: "hello",
+			resp: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			want: accessLogEntry{Severity: "ERROR", Message: "proxied request", Host: "hello",
+				TargetHost: "hello-hash-uc.a.run.app", TokenInjected: true, Error: "connection refused",
+				HTTPRequest: accessLogHTTPRequest{RequestMethod: "GET", RequestURL: "https://hello-hash-uc.a.run.app/path", ResponseSize: "0"}},
+		},
+		{
+			name: "unknown region",
+			host: "hello.us-mars1",
+			want: accessLogEntry{Severity: "INFO", Message: "proxied request", Host: "hello.us-mars1",
+				HTTPRequest: accessLogHTTPRequest{RequestMethod: "GET", RequestURL: "http://hello.us-mars1/path", Status: 421, ResponseSize: "279"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.upstreamRetries = 0
+			rp.noAuthServices = tt.noAuth
+			rp.accessLog = newAccessLogger(&buf)
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return tt.resp(req)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/path", nil)
+			if tt.authz != "" {
+				req.Header.Set("authorization", tt.authz)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("expected 1 log line, got %d: %q", len(lines), buf.String())
+			}
+			var got accessLogEntry
+			if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+				t.Fatalf("failed to parse log line %q: %v", lines[0], err)
+			}
+			if got.RequestID == "" {
+				t.Errorf("request id is not logged")
+			}
+			if got.HTTPRequest.Latency == "" {
+				t.Errorf("latency is not logged")
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreFields(accessLogEntry{}, "RequestID"), cmpopts.IgnoreFields(accessLogHTTPRequest{}, "Latency")); diff != "" {
+				t.Errorf("unexpected log entry (-want +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Config configures a Proxy or a Resolver embedded in another program. The
+// runsd binary builds one from its flags.
+type Config struct {
+	// InternalDomain is the zone of the internal names (default:
+	// run.internal.).
+	InternalDomain string
+
+	// AliasDomains are other zones resolved like InternalDomain, e.g. during
+	// a migration.
+	AliasDomains []string
+
+	// Region is the region of the services reached with names without a
+	// region, e.g. us-central1.
+	Region string
+
+	// ProjectHash is the hash in the URLs of the services of the project,
+	// e.g. dpyb4duzqq if the URLs are like foo-dpyb4duzqq-uc.a.run.app, or
+	// the project number with URLFormatNumber.
+	ProjectHash string
+
+	// URLFormat is the format of the URLs of the services, URLFormatHash or
+	// URLFormatNumber (default: URLFormatHash). With URLFormatNumber,
+	// ProjectHash and ProjectHashes are project numbers.
+	URLFormat string
+
+	// RegionCodes are the codes of regions that runsd does not know yet (or
+	// replacements of the known ones), keyed by region. They are added for
+	// the whole process.
+	RegionCodes map[string]string
+
+	UpstreamTimeout    time.Duration // of the proxied requests, streams are exempt (default: none)
+	UpgradeIdleTimeout time.Duration // of the upgraded (e.g. websocket) connections (default: none)
+
+	// MetadataTimeout is the deadline of each metadata server query, for the
+	// whole process (default: 5s).
+	MetadataTimeout time.Duration
+
+	// TokenSource returns an identity token for the audience (default: from
+	// the metadata server, or the CLOUD_RUN_ID_TOKEN environment variable).
+	TokenSource func(audience string) (string, error)
+
+	// AuthPassthrough keeps the Authorization header of the requests that
+	// have one, and sends the identity token in X-Serverless-Authorization.
+	AuthPassthrough bool
+
+	// NoAuth are the service names or patterns (in which "*" matches any
+	// characters, e.g. "public-*") of the services that get the requests
+	// without an identity token.
+	NoAuth []string
+
+	ProjectHashes  map[string]string // of other projects, keyed by the project name in the internal names
+	ServiceRegions map[string]string // regions of the services not in Region, keyed by service name
+	CustomDomains  map[string]string // domains of the services reached on a custom domain, keyed by service name
+
+	// AllowServices are the service names or patterns (like NoAuth) of the
+	// only services requests are sent to (default: all).
+	AllowServices []string
+
+	// Transport sends the proxied requests to the Cloud Run services
+	// (default: one negotiating HTTP/2 like the runsd binary uses).
+	Transport http.RoundTripper
+
+	// Nameserver is the host or host:port the DNS server forwards the
+	// queries outside the internal domain to (default: they are refused).
+	Nameserver string
+}
+
+// URL formats of the Cloud Run services, see Config.URLFormat.
+const (
+	// URLFormatHash is SERVICE-PROJECTHASH-REGIONCODE.a.run.app.
+	URLFormatHash = "hash"
+	// URLFormatNumber is SERVICE-PROJECTNUMBER.REGION.run.app, with the
+	// project number instead of a project hash.
+	URLFormatNumber = "number"
+)
+
+var errNoProjectHash = errors.New("project hash is not set")
+
+// Validate checks that the required fields are set and that the domains,
+// regions, project hashes, service names and timeouts are valid.
+func (c Config) Validate() error {
+	if c.InternalDomain != "" {
+		if _, err := normalizeDomain(c.InternalDomain); err != nil {
+			return fmt.Errorf("invalid internal domain: %w", err)
+		}
+	}
+	for _, d := range c.AliasDomains {
+		if _, err := normalizeDomain(d); err != nil {
+			return fmt.Errorf("invalid alias domain: %w", err)
+		}
+	}
+	for r, code := range c.RegionCodes {
+		if !dnsLabel.MatchString(r) {
+			return fmt.Errorf("%q is not a valid region name", r)
+		}
+		if !regionCodeFormat.MatchString(code) {
+			return fmt.Errorf("%q is not a valid region code of %s (must be two lowercase letters)", code, r)
+		}
+	}
+	if c.Region == "" {
+		return errors.New("region is not set")
+	}
+	if !c.hasRegionCode(c.Region) {
+		return fmt.Errorf("region %q does not have a region code", c.Region)
+	}
+	validate := validateProjectHash
+	switch c.URLFormat {
+	case "", URLFormatHash:
+	case URLFormatNumber:
+		validate = validateProjectNumber
+	default:
+		return fmt.Errorf("url format %q is not %q or %q", c.URLFormat, URLFormatHash, URLFormatNumber)
+	}
+	if c.ProjectHash == "" {
+		return errNoProjectHash
+	}
+	if err := validate(c.ProjectHash); err != nil {
+		return err
+	}
+	for name, d := range map[string]time.Duration{
+		"upstream timeout":     c.UpstreamTimeout,
+		"upgrade idle timeout": c.UpgradeIdleTimeout,
+		"metadata timeout":     c.MetadataTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s %s is negative", name, d)
+		}
+	}
+	if err := validateServicePatterns(c.NoAuth); err != nil {
+		return fmt.Errorf("invalid no-auth services: %w", err)
+	}
+	if err := validateServicePatterns(c.AllowServices); err != nil {
+		return fmt.Errorf("invalid allowed services: %w", err)
+	}
+	for name, hash := range c.ProjectHashes {
+		if err := validateProjectName(name); err != nil {
+			return err
+		}
+		if err := validate(hash); err != nil {
+			return fmt.Errorf("project %q: %w", name, err)
+		}
+	}
+	for svc, r := range c.ServiceRegions {
+		if err := validateServiceName(svc); err != nil {
+			return err
+		}
+		if !c.hasRegionCode(r) {
+			return fmt.Errorf("region %q of service %q does not have a region code", r, svc)
+		}
+	}
+	for svc, d := range c.CustomDomains {
+		if err := validateServiceName(svc); err != nil {
+			return err
+		}
+		if _, err := normalizeCustomDomain(svc, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRegionCode reports whether the region has a code in RegionCodes or in
+// the known region codes.
+func (c Config) hasRegionCode(region string) bool {
+	if _, ok := c.RegionCodes[region]; ok {
+		return true
+	}
+	_, ok := regionCode(region)
+	return ok
+}
+
+// newReverseProxy returns a reverseProxy with the settings of the config,
+// which is valid.
+func (c Config) newReverseProxy() *reverseProxy {
+	domain := defaultInternalDomain
+	if c.InternalDomain != "" {
+		domain, _ = normalizeDomain(c.InternalDomain)
+	}
+	rp := newReverseProxy(c.ProjectHash, c.Region, domain)
+	rp.urlFormat = c.URLFormat
+	for _, d := range c.AliasDomains {
+		d, _ = normalizeDomain(d)
+		rp.aliasDomains = append(rp.aliasDomains, d)
+	}
+	rc := resolverConfig{
+		projectHashes:  make(map[string]string, len(c.ProjectHashes)),
+		serviceRegions: make(map[string]string, len(c.ServiceRegions)),
+		customDomains:  make(map[string]string, len(c.CustomDomains)),
+	}
+	// names are matched in lowercase after hostname canonicalization
+	for name, hash := range c.ProjectHashes {
+		rc.projectHashes[strings.ToLower(name)] = hash
+	}
+	for svc, r := range c.ServiceRegions {
+		rc.serviceRegions[strings.ToLower(svc)] = strings.ToLower(r)
+	}
+	for svc, d := range c.CustomDomains {
+		rc.customDomains[strings.ToLower(svc)], _ = normalizeCustomDomain(svc, d)
+	}
+	for _, p := range c.AllowServices {
+		rc.allowServices = append(rc.allowServices, strings.ToLower(p))
+	}
+	rp.setConfig(rc)
+	rp.upstreamTimeout = c.UpstreamTimeout
+	rp.upgradeIdleTimeout = c.UpgradeIdleTimeout
+	if c.TokenSource != nil {
+		rp.tokenSource = c.TokenSource
+	} else {
+		rp.tokenSource = newRetryingTokenSource(identityToken, defaultTokenFetchRetries).identityToken
+	}
+	rp.authPassthrough = c.AuthPassthrough
+	rp.noAuthServices = c.NoAuth
+	return rp
+}
+
+// Target is the Cloud Run service an internal name resolves to.
+type Target struct {
+	Service string
+	Tag     string // revision tag, if any
+	Region  string // empty for custom domains
+	Project string // empty for the current project
+	Host    string // e.g. foo-dpyb4duzqq-uc.a.run.app
+}
+
+// Resolver resolves the internal names to Cloud Run services, and answers
+// them in DNS with the loopback addresses the Proxy is reached on.
+type Resolver struct {
+	rp  *reverseProxy
+	dns *dnsHijack
+}
+
+// NewResolver returns a Resolver for the config, after validating it.
+func NewResolver(cfg Config) (*Resolver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	addRegionCodes(cfg.RegionCodes, "config")
+	if cfg.MetadataTimeout > 0 {
+		metadataTimeout = cfg.MetadataTimeout
+	}
+	rp := cfg.newReverseProxy()
+	d := &dnsHijack{
+		domain:     rp.internalDomain,
+		aliases:    rp.aliasDomains,
+		nameserver: cfg.Nameserver,
+		serveIPv6:  true,
+		noForward:  cfg.Nameserver == "",
+		cache:      newDNSCache(defaultDNSCacheSize),
+	}
+	d.currentProjects = func() map[string]string { return rp.config().projectHashes }
+	return &Resolver{rp: rp, dns: d}, nil
+}
+
+// Resolve returns the Cloud Run service the hostname (with or without the
+// internal domain) resolves to.
+func (r *Resolver) Resolve(hostname string) (Target, error) {
+	t, err := r.rp.resolveCloudRunHost(hostname)
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{Service: t.service, Tag: t.tag, Region: t.region, Project: t.project, Host: t.host}, nil
+}
+
+// DNSServer returns a DNS server on the network ("udp" or "tcp") and address
+// answering the internal names with the loopback addresses.
+func (r *Resolver) DNSServer(network, addr string) *dns.Server {
+	return r.dns.newServer(network, addr)
+}
+
+// Proxy is an http.Handler sending the requests to the internal names to
+// their Cloud Run services, with identity tokens.
+type Proxy struct {
+	resolver *Resolver
+	handler  http.Handler
+}
+
+// NewProxy returns a Proxy for the config.
+func NewProxy(cfg Config) (*Proxy, error) {
+	r, err := NewResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tr := cfg.Transport
+	if tr == nil {
+		tr = newUpstreamRoundTripper(upstreamOptions{
+			maxIdleConns:        defaultUpstreamMaxIdleConns,
+			maxIdleConnsPerHost: defaultUpstreamMaxIdleConnsPerHost,
+			idleConnTimeout:     defaultUpstreamIdleConnTimeout,
+			dialTimeout:         defaultUpstreamDialTimeout,
+			keepAlive:           defaultUpstreamKeepAlive,
+		})
+	}
+	return &Proxy{resolver: r, handler: r.rp.newReverseProxyHandler(tr)}, nil
+}
+
+// Resolver returns the Resolver the proxy routes the requests with.
+func (p *Proxy) Resolver() *Resolver {
+	return p.resolver
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud_run_proxy/runsd"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestNewResolverErrors(t *testing.T) {
+	valid := runsd.Config{Region: "us-central1", ProjectHash: "dpyb4duzqq"}
+	cases := []struct {
+		name   string
+		modify func(*runsd.Config)
+	}{
+		{"bad domain", func(c *runsd.Config) { c.InternalDomain = "a..b" }},
+		{"no region", func(c *runsd.Config) { c.Region = "" }},
+		{"unknown region", func(c *runsd.Config) { c.Region = "mars-north1" }},
+		{"no project hash", func(c *runsd.Config) { c.ProjectHash = "" }},
+		{"bad project hash", func(c *runsd.Config) { c.ProjectHash = "NOT-A-HASH" }},
+	}
+	if _, err := runsd.NewResolver(valid); err != nil {
+		t.Fatalf("NewResolver(%+v) error = %v", valid, err)
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			if _, err := runsd.NewResolver(cfg); err == nil {
+				t.Fatalf("NewResolver(%+v) did not fail", cfg)
+			}
+			if _, err := runsd.NewProxy(cfg); err == nil {
+				t.Fatalf("NewProxy(%+v) did not fail", cfg)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() runsd.Config {
+		return runsd.Config{
+			InternalDomain: "run.internal",
+			Region:         "us-central1",
+			ProjectHash:    "dpyb4duzqq",
+			ProjectHashes:  map[string]string{"shared": "abcd1234"},
+			ServiceRegions: map[string]string{"payments": "europe-west1"},
+			CustomDomains:  map[string]string{"web": "web.example.com"},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate() of the valid config error = %v", err)
+	}
+	numbers := valid()
+	numbers.URLFormat, numbers.ProjectHash, numbers.ProjectHashes = runsd.URLFormatNumber, "123456789012", map[string]string{"shared": "42"}
+	if err := numbers.Validate(); err != nil {
+		t.Fatalf("Validate() of the valid config with project numbers error = %v", err)
+	}
+	cases := []struct {
+		name   string
+		modify func(*runsd.Config)
+	}{
+		{"internal domain", func(c *runsd.Config) { c.InternalDomain = "-bad.internal" }},
+		{"alias domain", func(c *runsd.Config) { c.AliasDomains = []string{"a..b"} }},
+		{"region code region name", func(c *runsd.Config) { c.RegionCodes = map[string]string{"Bad_Region": "bb"} }},
+		{"region code", func(c *runsd.Config) { c.RegionCodes = map[string]string{"moon-north1": "abc"} }},
+		{"no region", func(c *runsd.Config) { c.Region = "" }},
+		{"unknown region", func(c *runsd.Config) { c.Region = "moon-north1" }},
+		{"no project hash", func(c *runsd.Config) { c.ProjectHash = "" }},
+		{"project hash", func(c *runsd.Config) { c.ProjectHash = "Not_A_Hash" }},
+		{"upstream timeout", func(c *runsd.Config) { c.UpstreamTimeout = -time.Second }},
+		{"upgrade idle timeout", func(c *runsd.Config) { c.UpgradeIdleTimeout = -time.Second }},
+		{"metadata timeout", func(c *runsd.Config) { c.MetadataTimeout = -time.Second }},
+		{"no auth pattern", func(c *runsd.Config) { c.NoAuth = []string{"public-["} }},
+		{"allow services pattern", func(c *runsd.Config) { c.AllowServices = []string{"billing-["} }},
+		{"project name", func(c *runsd.Config) { c.ProjectHashes = map[string]string{"a.b": "abcd1234"} }},
+		{"project name is a region", func(c *runsd.Config) { c.ProjectHashes = map[string]string{"us-east1": "abcd1234"} }},
+		{"other project hash", func(c *runsd.Config) { c.ProjectHashes = map[string]string{"shared": "-"} }},
+		{"service region service name", func(c *runsd.Config) { c.ServiceRegions = map[string]string{"a.b": "us-east1"} }},
+		{"service region", func(c *runsd.Config) { c.ServiceRegions = map[string]string{"payments": "moon-north1"} }},
+		{"custom domain service name", func(c *runsd.Config) { c.CustomDomains = map[string]string{"a.b": "web.example.com"} }},
+		{"custom domain", func(c *runsd.Config) { c.CustomDomains = map[string]string{"web": "localhost"} }},
+		{"url format", func(c *runsd.Config) { c.URLFormat = "v2" }},
+		{"project number", func(c *runsd.Config) { c.URLFormat = runsd.URLFormatNumber }},
+		{"other project number", func(c *runsd.Config) {
+			c.URLFormat, c.ProjectHash = runsd.URLFormatNumber, "123456789012"
+		}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Fatalf("Validate(%+v) did not fail", cfg)
+			}
+		})
+	}
+}
+
+func TestConfigRegionCodes(t *testing.T) {
+	cfg := runsd.Config{
+		Region:      "moon-south1",
+		ProjectHash: "dpyb4duzqq",
+		RegionCodes: map[string]string{"moon-south1": "ms"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	r, err := runsd.NewResolver(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Resolve("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello-dpyb4duzqq-ms.a.run.app"; got.Host != want {
+		t.Fatalf("Resolve() host=%q, want %q", got.Host, want)
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	r, err := runsd.NewResolver(runsd.Config{InternalDomain: "svc.local", Region: "us-central1", ProjectHash: "dpyb4duzqq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		hostname string
+		want     runsd.Target
+		wantErr  bool
+	}{
+		{hostname: "hello", want: runsd.Target{Service: "hello", Region: "us-central1", Host: "hello-dpyb4duzqq-uc.a.run.app"}},
+		{hostname: "hello.svc.local", want: runsd.Target{Service: "hello", Region: "us-central1", Host: "hello-dpyb4duzqq-uc.a.run.app"}},
+		{hostname: "hello.europe-west1.svc.local.", want: runsd.Target{Service: "hello", Region: "europe-west1", Host: "hello-dpyb4duzqq-ew.a.run.app"}},
+		{hostname: "a.b.c.d.e.svc.local", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, err := r.Resolve(tt.hostname)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve(%q) error = %v, wantErr = %v", tt.hostname, err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("Resolve(%q) diff: %s", tt.hostname, diff)
+			}
+		})
+	}
+}
+
+func TestResolverDNSServer(t *testing.T) {
+	r, err := runsd.NewResolver(runsd.Config{Region: "us-central1", ProjectHash: "dpyb4duzqq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := r.DNSServer("udp", pc.LocalAddr().String())
+	srv.PacketConn = pc
+	ch := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(ch) }
+	go srv.ActivateAndServe()
+	<-ch
+	defer srv.Shutdown()
+
+	cases := []struct {
+		name      string
+		wantRcode int
+		wantA     string
+	}{
+		{name: "hello.run.internal.", wantRcode: dns.RcodeSuccess, wantA: "127.0.0.1"},
+		{name: "hello.us-central1.run.internal.", wantRcode: dns.RcodeSuccess, wantA: "127.0.0.1"},
+		{name: "example.com.", wantRcode: dns.RcodeRefused}, // no Nameserver to forward to
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := dns.Exchange(new(dns.Msg).SetQuestion(tt.name, dns.TypeA), pc.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("got rcode=%s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			var got string
+			if len(resp.Answer) > 0 {
+				got = resp.Answer[0].(*dns.A).A.String()
+			}
+			if got != tt.wantA {
+				t.Fatalf("got A=%q, want %q", got, tt.wantA)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestProxyInjectsToken(t *testing.T) {
+	var gotURL, gotAuth string
+	p, err := runsd.NewProxy(runsd.Config{
+		Region:      "us-central1",
+		ProjectHash: "dpyb4duzqq",
+		TokenSource: func(audience string) (string, error) { return "token-for-" + audience, nil },
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotURL, gotAuth = req.URL.String(), req.Header.Get("Authorization")
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Resolver().Resolve("hello"); err != nil {
+		t.Fatalf("Resolver().Resolve() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://hello/foo", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status=%d, body: %s", rec.Code, rec.Body)
+	}
+	if want := "https://hello-dpyb4duzqq-uc.a.run.app/foo"; gotURL != want {
+		t.Errorf("got url=%q, want %q", gotURL, want)
+	}
+	if want := "Bearer token-for-https://hello-dpyb4duzqq-uc.a.run.app"; gotAuth != want {
+		t.Errorf("got Authorization=%q, want %q", gotAuth, want)
+	}
+}
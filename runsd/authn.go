@@ -12,13 +12,84 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"k8s.io/klog/v2"
 )
 
+const (
+	iamCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+
+	defaultTokenFetchRetries = 3
+	tokenFetchMaxBackoff     = time.Second
+	// tokenFetchDeadline bounds the time spent retrying a token fetch.
+	tokenFetchDeadline = 10 * time.Second
+
+	// Values of -token_type.
+	tokenTypeID     = "id"
+	tokenTypeAccess = "access"
+
+	defaultAccessTokenScopes = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// iamClient is used for the IAM Credentials API calls.
+var iamClient = &http.Client{Timeout: 10 * time.Second}
+
+// retryingTokenSource retries failed identity token fetches with exponential
+// backoff, e.g. while the metadata server is unavailable during startup.
+type retryingTokenSource struct {
+	fetch    func(audience string) (string, error)
+	retries  int
+	deadline time.Duration
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRetryingTokenSource(fetch func(string) (string, error), retries int) *retryingTokenSource {
+	return &retryingTokenSource{
+		fetch:    fetch,
+		retries:  retries,
+		deadline: tokenFetchDeadline,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+func (r *retryingTokenSource) identityToken(audience string) (string, error) {
+	start := r.now()
+	backoff := retryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		tok, err := r.fetch(audience)
+		if err == nil {
+			return tok, nil
+		}
+		if attempt >= r.retries || r.now().Add(backoff).Sub(start) > r.deadline {
+			return "", fmt.Errorf("failed to fetch identity token after %d attempt(s): %w", attempt+1, err)
+		}
+		klog.V(4).Infof("[tokens] attempt=%d for audience=%s failed: %v, retrying in %s", attempt+1, audience, err, backoff)
+		r.sleep(backoff)
+		if backoff *= 2; backoff > tokenFetchMaxBackoff {
+			backoff = tokenFetchMaxBackoff
+		}
+	}
+}
+
 func identityToken(audience string) (string, error) {
 	if v := os.Getenv("CLOUD_RUN_ID_TOKEN"); v != "" {
 		return strings.TrimSpace(v), nil
@@ -29,3 +100,204 @@ func identityToken(audience string) (string, error) {
 func identityTokenFromMetadata(audience string) (string, error) {
 	return queryMetadata("http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/identity?audience=" + audience)
 }
+
+// accessTokenFromMetadata returns an OAuth2 access token of the default
+// service account.
+func accessTokenFromMetadata() (string, error) {
+	v, err := queryMetadata("http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(v), &tok); err != nil {
+		return "", fmt.Errorf("failed to parse access token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("metadata server returned no access token")
+	}
+	return tok.AccessToken, nil
+}
+
+// accessTokenSource fetches OAuth2 access tokens of the default service
+// account with the scopes from the metadata server, for the backends that
+// expect them instead of identity tokens (-token_type=access). Unlike identity
+// tokens, their expiry is not in the token, so it is kept for expiry.
+type accessTokenSource struct {
+	scopes []string
+	query  func(url string) (string, error)
+	now    func() time.Time
+
+	mu       sync.Mutex
+	expiries map[string]time.Time // of the fetched tokens that have not expired
+}
+
+func newAccessTokenSource(scopes []string) *accessTokenSource {
+	return &accessTokenSource{
+		scopes:   scopes,
+		query:    queryMetadata,
+		now:      time.Now,
+		expiries: make(map[string]time.Time),
+	}
+}
+
+// accessToken returns an access token. The audience is ignored, access
+// tokens are not for one.
+func (s *accessTokenSource) accessToken(string) (string, error) {
+	u := "http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token"
+	if len(s.scopes) > 0 {
+		u += "?scopes=" + url.QueryEscape(strings.Join(s.scopes, ","))
+	}
+	v, err := s.query(u)
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(v), &tok); err != nil {
+		return "", fmt.Errorf("failed to parse access token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("metadata server returned no access token")
+	}
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, exp := range s.expiries {
+		if !now.Before(exp) {
+			delete(s.expiries, t)
+		}
+	}
+	if tok.ExpiresIn > 0 {
+		s.expiries[tok.AccessToken] = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return tok.AccessToken, nil
+}
+
+// expiry returns the expiry of an unexpired token returned by accessToken.
+func (s *accessTokenSource) expiry(tok string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.expiries[tok]
+	if !ok {
+		return time.Time{}, fmt.Errorf("access token has no known expiry")
+	}
+	return exp, nil
+}
+
+// impersonatingTokenSource generates identity tokens as another service
+// account with the IAM Credentials API, authenticating as the default service
+// account (which needs the Service Account OpenID Connect Identity Token
+// Creator role on it).
+type impersonatingTokenSource struct {
+	serviceAccount string
+	endpoint       string
+	accessToken    func() (string, error)
+	client         *http.Client
+}
+
+func newImpersonatingTokenSource(serviceAccount string) *impersonatingTokenSource {
+	return &impersonatingTokenSource{
+		serviceAccount: serviceAccount,
+		endpoint:       iamCredentialsEndpoint,
+		accessToken:    accessTokenFromMetadata,
+		client:         iamClient,
+	}
+}
+
+func (s *impersonatingTokenSource) identityToken(audience string) (string, error) {
+	at, err := s.accessToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token to impersonate %s: %w", s.serviceAccount, err)
+	}
+	body, _ := json.Marshal(struct {
+		Audience     string `json:"audience"`
+		IncludeEmail bool   `json:"includeEmail"`
+	}{Audience: audience, IncludeEmail: true})
+	u := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateIdToken", s.endpoint, url.PathEscape(s.serviceAccount))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+at)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate identity token as %s: %w", s.serviceAccount, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read generateIdToken response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("generateIdToken for %s responded with code=%d: %s", s.serviceAccount, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var v struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", fmt.Errorf("failed to parse generateIdToken response: %w", err)
+	}
+	if v.Token == "" {
+		return "", fmt.Errorf("generateIdToken for %s returned no token", s.serviceAccount)
+	}
+	return v.Token, nil
+}
+
+// adcTokenSource generates identity tokens from the Application Default
+// Credentials (e.g. "gcloud auth application-default login"), for running
+// off Google Cloud. Tokens of user accounts are for the gcloud OAuth client
+// instead of the audience, which Cloud Run accepts for users with the invoker
+// role.
+type adcTokenSource struct {
+	creds *google.Credentials
+}
+
+func newADCTokenSource(ctx context.Context) (*adcTokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, "openid", "https://www.googleapis.com/auth/userinfo.email")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find application default credentials: %w", err)
+	}
+	return &adcTokenSource{creds: creds}, nil
+}
+
+func (s *adcTokenSource) identityToken(audience string) (string, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if len(s.creds.JSON) > 0 {
+		if err := json.Unmarshal(s.creds.JSON, &f); err != nil {
+			return "", fmt.Errorf("failed to parse application default credentials: %w", err)
+		}
+	}
+	switch f.Type {
+	case "service_account":
+		cfg, err := google.JWTConfigFromJSON(s.creds.JSON)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse service account key: %w", err)
+		}
+		cfg.PrivateClaims = map[string]interface{}{"target_audience": audience}
+		cfg.UseIDToken = true
+		tok, err := cfg.TokenSource(context.Background()).Token()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate identity token with service account key: %w", err)
+		}
+		return tok.AccessToken, nil
+	case "authorized_user":
+		tok, err := s.creds.TokenSource.Token()
+		if err != nil {
+			return "", fmt.Errorf("failed to refresh user credentials: %w", err)
+		}
+		id, _ := tok.Extra("id_token").(string)
+		if id == "" {
+			return "", fmt.Errorf("user credentials did not return an identity token, try running \"gcloud auth application-default login\" again")
+		}
+		return id, nil
+	default:
+		return "", fmt.Errorf("application default credentials of type %q cannot generate identity tokens, use a service account key or user credentials", f.Type)
+	}
+}
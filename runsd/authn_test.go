@@ -0,0 +1,247 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestImpersonatingTokenSource(t *testing.T) {
+	cases := []struct {
+		name        string
+		code        int
+		body        string
+		accessErr   error
+		want        string
+		wantErrText string
+	}{
+		{name: "ok", code: http.StatusOK, body: `{"token":"id-token"}`, want: "id-token"},
+		{name: "permission denied", code: http.StatusForbidden, body: `{"error":{"message":"denied"}}`, wantErrText: "code=403"},
+		{name: "no token", code: http.StatusOK, body: `{}`, wantErrText: "returned no token"},
+		{name: "no access token", accessErr: errors.New("metadata down"), wantErrText: "metadata down"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.EscapedPath() != "/v1/projects/-/serviceAccounts/sa@proj.iam.gserviceaccount.com:generateIdToken" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+				}
+				if got := r.Header.Get("authorization"); got != "Bearer access-token" {
+					t.Errorf("got authorization=%q", got)
+				}
+				var body struct {
+					Audience string `json:"audience"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Audience != "https://foo.a.run.app" {
+					t.Errorf("unexpected body audience=%q err=%v", body.Audience, err)
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			s := newImpersonatingTokenSource("sa@proj.iam.gserviceaccount.com")
+			s.endpoint = srv.URL
+			s.accessToken = func() (string, error) { return "access-token", tt.accessErr }
+
+			got, err := s.identityToken("https://foo.a.run.app")
+			if tt.wantErrText != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Fatalf("got err=%v, expected it to contain %q", err, tt.wantErrText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got token=%q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessTokenSource(t *testing.T) {
+	now := time.Unix(1620000000, 0)
+	cases := []struct {
+		name        string
+		scopes      []string
+		body        string
+		queryErr    error
+		wantURL     string
+		want        string
+		wantExpiry  time.Time
+		wantErrText string
+	}{
+		{name: "ok", scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+			body:    `{"access_token":"ya29.token","expires_in":3599,"token_type":"Bearer"}`,
+			wantURL: "http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token?scopes=https%3A%2F%2Fwww.googleapis.com%2Fauth%2Fcloud-platform",
+			want:    "ya29.token", wantExpiry: now.Add(3599 * time.Second)},
+		{name: "default scopes", body: `{"access_token":"ya29.token","expires_in":60}`,
+			wantURL: "http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token",
+			want:    "ya29.token", wantExpiry: now.Add(time.Minute)},
+		{name: "no token", body: `{"expires_in":60}`, wantErrText: "no access token"},
+		{name: "bad json", body: `ya29.token`, wantErrText: "failed to parse"},
+		{name: "metadata down", queryErr: errors.New("metadata down"), wantErrText: "metadata down"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newAccessTokenSource(tt.scopes)
+			s.now = func() time.Time { return now }
+			s.query = func(u string) (string, error) {
+				if tt.wantURL != "" && u != tt.wantURL {
+					t.Errorf("got url=%s, want %s", u, tt.wantURL)
+				}
+				return tt.body, tt.queryErr
+			}
+			got, err := s.accessToken("https://foo.a.run.app")
+			if tt.wantErrText != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Fatalf("got err=%v, expected it to contain %q", err, tt.wantErrText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got token=%q, want %q", got, tt.want)
+			}
+			exp, err := s.expiry(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exp.Equal(tt.wantExpiry) {
+				t.Fatalf("got expiry=%s, want %s", exp, tt.wantExpiry)
+			}
+			if _, err := s.expiry("other"); err == nil {
+				t.Fatal("expected error for the expiry of an unknown token")
+			}
+		})
+	}
+}
+
+func TestADCTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	var gotAudience string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) == 3 {
+			b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var claims struct {
+				TargetAudience string `json:"target_audience"`
+			}
+			json.Unmarshal(b, &claims)
+			gotAudience = claims.TargetAudience
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{"id_token":"` + testJWT(time.Now().Add(time.Hour)) + `"}`))
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		json    map[string]string
+		wantErr bool
+	}{
+		{name: "service account", json: map[string]string{
+			"type": "service_account", "client_email": "sa@proj.iam.gserviceaccount.com",
+			"private_key": string(keyPEM), "token_uri": srv.URL}},
+		{name: "unsupported", json: map[string]string{"type": "external_account"}, wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := json.Marshal(tt.json)
+			s := &adcTokenSource{creds: &google.Credentials{JSON: b}}
+			tok, err := s.identityToken("https://foo.a.run.app")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("identityToken() err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := tokenExpiry(tok); err != nil {
+				t.Fatalf("got invalid token %q: %v", tok, err)
+			}
+			if gotAudience != "https://foo.a.run.app" {
+				t.Fatalf("got target_audience=%q", gotAudience)
+			}
+		})
+	}
+}
+
+func TestRetryingTokenSource(t *testing.T) {
+	cases := []struct {
+		name         string
+		retries      int
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "no failures", retries: 3, wantAttempts: 1},
+		{name: "transient failures", retries: 3, failures: 2, wantAttempts: 3},
+		{name: "persistent failures", retries: 3, failures: 100, wantAttempts: 4, wantErr: true},
+		{name: "no retries", retries: 0, failures: 1, wantAttempts: 1, wantErr: true},
+		{name: "deadline", retries: 100, failures: 100, wantAttempts: 13, wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1600000000, 0)
+			attempts := 0
+			r := newRetryingTokenSource(func(string) (string, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return "", errors.New("metadata server responded with code=503")
+				}
+				return "token", nil
+			}, tt.retries)
+			r.now = func() time.Time { return now }
+			r.sleep = func(d time.Duration) { now = now.Add(d) }
+
+			tok, err := r.identityToken("aud")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("identityToken() err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if err == nil && tok != "token" {
+				t.Fatalf("got token=%q", tok)
+			}
+			if err != nil && !strings.Contains(err.Error(), "code=503") {
+				t.Fatalf("error %q does not wrap the last error", err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Fatalf("got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// defaultMaxResponseBuffer is the most of a response body the ModifyResponse
+// transformations that need the whole body buffer.
+const defaultMaxResponseBuffer = 1 << 20
+
+// ctxKeyBodyLimit holds the *limitedBody of the request.
+const ctxKeyBodyLimit ctxKey = `body-limit`
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxBodyHandler responds with 413 to requests with bodies larger than limit
+// bytes. Streaming requests (grpc and upgrades) are not limited.
+func maxBodyHandler(limit int64, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || isStreamingRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			klog.V(4).Infof("[proxy] rejecting request to host=%s with content-length=%d (limit=%d)", urlHost(r), r.ContentLength, limit)
+			writeBodyTooLarge(w, r, limit)
+			return
+		}
+		b := &limitedBody{ReadCloser: r.Body, remaining: limit, limit: limit}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyBodyLimit, b))
+		r.Body = b
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("runsd does not proxy request bodies larger than %d bytes", limit))
+}
+
+// bodyTooLarge reports whether the request body exceeded the limit.
+func bodyTooLarge(ctx context.Context) (int64, bool) {
+	b, ok := ctx.Value(ctxKeyBodyLimit).(*limitedBody)
+	if !ok || atomic.LoadInt32(&b.exceeded) == 0 {
+		return 0, false
+	}
+	return b.limit, true
+}
+
+// limitedBody fails reads once more than limit bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+	exceeded  int32 // accessed atomically
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// bufferResponse reads the whole response body for a transformation, if it
+// has at most limit bytes. Larger bodies are put back to be streamed as is,
+// and ok is false so that the transformation is skipped.
+func bufferResponse(resp *http.Response, limit int64) (b []byte, ok bool, err error) {
+	if resp.ContentLength > limit {
+		return nil, false, nil
+	}
+	b, err = ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(b)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	return b, true, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodyBytes(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name        string
+		body        string
+		chunked     bool
+		contentType string
+		wantCode    int
+		wantUp      bool
+	}{
+		{name: "under limit", body: strings.Repeat("a", 10), wantCode: http.StatusOK, wantUp: true},
+		{name: "at limit", body: strings.Repeat("a", 16), wantCode: http.StatusOK, wantUp: true},
+		{name: "content-length over limit", body: strings.Repeat("a", 17), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "chunked over limit", body: strings.Repeat("a", 100), chunked: true, wantCode: http.StatusRequestEntityTooLarge, wantUp: true},
+		{name: "chunked under limit", body: strings.Repeat("a", 16), chunked: true, wantCode: http.StatusOK, wantUp: true},
+		{name: "grpc is exempt", body: strings.Repeat("a", 100), contentType: "application/grpc", wantCode: http.StatusOK, wantUp: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.upstreamRetries = 0
+			rp.maxBodyBytes = 16
+			var up bool
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				up = true
+				if _, err := ioutil.ReadAll(req.Body); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "http://foo/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			if tt.contentType != "" {
+				req.Header.Set("content-type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if up != tt.wantUp {
+				t.Fatalf("upstream called=%v, want %v", up, tt.wantUp)
+			}
+		})
+	}
+}
+
+func TestBufferResponse(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	cases := []struct {
+		name   string
+		length int64
+		limit  int64
+		wantOK bool
+	}{
+		{name: "under", length: 100, limit: 100, wantOK: true},
+		{name: "under unknown length", length: -1, limit: 100, wantOK: true},
+		{name: "over", length: 100, limit: 99},
+		{name: "over unknown length", length: -1, limit: 10},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), ContentLength: tt.length}
+			b, ok, err := bufferResponse(resp, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("bufferResponse() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok {
+				if string(b) != body {
+					t.Fatalf("bufferResponse() = %q, want the body", b)
+				}
+				return
+			}
+			// streamed as is
+			if got, _ := ioutil.ReadAll(resp.Body); string(got) != body {
+				t.Fatalf("got body=%q after bufferResponse(), want it unchanged", got)
+			}
+		})
+	}
+}
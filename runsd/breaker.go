@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// circuitBreaker tracks the consecutive failures of each upstream host. After
+// threshold failures, the host is failed fast for the cooldown, and then a
+// single request is let through to probe it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // a request is let through after the cooldown
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		hosts:     make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether a request can be sent to the host, and otherwise how
+// long until the host is probed again.
+func (b *circuitBreaker) allow(host string) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.hosts[host]
+	if !ok || s.failures < b.threshold {
+		return true, 0
+	}
+	if d := s.openUntil.Sub(b.now()); d > 0 {
+		return false, d
+	}
+	if s.probing {
+		return false, 0
+	}
+	s.probing = true
+	return true, 0
+}
+
+// record updates the host with the outcome of a request that was allowed.
+func (b *circuitBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	s, ok := b.hosts[host]
+	if !ok {
+		s = new(breakerState)
+		b.hosts[host] = s
+	}
+	s.failures++
+	s.probing = false
+	if s.failures >= b.threshold {
+		if s.failures == b.threshold {
+			klog.V(1).Infof("WARN: [breaker] host=%s failed %d times in a row, failing requests for %s", host, s.failures, b.cooldown)
+		}
+		s.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// release lets another request probe the host, if the allowed request
+// finished without an outcome (e.g. it was canceled by the client).
+func (b *circuitBreaker) release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.hosts[host]; ok {
+		s.probing = false
+	}
+}
+
+// breakerTransport fails requests fast with 503 while the circuit breaker of
+// their upstream host is open. It keys on the resolved host (e.g.
+// foo-dpyb4duzqq-uc.a.run.app) rather than the requested internal name, so
+// that all names of a service share its breaker.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker // disabled if nil
+}
+
+var _ http.Flusher = breakerTransport{} // ensure it's a Flusher
+
+func (b breakerTransport) Flush() {
+	if v, ok := b.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (b breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.breaker == nil {
+		return b.next.RoundTrip(req)
+	}
+	host := req.URL.Host
+	if ok, wait := b.breaker.allow(host); !ok {
+		klog.V(4).Infof("[breaker] failing fast for host=%s id=%s", host, requestID(req.Context()))
+		resp := errorResponse(req, http.StatusServiceUnavailable, fmt.Sprintf("runsd stopped sending requests to host=%q after consecutive failures, retry later", host))
+		resp.Header.Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second)/time.Second)))
+		return resp, nil
+	}
+	resp, err := b.next.RoundTrip(req)
+	if req.Context().Err() == context.Canceled {
+		b.breaker.release(host)
+	} else {
+		b.breaker.record(host, isUpstreamFailure(resp, err))
+	}
+	return resp, err
+}
+
+// isUpstreamFailure reports whether the response indicates the upstream is
+// unavailable, as opposed to an error of the request.
+func isUpstreamFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
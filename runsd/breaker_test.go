@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBreakerTransport(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	var upstream []string
+	fail := map[string]bool{}
+	tr := breakerTransport{
+		breaker: b,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			upstream = append(upstream, req.URL.Host)
+			if fail[req.URL.Host] {
+				if req.URL.Host == "err.a.run.app" {
+					return nil, errors.New("connection refused")
+				}
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	send := func(host string) int {
+		resp, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil))
+		if err != nil {
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	steps := []struct {
+		name     string
+		host     string
+		fail     bool
+		advance  time.Duration
+		wantCode int
+		wantUp   bool
+	}{
+		{name: "first failure", host: "foo.a.run.app", fail: true, wantCode: 503, wantUp: true},
+		{name: "second failure opens", host: "foo.a.run.app", fail: true, wantCode: 503, wantUp: true},
+		{name: "open fails fast", host: "foo.a.run.app", wantCode: 503},
+		{name: "other host unaffected", host: "bar.a.run.app", wantCode: 200, wantUp: true},
+		{name: "connection errors count", host: "err.a.run.app", fail: true, wantUp: true},
+		{name: "connection errors open", host: "err.a.run.app", fail: true, wantUp: true},
+		{name: "still open before cooldown", host: "foo.a.run.app", advance: 9 * time.Second, wantCode: 503},
+		{name: "failed probe reopens", host: "foo.a.run.app", fail: true, advance: time.Second, wantCode: 503, wantUp: true},
+		{name: "open after failed probe", host: "foo.a.run.app", wantCode: 503},
+		{name: "successful probe closes", host: "foo.a.run.app", advance: 10 * time.Second, wantCode: 200, wantUp: true},
+		{name: "closed", host: "foo.a.run.app", wantCode: 200, wantUp: true},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		fail[s.host] = s.fail
+		upstream = nil
+		if got := send(s.host); got != s.wantCode {
+			t.Fatalf("%s: got code=%d, want %d", s.name, got, s.wantCode)
+		}
+		if got := len(upstream) > 0; got != s.wantUp {
+			t.Fatalf("%s: upstream called=%v, want %v", s.name, got, s.wantUp)
+		}
+	}
+}
+
+func TestBreakerHalfOpenSingleProbe(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(1, time.Second)
+	b.now = func() time.Time { return now }
+	b.record("foo", true)
+
+	now = now.Add(time.Second)
+	var got []bool
+	for i := 0; i < 2; i++ {
+		ok, _ := b.allow("foo")
+		got = append(got, ok)
+	}
+	if diff := cmp.Diff([]bool{true, false}, got); diff != "" {
+		t.Fatalf("allow() after cooldown (-want,+got):\n%s", diff)
+	}
+	b.release("foo")
+	if ok, _ := b.allow("foo"); !ok {
+		t.Fatal("released probe did not let another request through")
+	}
+}
+
+func TestReverseProxyBreakerKeysOnResolvedHost(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.upstreamRetries = 0
+	rp.breakerFailures = 1
+	calls := 0
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+	}))
+
+	// all names of the service share its breaker
+	for _, host := range []string{"foo", "foo.us-central1", "foo.us-central1.run.internal"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("host=%s: got code=%d, want 503", host, rec.Code)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+}
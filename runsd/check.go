@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultCheckTimeout is the deadline of the request of runsd check, unless
+// -upstream_timeout is set.
+const defaultCheckTimeout = 30 * time.Second
+
+// checkStep is the outcome of a step of runsd check.
+type checkStep struct {
+	name   string
+	took   time.Duration
+	detail string
+	err    error
+}
+
+// checkService resolves the service, fetches an identity token for it and
+// sends it a request with the token over tr, the way the proxy would, timing
+// each step. The request is HEAD / if path is empty, else GET path. The steps
+// after the first failing one are not run.
+func (rp *reverseProxy) checkService(ctx context.Context, tr http.RoundTripper, service, path string) []checkStep {
+	var steps []checkStep
+	step := func(name string, f func() (string, error)) bool {
+		start := time.Now()
+		detail, err := f()
+		steps = append(steps, checkStep{name: name, took: time.Since(start), detail: detail, err: err})
+		return err == nil
+	}
+
+	var t cloudRunTarget
+	if !step("resolve", func() (string, error) {
+		var err error
+		t, err = rp.resolveCloudRunHost(service)
+		return t.host, err
+	}) {
+		return steps
+	}
+
+	var token string
+	audience := "https://" + t.host
+	if !step("token", func() (string, error) {
+		if matchService(rp.noAuthServices, t.service) {
+			return "skipped, service is in -no_auth", nil
+		}
+		if !t.customDomain {
+			if err := validateAudienceHost(t.host); err != nil {
+				return "", err
+			}
+		}
+		var err error
+		token, err = rp.tokenSource(audience)
+		return "audience " + audience, err
+	}) {
+		return steps
+	}
+
+	step("request", func() (string, error) {
+		method := http.MethodHead
+		if path == "" {
+			path = "/"
+		} else {
+			method = http.MethodGet
+		}
+		timeout := rp.upstreamTimeout
+		if timeout <= 0 {
+			timeout = defaultCheckTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req, err := http.NewRequest(method, audience+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ctx)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if !rp.noUserAgent {
+			setUserAgent(req)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return method + " " + path, err
+		}
+		resp.Body.Close()
+		detail := fmt.Sprintf("%s %s: %d %s", method, path, resp.StatusCode, http.StatusText(resp.StatusCode))
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return detail, fmt.Errorf("the service rejected the identity token (does the service account have roles/run.invoker?)")
+		case resp.StatusCode >= 500:
+			return detail, fmt.Errorf("the service failed to respond")
+		}
+		return detail, nil
+	})
+	return steps
+}
+
+// writeCheck prints the steps of runsd check as a table, and reports whether
+// they all succeeded.
+func writeCheck(w io.Writer, steps []checkStep) bool {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	ok := true
+	for _, s := range steps {
+		status, detail := "ok", s.detail
+		if s.err != nil {
+			status, ok = "FAIL", false
+			if detail != "" {
+				detail += ": "
+			}
+			detail += s.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.name, status, s.took.Round(time.Millisecond), detail)
+	}
+	tw.Flush()
+	return ok
+}
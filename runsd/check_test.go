@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckService(t *testing.T) {
+	type step struct {
+		Name, Detail string
+		Failed       bool
+	}
+	cases := []struct {
+		name     string
+		service  string
+		path     string
+		tokenErr error
+		status   int
+		noAuth   []string
+		want     []step
+	}{
+		{
+			name: "ok", service: "foo", status: http.StatusOK,
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "audience https://foo-hash-uc.a.run.app"},
+				{Name: "request", Detail: "HEAD /: 200 OK"},
+			},
+		},
+		{
+			name: "path", service: "foo", path: "/healthz", status: http.StatusNotFound,
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "audience https://foo-hash-uc.a.run.app"},
+				{Name: "request", Detail: "GET /healthz: 404 Not Found"},
+			},
+		},
+		{
+			name: "unresolvable", service: "a.b.c.d.e",
+			want: []step{{Name: "resolve", Failed: true}},
+		},
+		{
+			name: "token error", service: "foo", tokenErr: errors.New("no metadata server"),
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "audience https://foo-hash-uc.a.run.app", Failed: true},
+			},
+		},
+		{
+			name: "no auth", service: "foo", noAuth: []string{"f*"}, status: http.StatusOK,
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "skipped, service is in -no_auth"},
+				{Name: "request", Detail: "HEAD /: 200 OK"},
+			},
+		},
+		{
+			name: "forbidden", service: "foo", status: http.StatusForbidden,
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "audience https://foo-hash-uc.a.run.app"},
+				{Name: "request", Detail: "HEAD /: 403 Forbidden", Failed: true},
+			},
+		},
+		{
+			name: "server error", service: "foo", status: http.StatusServiceUnavailable,
+			want: []step{
+				{Name: "resolve", Detail: "foo-hash-uc.a.run.app"},
+				{Name: "token", Detail: "audience https://foo-hash-uc.a.run.app"},
+				{Name: "request", Detail: "HEAD /: 503 Service Unavailable", Failed: true},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.noAuthServices = tt.noAuth
+			rp.tokenSource = func(audience string) (string, error) { return "token-of-" + audience, tt.tokenErr }
+			tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				wantAuth := "Bearer token-of-https://foo-hash-uc.a.run.app"
+				if tt.noAuth != nil {
+					wantAuth = ""
+				}
+				if got := req.Header.Get("Authorization"); got != wantAuth {
+					t.Errorf("got authorization=%q, want %q", got, wantAuth)
+				}
+				if ua := req.Header.Get("User-Agent"); !strings.HasPrefix(ua, "runsd/") {
+					t.Errorf("got user-agent=%q", ua)
+				}
+				return &http.Response{StatusCode: tt.status, Body: http.NoBody, Request: req}, nil
+			})
+			steps := rp.checkService(context.Background(), tr, tt.service, tt.path)
+			var got []step
+			for _, s := range steps {
+				got = append(got, step{Name: s.name, Detail: s.detail, Failed: s.err != nil})
+			}
+			if tt.want[0].Failed {
+				got[0].Detail = "" // the resolution error is in err
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("checkService() (-want,+got):\n%s", diff)
+			}
+
+			var b bytes.Buffer
+			if ok := writeCheck(&b, steps); ok == tt.want[len(tt.want)-1].Failed {
+				t.Errorf("writeCheck() = %v, output:\n%s", ok, b.String())
+			}
+			if n := strings.Count(b.String(), "\n"); n != len(tt.want) {
+				t.Errorf("writeCheck() printed %d lines, want %d:\n%s", n, len(tt.want), b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultCompressMinBytes = 1024
+
+// compressedContentTypes are the content type prefixes that are not worth
+// compressing again.
+var compressedContentTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/gzip",
+	"application/zip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/octet-stream",
+}
+
+// gzipResponse compresses the response body with gzip if the client accepts
+// it and the response is not encoded, streamed or already compressed. The
+// responses with a known length are compressed only if they have at least
+// minSize bytes.
+func gzipResponse(resp *http.Response, minSize int64) {
+	if !shouldCompress(resp, minSize) {
+		return
+	}
+	klog.V(6).Infof("[proxy] compressing response for host=%s id=%s", resp.Request.Host, requestID(resp.Request.Context()))
+	resp.Body = newGzipBody(resp.Body)
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.ContentLength = -1
+}
+
+func shouldCompress(resp *http.Response, minSize int64) bool {
+	if resp.Request == nil || resp.Request.Method == http.MethodHead || !acceptsGzip(resp.Request.Header) {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || isStreamingResponse(resp) {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return false
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	for _, p := range compressedContentTypes {
+		if strings.HasPrefix(ct, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, e := range strings.Split(v, ",") {
+			parts := strings.Split(e, ";")
+			if name := strings.ToLower(strings.TrimSpace(parts[0])); name != "gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, p := range parts[1:] {
+				if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+					q, _ = strconv.ParseFloat(p[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// gzipBody compresses the body as it is read.
+type gzipBody struct {
+	src io.ReadCloser
+	pr  *io.PipeReader
+}
+
+func newGzipBody(src io.ReadCloser) *gzipBody {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return &gzipBody{src: src, pr: pr}
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) { return g.pr.Read(p) }
+
+func (g *gzipBody) Close() error {
+	g.pr.Close() // unblocks the compressing goroutine
+	return g.src.Close()
+}
+
+// compressRequestTransport gzips the request bodies to the services matching
+// one of the patterns, which must accept Content-Encoding: gzip. The bodies
+// are buffered to compress them, so streaming requests, encoded bodies,
+// already compressed content types and bodies smaller than minSize are sent
+// as is.
+type compressRequestTransport struct {
+	next     http.RoundTripper
+	services []string
+	minSize  int64
+}
+
+var _ http.Flusher = compressRequestTransport{} // ensure it's a Flusher
+
+func (c compressRequestTransport) Flush() {
+	if v, ok := c.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (c compressRequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, ok := targetFromContext(req.Context())
+	if !ok || !matchService(c.services, target.service) || !shouldCompressRequest(req, c.minSize) {
+		return c.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err // e.g. over -max_body_bytes
+	}
+	if int64(len(body)) >= c.minSize {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(body)
+		zw.Close()
+		klog.V(6).Infof("[proxy] compressed request body of size=%d to size=%d for host=%s id=%s", len(body), b.Len(), req.URL.Host, requestID(req.Context()))
+		body = b.Bytes()
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Del("Content-Length")
+	req.ContentLength = int64(len(body))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+	return c.next.RoundTrip(req)
+}
+
+func shouldCompressRequest(req *http.Request, minSize int64) bool {
+	if req.Body == nil || req.Body == http.NoBody || isStreamingRequest(req) {
+		return false
+	}
+	if req.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if req.ContentLength >= 0 && req.ContentLength < minSize {
+		return false
+	}
+	ct := strings.ToLower(req.Header.Get("Content-Type"))
+	for _, p := range compressedContentTypes {
+		if strings.HasPrefix(ct, p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressResponses(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	large := strings.Repeat("hello world ", 100)
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		encoding       string
+		body           string
+		unknownLength  bool
+		wantGzip       bool
+	}{
+		{name: "large text", acceptEncoding: "gzip", contentType: "application/json", body: large, wantGzip: true},
+		{name: "unknown length", acceptEncoding: "gzip, deflate", contentType: "text/html", body: large, unknownLength: true, wantGzip: true},
+		{name: "small", acceptEncoding: "gzip", contentType: "application/json", body: "{}"},
+		{name: "not accepted", contentType: "application/json", body: large},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0, br", contentType: "application/json", body: large},
+		{name: "already encoded", acceptEncoding: "gzip", contentType: "application/json", encoding: "br", body: large},
+		{name: "image", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "grpc", acceptEncoding: "gzip", contentType: "application/grpc", body: large},
+		{name: "sse", acceptEncoding: "gzip", contentType: "text/event-stream", body: large},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.compress = true
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				hdr := http.Header{"Content-Type": {tt.contentType}}
+				if tt.encoding != "" {
+					hdr.Set("Content-Encoding", tt.encoding)
+				}
+				length := int64(len(tt.body))
+				if tt.unknownLength {
+					length = -1
+				}
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        hdr,
+					ContentLength: length,
+					Body:          ioutil.NopCloser(strings.NewReader(tt.body)),
+					Request:       req,
+				}, nil
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			gotGzip := rec.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("got gzip=%v, want %v (headers=%v)", gotGzip, tt.wantGzip, rec.Header())
+			}
+			body := rec.Body.String()
+			if gotGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+				if rec.Header().Get("Content-Length") != "" {
+					t.Fatalf("compressed response has Content-Length=%s", rec.Header().Get("Content-Length"))
+				}
+			}
+			if body != tt.body {
+				t.Fatalf("got body=%q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"br", false},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.in != "" {
+			h.Set("Accept-Encoding", tt.in)
+		}
+		if got := acceptsGzip(h); got != tt.want {
+			t.Errorf("acceptsGzip(%q)=%v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompressRequests(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	// decompresses gzip bodies, and echoes the body with its encoding
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Got-Encoding", r.Header.Get("Content-Encoding"))
+		w.Header().Set("Got-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(b)
+	}))
+	defer backend.Close()
+
+	large := strings.Repeat(`{"hello":"world"}`, 100)
+	cases := []struct {
+		name          string
+		host          string
+		contentType   string
+		encoding      string
+		body          string
+		unknownLength bool
+		maxBodyBytes  int64
+		wantGzip      bool
+		wantCode      int
+	}{
+		{name: "large json", host: "foo", contentType: "application/json", body: large, wantGzip: true},
+		{name: "unknown length", host: "foo", contentType: "application/json", body: large, unknownLength: true, wantGzip: true},
+		{name: "pattern", host: "ingest-a", contentType: "application/json", body: large, wantGzip: true},
+		{name: "other service", host: "bar", contentType: "application/json", body: large},
+		{name: "small", host: "foo", contentType: "application/json", body: "{}"},
+		{name: "small unknown length", host: "foo", contentType: "application/json", body: "{}", unknownLength: true},
+		{name: "already encoded", host: "foo", contentType: "application/json", encoding: "identity", body: large},
+		{name: "image", host: "foo", contentType: "image/png", body: large},
+		{name: "grpc", host: "foo", contentType: "application/grpc", body: large},
+		{name: "too large", host: "foo", contentType: "application/json", body: large, unknownLength: true, maxBodyBytes: 100, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.compressRequests = []string{"foo", "ingest-*"}
+			rp.maxBodyBytes = tt.maxBodyBytes
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				req.URL.Scheme, req.URL.Host = "http", strings.TrimPrefix(backend.URL, "http://")
+				return http.DefaultTransport.RoundTrip(req)
+			}))
+
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.unknownLength {
+				body = ioutil.NopCloser(body) // hides the length from NewRequest
+			}
+			req := httptest.NewRequest(http.MethodPost, "http://"+tt.host+"/", body)
+			if tt.unknownLength {
+				req.ContentLength = -1
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			wantCode := tt.wantCode
+			if wantCode == 0 {
+				wantCode = http.StatusOK
+			}
+			if rec.Code != wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, wantCode, rec.Body.String())
+			}
+			if wantCode != http.StatusOK {
+				return
+			}
+			if gotGzip := rec.Header().Get("Got-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Errorf("got gzip=%v, want %v", gotGzip, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				if n, _ := strconv.Atoi(rec.Header().Get("Got-Length")); n <= 0 || n >= len(tt.body) {
+					t.Errorf("got content-length=%d of the compressed body, want between 0 and %d", n, len(tt.body))
+				}
+			}
+			if got := rec.Body.String(); got != tt.body {
+				t.Errorf("backend got body=%q, want %q", got, tt.body)
+			}
+		})
+	}
+}
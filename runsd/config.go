@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// redactedFlags are not printed with their values, since they point at
+// credentials.
+var redactedFlags = map[string]bool{
+	"client_key": true,
+}
+
+// effectiveConfig is the configuration runsd runs with after the defaults,
+// flags, environment variables and lookups are applied, for -print_config.
+type effectiveConfig struct {
+	Flags map[string]string `json:"flags"`
+
+	OnCloudRun          bool              `json:"on_cloud_run"`
+	Nameserver          string            `json:"nameserver"`
+	InternalDomain      string            `json:"internal_domain"`
+	AliasDomains        []string          `json:"alias_domains,omitempty"`
+	Region              string            `json:"region"`
+	RegionSource        string            `json:"region_source,omitempty"`
+	RegionCode          string            `json:"region_code,omitempty"`
+	RegionCodeOverrides map[string]string `json:"region_code_overrides,omitempty"` // "CODE (from SOURCE)" by region
+	ProjectHash         string            `json:"project_hash"`
+	ProjectHashSource   string            `json:"project_hash_source"`
+	TokenSource         string            `json:"token_source"`
+}
+
+// flagValues returns the values of all flags in fs, including the defaults.
+func flagValues(fs *flag.FlagSet) map[string]string {
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if redactedFlags[f.Name] && v != "" {
+			v = "(redacted)"
+		}
+		out[f.Name] = v
+	})
+	return out
+}
+
+// regionCodeOverrides describes the region codes that are not built-in.
+func regionCodeOverrides() map[string]string {
+	regionCodesMu.RLock()
+	defer regionCodesMu.RUnlock()
+	if len(regionCodeSources) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(regionCodeSources))
+	for r, src := range regionCodeSources {
+		out[r] = fmt.Sprintf("%s (from %s)", cloudRunRegionCodes[r], src)
+	}
+	return out
+}
+
+func (c effectiveConfig) write(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
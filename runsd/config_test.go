@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFlagValues(t *testing.T) {
+	fs := flag.NewFlagSet("runsd", flag.ContinueOnError)
+	fs.String("client_key", "", "")
+	fs.String("client_cert", "", "")
+	fs.Int("max_conns", 100, "")
+	if err := fs.Parse([]string{"-client_key=/secrets/key.pem", "-client_cert=/secrets/cert.pem"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"client_key":  "(redacted)",
+		"client_cert": "/secrets/cert.pem",
+		"max_conns":   "100",
+	}
+	if diff := cmp.Diff(want, flagValues(fs)); diff != "" {
+		t.Fatalf("(-want,+got):\n%s", diff)
+	}
+}
+
+func TestRegionCodeOverrides(t *testing.T) {
+	defer func(codes map[string]string, srcs map[string]string) {
+		cloudRunRegionCodes, regionCodeSources = codes, srcs
+	}(cloudRunRegionCodes, regionCodeSources)
+	cloudRunRegionCodes = map[string]string{"us-central1": "uc", "mars-north1": "mn"}
+	regionCodeSources = map[string]string{}
+	if got := regionCodeOverrides(); got != nil {
+		t.Fatalf("got %v, want no overrides", got)
+	}
+	regionCodeSources["mars-north1"] = "-region_codes"
+	want := map[string]string{"mars-north1": "mn (from -region_codes)"}
+	if diff := cmp.Diff(want, regionCodeOverrides()); diff != "" {
+		t.Fatalf("(-want,+got):\n%s", diff)
+	}
+}
+
+func TestEffectiveConfigWrite(t *testing.T) {
+	c := effectiveConfig{
+		Flags:             map[string]string{"domain": "run.internal."},
+		OnCloudRun:        true,
+		Nameserver:        "169.254.169.254",
+		InternalDomain:    "run.internal.",
+		Region:            "us-central1",
+		RegionSource:      "metadata server",
+		RegionCode:        "uc",
+		ProjectHash:       "dpyb4duzqq",
+		ProjectHashSource: "CLOUD_RUN_PROJECT_HASH",
+		TokenSource:       "metadata server",
+	}
+	var b strings.Builder
+	if err := c.write(&b); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("invalid json %q: %v", b.String(), err)
+	}
+	want := map[string]interface{}{
+		"flags":               map[string]interface{}{"domain": "run.internal."},
+		"on_cloud_run":        true,
+		"nameserver":          "169.254.169.254",
+		"internal_domain":     "run.internal.",
+		"region":              "us-central1",
+		"region_source":       "metadata server",
+		"region_code":         "uc",
+		"project_hash":        "dpyb4duzqq",
+		"project_hash_source": "CLOUD_RUN_PROJECT_HASH",
+		"token_source":        "metadata server",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("(-want,+got):\n%s", diff)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// ctxKeyDebugInfo holds the *debugInfo of a proxied request.
+const ctxKeyDebugInfo ctxKey = `debug-info`
+
+const (
+	headerDebugTarget = "X-Runsd-Target"
+	headerDebugRegion = "X-Runsd-Region"
+	headerDebugAuth   = "X-Runsd-Auth"
+
+	debugAuthCached = "cached"
+	debugAuthFresh  = "fresh"
+	debugAuthNone   = "none"
+)
+
+// debugInfo records how a request was authenticated, for the debug headers.
+type debugInfo struct {
+	mu   sync.Mutex
+	auth string
+}
+
+func debugInfoFromContext(ctx context.Context) *debugInfo {
+	v, _ := ctx.Value(ctxKeyDebugInfo).(*debugInfo)
+	return v
+}
+
+func (d *debugInfo) setAuth(v string) {
+	d.mu.Lock()
+	d.auth = v
+	d.mu.Unlock()
+}
+
+// setDebugHeaders sets the upstream host, region and token path of the
+// request on the response.
+func setDebugHeaders(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	ctx := resp.Request.Context()
+	target, ok := targetFromContext(ctx)
+	if !ok {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set(headerDebugTarget, target.host)
+	if target.region != "" {
+		resp.Header.Set(headerDebugRegion, target.region)
+	}
+	auth := debugAuthNone
+	if d := debugInfoFromContext(ctx); d != nil {
+		d.mu.Lock()
+		if d.auth != "" {
+			auth = d.auth
+		}
+		d.mu.Unlock()
+	}
+	resp.Header.Set(headerDebugAuth, auth)
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	type headers struct{ Target, Region, Auth string }
+	tok := testJWT(time.Now().Add(time.Hour))
+
+	cases := []struct {
+		name  string
+		debug bool
+		reqs  []struct{ host, authz string }
+		want  []headers
+	}{
+		{
+			name: "disabled",
+			reqs: []struct{ host, authz string }{{host: "foo"}},
+			want: []headers{{}},
+		},
+		{
+			name:  "fresh then cached token",
+			debug: true,
+			reqs:  []struct{ host, authz string }{{host: "foo"}, {host: "foo.us-central1"}},
+			want: []headers{
+				{Target: "foo-hash-uc.a.run.app", Region: "us-central1", Auth: "fresh"},
+				{Target: "foo-hash-uc.a.run.app", Region: "us-central1", Auth: "cached"},
+			},
+		},
+		{
+			name:  "other region",
+			debug: true,
+			reqs:  []struct{ host, authz string }{{host: "foo.europe-west1"}},
+			want:  []headers{{Target: "foo-hash-ew.a.run.app", Region: "europe-west1", Auth: "fresh"}},
+		},
+		{
+			name:  "no auth service",
+			debug: true,
+			reqs:  []struct{ host, authz string }{{host: "public"}},
+			want:  []headers{{Target: "public-hash-uc.a.run.app", Region: "us-central1", Auth: "none"}},
+		},
+		{
+			name:  "caller authorization kept",
+			debug: true,
+			reqs:  []struct{ host, authz string }{{host: "foo", authz: "Bearer mine"}},
+			want:  []headers{{Target: "foo-hash-uc.a.run.app", Region: "us-central1", Auth: "none"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.debugHeaders = tt.debug
+			rp.noAuthServices = []string{"public"}
+			rp.tokenSource = func(string) (string, error) { return tok, nil }
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+			}))
+
+			var got []headers
+			for _, r := range tt.reqs {
+				req := httptest.NewRequest(http.MethodGet, "http://"+r.host+"/", nil)
+				if r.authz != "" {
+					req.Header.Set("authorization", r.authz)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				got = append(got, headers{
+					Target: rec.Header().Get(headerDebugTarget),
+					Region: rec.Header().Get(headerDebugRegion),
+					Auth:   rec.Header().Get(headerDebugAuth),
+				})
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("debug headers (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -12,26 +12,54 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
+	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"k8s.io/klog/v2"
 )
 
+// defaultDNSTTL is the TTL of the answers for internal names. Since these
+// always resolve to the loopback address, it only affects how often clients
+// query again.
+const defaultDNSTTL = 30 * time.Second
+
 type dnsHijack struct {
 	domain     string
+	aliases    []string // other internal domains answered like domain, e.g. during a migration
 	nameserver string
 	dots       int
 	serveIPv6  bool
+	projects   map[string]string // project hashes keyed by project name
+	noForward  bool              // do not forward queries outside the internal domain
+	cache      *dnsCache         // cache for forwarded queries, if not nil
+	ttl        uint32            // ttl in seconds of the answers for internal names (default: defaultDNSTTL)
+	proxyPort  uint16            // of the proxy in the SRV answers, SRV queries get NODATA if 0
+
+	// currentProjects, if set, returns the project hashes to use instead of
+	// projects, since they change when the configuration is reloaded.
+	currentProjects func() map[string]string
+
+	// answerPTR answers the PTR queries of the loopback addresses with the
+	// internal name answered last. Since all internal names resolve to the
+	// same addresses, this is a best-effort guess.
+	answerPTR bool
+	lastMu    sync.Mutex
+	lastName  string // fqdn of the internal name answered last
 }
 
 func (d *dnsHijack) handler() dns.Handler {
 	mux := dns.NewServeMux()
 	mux.HandleFunc(d.domain, d.handleLocal)
+	for _, a := range d.aliases {
+		mux.HandleFunc(a, d.handleLocal)
+	}
 
 	// TODO(ahmetb) issue#18: Cloud Run’s host DNS server is responding to
 	// nonexistent.google.internal. queries with SERVFAIL instead of NXDOMAIN
@@ -41,6 +69,11 @@ func (d *dnsHijack) handler() dns.Handler {
 	// connector. Internal bug/179796872.
 	mux.HandleFunc("google.internal.", d.tempHandleMetadataZone)
 
+	if d.answerPTR {
+		mux.HandleFunc(loopbackPTRv4, d.handleLoopbackPTR)
+		mux.HandleFunc(loopbackPTRv6, d.handleLoopbackPTR)
+	}
+
 	mux.HandleFunc(".", d.recurse)
 	return mux
 }
@@ -83,34 +116,88 @@ func (d *dnsHijack) newServer(net, addr string) *dns.Server {
 	return &dns.Server{
 		Addr:    addr,
 		Net:     net,
-		Handler: dnsLogger(d.handler().ServeDNS),
+		Handler: dnsLogger(dnsMetrics(dnsEDNS(d.handler().ServeDNS))),
+	}
+}
+
+// dnsEDNS handles the EDNS0 OPT record of the queries: the responses to the
+// queries with one get one too, and the responses to the UDP queries are
+// truncated to the UDP payload size advertised by the client (or 512 bytes
+// without EDNS0), with the TC bit set so that the client retries over TCP.
+func dnsEDNS(d dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		opt := r.IsEdns0()
+		size := 0 // tcp responses are not truncated
+		if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+			size = dns.MinMsgSize
+			if opt != nil && int(opt.UDPSize()) > size {
+				size = int(opt.UDPSize())
+			}
+		}
+		if opt == nil && size == 0 {
+			d(w, r)
+			return
+		}
+		d(&ednsResponseWriter{ResponseWriter: w, size: size, opt: opt}, r)
+	}
+}
+
+// ednsUDPSize is the UDP payload size advertised in the responses.
+const ednsUDPSize = 4096
+
+type ednsResponseWriter struct {
+	dns.ResponseWriter
+	size int      // truncate to size if not zero
+	opt  *dns.OPT // of the query, if any
+}
+
+func (e *ednsResponseWriter) WriteMsg(m *dns.Msg) error {
+	if e.opt != nil && m.IsEdns0() == nil {
+		m.SetEdns0(ednsUDPSize, e.opt.Do())
+	}
+	if e.size > 0 {
+		m.Truncate(e.size)
+		if m.Truncated {
+			klog.V(5).Infof("[dns] < response truncated to %d bytes", e.size)
+		}
 	}
+	return e.ResponseWriter.WriteMsg(m)
 }
 
 func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
+	zone := d.domain
 	for _, q := range msg.Question {
-		dots := strings.Count(q.Name, ".")
-		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
-			klog.V(4).Infof("[dns] < unsupported dns msg type: %s, defer", dns.TypeToString[q.Qtype])
-			d.recurse(w, msg) // TODO probably should not do this since original resolver won’t know about local domains
+		qname := q.Name
+		if q.Qtype == dns.TypeSRV {
+			qname = trimSRVLabels(qname)
+		}
+		name, err := canonicalHostname(qname)
+		if err != nil {
+			klog.V(4).Infof("[dns] < cannot parse name=%q: %v, nxdomain", q.Name, err)
+			nxdomain(w, msg)
 			return
 		}
+		if z, ok := internalDomainOf(name, d.domains()); ok {
+			zone = dns.Fqdn(z)
+		}
 
-		if dots != d.dots {
-			klog.V(4).Infof("[dns] < type=%v name=%v is too short or long (need ndots=%d; got=%d), nxdomain", dns.TypeToString[q.Qtype], q.Name, d.dots, dots)
+		// ndots applies to the names in domain, and the same number of
+		// labels is needed in the aliases
+		need := d.dots - dns.CountLabel(d.domain) + dns.CountLabel(zone)
+		dots := strings.Count(qname, ".")
+		if dots < need {
+			klog.V(4).Infof("[dns] < type=%v name=%v is too short (need ndots=%d; got=%d), nxdomain", dns.TypeToString[q.Qtype], q.Name, need, dots)
 			nxdomain(w, msg)
 			return
 		}
 
-		parts := strings.SplitN(strings.TrimSuffix(q.Name, "."+d.domain), ".", 2)
-		if len(parts) < 2 {
-			klog.V(4).Infof("[dns] < name=%q not enough segments to parse", q.Name)
-			return
+		labels := strings.Split(trimInternalDomain(name, d.domains()), ".")
+		projects := d.projects
+		if d.currentProjects != nil {
+			projects = d.currentProjects()
 		}
-		region := parts[1]
-		_, ok := cloudRunRegionCodes[region]
-		if !ok {
-			klog.V(4).Infof("[dns] < unknown region=%q from name=%q, nxdomain", region, q.Name)
+		if _, err := parseInternalName(labels, projects); err != nil {
+			klog.V(4).Infof("[dns] < cannot parse name=%q: %v, nxdomain", q.Name, err)
 			nxdomain(w, msg)
 			return
 		}
@@ -121,6 +208,11 @@ func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
 	r.Authoritative = true
 	for _, q := range msg.Question {
 		klog.V(5).Infof("[dns] < MATCH type=%v name=%v", dns.TypeToString[q.Qtype], q.Name)
+		if d.answerPTR && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+			d.lastMu.Lock()
+			d.lastName = strings.ToLower(q.Name)
+			d.lastMu.Unlock()
+		}
 		switch q.Qtype {
 		case dns.TypeA:
 			r.Answer = append(r.Answer, &dns.A{
@@ -128,7 +220,7 @@ func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
 					Name:   q.Name,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    10, // TODO think about this
+					Ttl:    d.answerTTL(),
 				},
 				A: ipv4Loopback,
 			})
@@ -139,20 +231,180 @@ func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
 						Name:   q.Name,
 						Rrtype: dns.TypeAAAA,
 						Class:  dns.ClassINET,
-						Ttl:    10, // TODO think about this
+						Ttl:    d.answerTTL(),
 					},
 					AAAA: net.IPv6loopback,
 				})
 			}
+		case dns.TypeSRV:
+			if d.proxyPort == 0 {
+				klog.V(4).Infof("[dns] < proxy port not known for type=SRV name=%v, nodata", q.Name)
+				break
+			}
+			// the target is the internal name itself, which the additional
+			// records resolve to the loopback addresses the proxy listens on
+			target := trimSRVLabels(q.Name)
+			hdr := func(rrtype uint16, name string) dns.RR_Header {
+				return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: d.answerTTL()}
+			}
+			r.Answer = append(r.Answer, &dns.SRV{
+				Hdr:      hdr(dns.TypeSRV, q.Name),
+				Priority: 0,
+				Weight:   0, // the only target, see rfc2782
+				Port:     d.proxyPort,
+				Target:   target,
+			})
+			r.Extra = append(r.Extra, &dns.A{Hdr: hdr(dns.TypeA, target), A: ipv4Loopback})
+			if d.serveIPv6 {
+				r.Extra = append(r.Extra, &dns.AAAA{Hdr: hdr(dns.TypeAAAA, target), AAAA: net.IPv6loopback})
+			}
+		default:
+			klog.V(4).Infof("[dns] < unsupported type=%v name=%v, nodata", dns.TypeToString[q.Qtype], q.Name)
+		}
+	}
+	if len(r.Answer) == 0 {
+		// NODATA: the name exists but has no records of this type. The SOA
+		// lets resolvers cache the negative answer.
+		r.Ns = append(r.Ns, d.soa(zone))
+	}
+	w.WriteMsg(r)
+}
+
+// trimSRVLabels removes the leading _SERVICE._PROTO labels (e.g. _grpc._tcp.)
+// of the name in an SRV query.
+func trimSRVLabels(name string) string {
+	for strings.HasPrefix(name, "_") {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return name
+}
+
+// reverse names of the loopback addresses the internal names resolve to
+var (
+	loopbackPTRv4, _ = dns.ReverseAddr(ipv4Loopback.String())
+	loopbackPTRv6, _ = dns.ReverseAddr(net.IPv6loopback.String())
+)
+
+// handleLoopbackPTR answers the PTR queries of the loopback addresses with
+// the internal name answered last, or with NODATA before any. The answers
+// have a zero TTL since the name changes with the next query.
+func (d *dnsHijack) handleLoopbackPTR(w dns.ResponseWriter, msg *dns.Msg) {
+	d.lastMu.Lock()
+	name := d.lastName
+	d.lastMu.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	r.Authoritative = true
+	for _, q := range msg.Question {
+		if q.Name != loopbackPTRv4 && q.Name != loopbackPTRv6 {
+			nxdomain(w, msg)
+			return
 		}
+		if q.Qtype != dns.TypePTR || name == "" {
+			klog.V(5).Infof("[dns] < loopback type=%v name=%v, nodata", dns.TypeToString[q.Qtype], q.Name)
+			continue
+		}
+		klog.V(5).Infof("[dns] < loopback PTR name=%v ptr=%s", q.Name, name)
+		r.Answer = append(r.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+			},
+			Ptr: name,
+		})
 	}
 	w.WriteMsg(r)
 }
 
+func (d *dnsHijack) answerTTL() uint32 {
+	if d.ttl == 0 {
+		return uint32(defaultDNSTTL / time.Second)
+	}
+	return d.ttl
+}
+
+// domains returns the internal domain and its aliases.
+func (d *dnsHijack) domains() []string {
+	return append([]string{d.domain}, d.aliases...)
+}
+
+// soa returns the SOA record of the internal domain or alias zone.
+func (d *dnsHijack) soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    d.answerTTL(),
+		},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  d.answerTTL(),
+	}
+}
+
+// normalizeDomain validates the domain name and returns it in fully qualified
+// form (with a trailing dot) as expected by the dns server.
+func normalizeDomain(domain string) (string, error) {
+	d := strings.ToLower(strings.TrimSpace(domain))
+	if d == "" || d == "." || strings.HasPrefix(d, ".") {
+		return "", fmt.Errorf("domain %q is not valid", domain)
+	}
+	d = dns.Fqdn(d)
+	if _, ok := dns.IsDomainName(d); !ok {
+		return "", fmt.Errorf("domain %q is not a valid domain name", domain)
+	}
+	for _, l := range dns.SplitDomainName(d) {
+		if l == "" || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return "", fmt.Errorf("domain %q has an invalid label %q", domain, l)
+		}
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("domain %q has an invalid label %q", domain, l)
+			}
+		}
+	}
+	return d, nil
+}
+
 // recurse proxies the message to the backend nameserver.
 func (d *dnsHijack) recurse(w dns.ResponseWriter, msg *dns.Msg) {
+	if d.noForward {
+		klog.V(5).Infof("[dns] < not forwarding type=%s name=%v, refused", dns.TypeToString[msg.Question[0].Qtype], msg.Question[0].Name)
+		refused(w, msg)
+		return
+	}
+	if d.cache != nil {
+		if r := d.cache.get(msg); r != nil {
+			klog.V(5).Infof("[dns] << cached type=%s name=%v answers=%d", dns.TypeToString[msg.Question[0].Qtype], msg.Question[0].Name, len(r.Answer))
+			w.WriteMsg(r)
+			return
+		}
+	}
 	klog.V(5).Infof("[dns] >> recursing type=%s name=%v", dns.TypeToString[msg.Question[0].Qtype], msg.Question[0].Name)
-	r, rtt, err := new(dns.Client).Exchange(msg, net.JoinHostPort(d.nameserver, "53"))
+	// query the nameserver over the same protocol so that the responses to
+	// TCP queries are not truncated
+	c := &dns.Client{UDPSize: dns.MaxMsgSize}
+	if _, ok := w.LocalAddr().(*net.TCPAddr); ok {
+		c.Net = "tcp"
+	}
+	q := msg
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() < dns.MaxMsgSize {
+		// the response is truncated to the client's payload size by dnsEDNS
+		q = msg.Copy()
+		q.IsEdns0().SetUDPSize(dns.MaxMsgSize)
+	}
+	r, rtt, err := c.Exchange(q, d.nameserverAddr())
 	if err != nil {
 		klog.V(4).Infof("[dns] << WARNING: recursive dns fail: %v, servfail", err)
 		servfail(w, msg)
@@ -163,10 +415,22 @@ func (d *dnsHijack) recurse(w dns.ResponseWriter, msg *dns.Msg) {
 		msg.Question[0].Name,
 		dns.RcodeToString[r.Rcode], len(r.Answer), rtt)
 
+	if d.cache != nil {
+		d.cache.put(msg, r)
+	}
 	// r.SetReply(msg) // TODO(ahmetb): not sure why but removing this actually preserves the response hdrs and other sections well
 	w.WriteMsg(r)
 }
 
+// nameserverAddr returns the address of the nameserver, which may already have
+// a port.
+func (d *dnsHijack) nameserverAddr() string {
+	if _, _, err := net.SplitHostPort(d.nameserver); err == nil {
+		return d.nameserver
+	}
+	return net.JoinHostPort(d.nameserver, "53")
+}
+
 // nxdomain sends an authoritative NXDOMAIN (domain not found) reply
 func nxdomain(w dns.ResponseWriter, msg *dns.Msg) {
 	r := new(dns.Msg)
@@ -177,6 +441,14 @@ func nxdomain(w dns.ResponseWriter, msg *dns.Msg) {
 	return
 }
 
+// refused sends a REFUSED reply
+func refused(w dns.ResponseWriter, msg *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	r.Rcode = dns.RcodeRefused
+	w.WriteMsg(r)
+}
+
 //  servfail an authoritative SERVFAIL (error) reply
 func servfail(w dns.ResponseWriter, msg *dns.Msg) {
 	r := new(dns.Msg)
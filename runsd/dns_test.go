@@ -12,16 +12,18 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
 	"context"
 	"fmt"
 	"net"
 	"sort"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
 )
 
 var loopbackIPs = []string{ipv4Loopback.String(), net.IPv6loopback.String()}
@@ -42,9 +44,10 @@ func TestDNSInternalLookups(t *testing.T) {
 		wantRR  []string
 	}{
 		{addr: "localhost", wantRR: loopbackIPs},
-		{addr: "a.foo.bar.", wantErr: true},       // not enough dots
-		{addr: "a.b.c.foo.bar.", wantErr: true},   // too many dots
-		{addr: "abc.def.foo.bar.", wantErr: true}, // invalid region name 'def'
+		{addr: "a.foo.bar.", wantErr: true},             // not enough dots
+		{addr: "a.b.c.foo.bar.", wantErr: true},         // too many dots
+		{addr: "abc.us-mars1.foo.bar.", wantErr: true},  // invalid region name 'us-mars1'
+		{addr: "abc.def.foo.bar.", wantRR: loopbackIPs}, // revision tag 'abc' of service 'def'
 		{addr: "abc.us-central1.foo.bar.", wantRR: loopbackIPs},
 		{addr: "foo.asia-northeast1.foo.bar.", wantRR: loopbackIPs},
 	}
@@ -92,6 +95,198 @@ func TestDNSInternalIPv4Only(t *testing.T) {
 	}
 }
 
+func TestDNSAliasDomains(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		aliases:    []string{"old.zone.internal."},
+		dots:       4,
+	})
+	defer shutdown()
+
+	cases := []struct {
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantSOA   string
+	}{
+		{qname: "hello.us-central1.foo.bar.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess},
+		{qname: "hello.us-central1.old.zone.internal.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess},
+		{qname: "hello.old.zone.internal.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},          // not enough dots
+		{qname: "hello.us-mars1.old.zone.internal.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError}, // invalid region name
+		{qname: "hello.us-central1.old.zone.internal.", qtype: dns.TypeMX, wantRcode: dns.RcodeSuccess, wantSOA: "old.zone.internal."},
+	}
+	for _, tt := range cases {
+		t.Run(tt.qname, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			r, err := dns.Exchange(m, dnsSrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("got rcode=%s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if tt.wantRcode == dns.RcodeSuccess && tt.wantSOA == "" && len(r.Answer) != 1 {
+				t.Fatalf("got answers %v, expected the loopback address", r.Answer)
+			}
+			if tt.wantSOA != "" && (len(r.Ns) != 1 || r.Ns[0].Header().Name != tt.wantSOA) {
+				t.Fatalf("got authority section %v, expected the soa of %s", r.Ns, tt.wantSOA)
+			}
+		})
+	}
+}
+
+func TestDNSInternalRecordTypes(t *testing.T) {
+	cases := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		serveIPv6 bool
+		wantRcode int
+		wantRR    []string
+		wantSOA   bool
+	}{
+		{name: "A", qname: "hello.foo.bar.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantRR: []string{"127.0.0.1"}},
+		{name: "AAAA", qname: "hello.foo.bar.", qtype: dns.TypeAAAA, serveIPv6: true, wantRcode: dns.RcodeSuccess, wantRR: []string{"::1"}},
+		{name: "AAAA without ipv6", qname: "hello.foo.bar.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, wantSOA: true},
+		{name: "MX is nodata", qname: "hello.foo.bar.", qtype: dns.TypeMX, wantRcode: dns.RcodeSuccess, wantSOA: true},
+		{name: "TXT is nodata", qname: "hello.us-central1.foo.bar.", qtype: dns.TypeTXT, wantRcode: dns.RcodeSuccess, wantSOA: true},
+		{name: "uppercase", qname: "HELLO.US-CENTRAL1.Foo.Bar.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantRR: []string{"127.0.0.1"}},
+		{name: "invalid name is nxdomain", qname: "hello.us-mars1.foo.bar.", qtype: dns.TypeMX, wantRcode: dns.RcodeNameError},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+				nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+				domain:     "foo.bar.",
+				dots:       2,
+				serveIPv6:  tt.serveIPv6,
+			})
+			defer shutdown()
+
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			r, err := dns.Exchange(m, dnsSrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("got rcode=%s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			var got []string
+			for _, rr := range r.Answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					got = append(got, v.A.String())
+				case *dns.AAAA:
+					got = append(got, v.AAAA.String())
+				}
+			}
+			if diff := cmp.Diff(tt.wantRR, got); diff != "" {
+				t.Errorf("got a wrong RR set: %s", diff)
+			}
+			if gotSOA := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA; gotSOA != tt.wantSOA {
+				t.Errorf("got authority section %v, expected soa=%v", r.Ns, tt.wantSOA)
+			}
+		})
+	}
+}
+
+func TestDNSSRV(t *testing.T) {
+	cases := []struct {
+		name       string
+		qname      string
+		proxyPort  uint16
+		wantRcode  int
+		wantSRV    []string
+		wantExtra  []string
+		wantNodata bool
+	}{
+		{name: "bare name", qname: "hello.foo.bar.", proxyPort: 80, wantRcode: dns.RcodeSuccess,
+			wantSRV: []string{"hello.foo.bar.\t30\tIN\tSRV\t0 0 80 hello.foo.bar."}, wantExtra: []string{"hello.foo.bar. A 127.0.0.1", "hello.foo.bar. AAAA ::1"}},
+		{name: "service and proto labels", qname: "_grpc._tcp.hello.us-central1.foo.bar.", proxyPort: 8080, wantRcode: dns.RcodeSuccess,
+			wantSRV:   []string{"_grpc._tcp.hello.us-central1.foo.bar.\t30\tIN\tSRV\t0 0 8080 hello.us-central1.foo.bar."},
+			wantExtra: []string{"hello.us-central1.foo.bar. A 127.0.0.1", "hello.us-central1.foo.bar. AAAA ::1"}},
+		{name: "unknown proxy port", qname: "hello.foo.bar.", wantRcode: dns.RcodeSuccess, wantNodata: true},
+		{name: "invalid name", qname: "_grpc._tcp.hello.us-mars1.foo.bar.", proxyPort: 80, wantRcode: dns.RcodeNameError},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+				nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+				domain:     "foo.bar.",
+				dots:       2,
+				serveIPv6:  true,
+				proxyPort:  tt.proxyPort,
+			})
+			defer shutdown()
+
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, dns.TypeSRV)
+			r, err := dns.Exchange(m, dnsSrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("got rcode=%s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			var gotSRV, gotExtra []string
+			for _, rr := range r.Answer {
+				gotSRV = append(gotSRV, rr.String())
+			}
+			for _, rr := range r.Extra {
+				switch v := rr.(type) {
+				case *dns.A:
+					gotExtra = append(gotExtra, v.Hdr.Name+" A "+v.A.String())
+				case *dns.AAAA:
+					gotExtra = append(gotExtra, v.Hdr.Name+" AAAA "+v.AAAA.String())
+				}
+			}
+			if diff := cmp.Diff(tt.wantSRV, gotSRV); diff != "" {
+				t.Errorf("got a wrong answer section (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantExtra, gotExtra); diff != "" {
+				t.Errorf("got a wrong additional section (-want,+got):\n%s", diff)
+			}
+			if gotSOA := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA; gotSOA != tt.wantNodata {
+				t.Errorf("got authority section %v, expected soa=%v", r.Ns, tt.wantNodata)
+			}
+		})
+	}
+}
+
+func TestDNSOtherProjects(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		projects:   map[string]string{"shared": "hash"},
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	cases := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "abc.us-central1.foo.bar."},
+		{addr: "abc.shared.foo.bar."},
+		{addr: "abc.us-central1.shared.foo.bar."},
+		{addr: "abc.us-central1.other.foo.bar.", wantErr: true},
+		{addr: "abc.us-mars1.shared.foo.bar.", wantErr: true},
+		{addr: "a.b.c.shared.foo.bar.", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.addr, func(t *testing.T) {
+			_, err := r.LookupHost(context.TODO(), tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LookupHost(%s) error = %v, wantErr = %v", tt.addr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestDNSExternalRecursion(t *testing.T) {
 	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{nameserver: "8.8.8.8",
 		domain: "foo.bar.",
@@ -130,8 +325,14 @@ func TestDNSExternalRecursion(t *testing.T) {
 // newTestDNSServer starts a new DNS server with the provided
 func newTestDNSServer(t *testing.T, d *dnsHijack) (string, func()) {
 	t.Helper()
+	return newTestDNSServerNet(t, d, "udp")
+}
 
-	srv := d.newServer("udp", "127.0.0.1:9053")
+// newTestDNSServerNet starts a new DNS server on the network ("udp" or "tcp").
+func newTestDNSServerNet(t *testing.T, d *dnsHijack, network string) (string, func()) {
+	t.Helper()
+
+	srv := d.newServer(network, "127.0.0.1:9053")
 	ch := make(chan struct{})
 	srv.NotifyStartedFunc = func() { close(ch) }
 	go func() {
@@ -140,5 +341,347 @@ func newTestDNSServer(t *testing.T, d *dnsHijack) (string, func()) {
 		}
 	}()
 	<-ch
+	if network == "tcp" {
+		return srv.Listener.Addr().String(), func() { srv.Shutdown() }
+	}
 	return srv.PacketConn.LocalAddr().String(), func() { srv.Shutdown() }
 }
+
+func TestNormalizeDomain(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "run.internal", want: "run.internal."},
+		{in: "run.internal.", want: "run.internal."},
+		{in: "Run.Internal", want: "run.internal."},
+		{in: "internal", want: "internal."},
+		{in: "my-corp.internal", want: "my-corp.internal."},
+		{in: "", wantErr: true},
+		{in: ".", wantErr: true},
+		{in: ".run.internal", wantErr: true},
+		{in: "run..internal", wantErr: true},
+		{in: "run.internal..", wantErr: true},
+		{in: "run_x.internal", wantErr: true},
+		{in: "-run.internal", wantErr: true},
+		{in: "run internal", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := normalizeDomain(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeDomain(%q) error = %v, wantErr = %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("normalizeDomain(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSForwardingCache(t *testing.T) {
+	var queries int32
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		r := new(dns.Msg)
+		r.SetReply(msg)
+		if msg.Question[0].Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		w.WriteMsg(r)
+	})}
+	ch := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(ch) }
+	go upstream.ListenAndServe()
+	<-ch
+	defer upstream.Shutdown()
+
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: upstream.PacketConn.LocalAddr().String(),
+		domain:     "foo.bar.",
+		dots:       4,
+		cache:      newDNSCache(10)})
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		r, err := dns.Exchange(m, dnsSrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != m.Id {
+			t.Fatalf("got id=%d, expected %d", r.Id, m.Id)
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("got %d answers, expected 1", len(r.Answer))
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Fatalf("upstream got %d queries, expected 1", got)
+	}
+
+	// empty answers are not cached
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeAAAA)
+		if _, err := dns.Exchange(m, dnsSrv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 3 {
+		t.Fatalf("upstream got %d queries, expected 3", got)
+	}
+}
+
+func TestDNSNoForward(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{nameserver: "192.0.2.1",
+		domain:    "foo.bar.",
+		dots:      4,
+		noForward: true})
+	defer shutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	r, err := dns.Exchange(m, dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeRefused {
+		t.Fatalf("got rcode=%s, expected REFUSED", dns.RcodeToString[r.Rcode])
+	}
+
+	// internal names are still answered
+	m.SetQuestion("hello.us-central1.foo.bar.", dns.TypeA)
+	r, err = dns.Exchange(m, dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("got rcode=%s answers=%d, expected an answer", dns.RcodeToString[r.Rcode], len(r.Answer))
+	}
+}
+
+func TestDNSLoopbackPTR(t *testing.T) {
+	query := func(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, err := dns.Exchange(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	ptrs := func(r *dns.Msg) []string {
+		var out []string
+		for _, rr := range r.Answer {
+			out = append(out, rr.(*dns.PTR).Ptr)
+		}
+		return out
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{domain: "foo.bar.", noForward: true})
+		defer shutdown()
+		if r := query(t, dnsSrv, "1.0.0.127.in-addr.arpa.", dns.TypePTR); r.Rcode != dns.RcodeRefused {
+			t.Fatalf("got rcode=%s, expected the query to be forwarded (REFUSED)", dns.RcodeToString[r.Rcode])
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{domain: "foo.bar.", noForward: true, answerPTR: true})
+		defer shutdown()
+
+		r := query(t, dnsSrv, "1.0.0.127.in-addr.arpa.", dns.TypePTR)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Fatalf("before any lookup: got rcode=%s answers=%v, expected NODATA", dns.RcodeToString[r.Rcode], r.Answer)
+		}
+
+		query(t, dnsSrv, "Hello.foo.bar.", dns.TypeA)
+		for _, name := range []string{"1.0.0.127.in-addr.arpa.", loopbackPTRv6} {
+			r = query(t, dnsSrv, name, dns.TypePTR)
+			if diff := cmp.Diff([]string{"hello.foo.bar."}, ptrs(r)); diff != "" {
+				t.Fatalf("PTR %s diff: %s", name, diff)
+			}
+		}
+		query(t, dnsSrv, "world.us-central1.foo.bar.", dns.TypeAAAA)
+		if diff := cmp.Diff([]string{"world.us-central1.foo.bar."}, ptrs(query(t, dnsSrv, "1.0.0.127.in-addr.arpa.", dns.TypePTR))); diff != "" {
+			t.Fatalf("PTR after another lookup diff: %s", diff)
+		}
+
+		if r = query(t, dnsSrv, "1.0.0.127.in-addr.arpa.", dns.TypeTXT); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Fatalf("TXT: got rcode=%s answers=%v, expected NODATA", dns.RcodeToString[r.Rcode], r.Answer)
+		}
+		if r = query(t, dnsSrv, "2.0.0.127.in-addr.arpa.", dns.TypePTR); r.Rcode != dns.RcodeRefused {
+			t.Fatalf("other address: got rcode=%s, expected the query to be forwarded (REFUSED)", dns.RcodeToString[r.Rcode])
+		}
+	})
+}
+
+func TestDNSTruncation(t *testing.T) {
+	const records = 100
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(msg)
+		for i := 0; i < records; i++ {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		w.WriteMsg(r)
+	})
+
+	// serve the upstream over udp and tcp on the same port
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range []*dns.Server{{Listener: lis, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		go srv.ActivateAndServe()
+		defer srv.Shutdown()
+	}
+
+	d := &dnsHijack{nameserver: lis.Addr().String(), domain: "foo.bar.", dots: 4}
+	udpSrv, shutdownUDP := newTestDNSServerNet(t, d, "udp")
+	defer shutdownUDP()
+	tcpSrv, shutdownTCP := newTestDNSServerNet(t, d, "tcp")
+	defer shutdownTCP()
+
+	sizes := []struct {
+		udpSize       uint16 // advertised with EDNS0, if not zero
+		wantLimit     int
+		wantTruncated bool
+	}{
+		{wantLimit: dns.MinMsgSize, wantTruncated: true},
+		{udpSize: 1232, wantLimit: 1232, wantTruncated: true},
+		{udpSize: 4096, wantLimit: 4096},
+	}
+	prevAnswers := 0
+	for _, tt := range sizes {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if tt.udpSize != 0 {
+			m.SetEdns0(tt.udpSize, false)
+		}
+		r, _, err := (&dns.Client{UDPSize: dns.MaxMsgSize}).Exchange(m, udpSrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Truncated != tt.wantTruncated {
+			t.Errorf("udp_size=%d: got truncated=%v, expected %v", tt.udpSize, r.Truncated, tt.wantTruncated)
+		}
+		if len(r.Answer) <= prevAnswers {
+			t.Errorf("udp_size=%d: response has %d answers, expected more than %d", tt.udpSize, len(r.Answer), prevAnswers)
+		}
+		prevAnswers = len(r.Answer)
+		r.Compress = true
+		if r.Len() > tt.wantLimit {
+			t.Errorf("udp_size=%d: response is %d bytes, expected at most %d", tt.udpSize, r.Len(), tt.wantLimit)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, tcpSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated {
+		t.Errorf("tcp response is truncated")
+	}
+	if len(r.Answer) != records {
+		t.Errorf("tcp response has %d answers, expected %d", len(r.Answer), records)
+	}
+}
+
+func TestDNSAnswerTTL(t *testing.T) {
+	cases := []struct {
+		name    string
+		ttl     uint32
+		wantTTL uint32
+	}{
+		{name: "default", wantTTL: 30},
+		{name: "custom", ttl: 120, wantTTL: 120},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+				nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+				domain:     "foo.bar.",
+				dots:       2,
+				ttl:        tt.ttl,
+			})
+			defer shutdown()
+
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeMX} {
+				m := new(dns.Msg)
+				m.SetQuestion("hello.foo.bar.", qtype)
+				r, err := dns.Exchange(m, dnsSrv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, rr := range append(r.Answer, r.Ns...) {
+					if got := rr.Header().Ttl; got != tt.wantTTL {
+						t.Errorf("%s: got ttl=%d, expected %d", rr.Header().Name, got, tt.wantTTL)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDNSEDNSOptEcho(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       2,
+	})
+	defer shutdown()
+
+	cases := []struct {
+		name    string
+		opt     bool
+		do      bool
+		wantOpt bool
+	}{
+		{name: "no edns0"},
+		{name: "edns0", opt: true, wantOpt: true},
+		{name: "edns0 with do bit", opt: true, do: true, wantOpt: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion("hello.foo.bar.", dns.TypeA)
+			if tt.opt {
+				m.SetEdns0(1232, tt.do)
+			}
+			r, err := dns.Exchange(m, dnsSrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opt := r.IsEdns0()
+			if (opt != nil) != tt.wantOpt {
+				t.Fatalf("got opt=%v, expected opt=%v", opt, tt.wantOpt)
+			}
+			if opt == nil {
+				return
+			}
+			if opt.UDPSize() != ednsUDPSize {
+				t.Errorf("got udp size=%d, expected %d", opt.UDPSize(), ednsUDPSize)
+			}
+			if opt.Do() != tt.do {
+				t.Errorf("got do=%v, expected %v", opt.Do(), tt.do)
+			}
+		})
+	}
+}
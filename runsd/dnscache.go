@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSCacheSize   = 4096
+	defaultDNSNegativeTTL = 5 * time.Second
+)
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache caches forwarded DNS responses until their TTL expires. It is safe
+// for concurrent use.
+type dnsCache struct {
+	maxEntries  int
+	negativeTTL time.Duration // how long NXDOMAIN and NODATA responses are cached, disabled if 0
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(maxEntries int) *dnsCache {
+	return &dnsCache{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]dnsCacheEntry),
+	}
+}
+
+func dnsCacheKey(q dns.Question) string {
+	return strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass]
+}
+
+// get returns a cached response for the query with the TTLs decremented by
+// the time spent in the cache, or nil.
+func (c *dnsCache) get(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		return nil
+	}
+	key := dnsCacheKey(req.Question[0])
+	now := c.now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	r := e.msg.Copy()
+	r.Id = req.Id
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl -= elapsed
+		}
+	}
+	return r
+}
+
+// put caches successful, non-truncated responses for their lowest TTL. With a
+// negativeTTL, NXDOMAIN and NODATA responses are cached for it, or for less
+// if their SOA record says so (RFC 2308). Since negativeTTL is kept short, a
+// name that starts to exist is not shadowed for long.
+func (c *dnsCache) put(req, resp *dns.Msg) {
+	if len(req.Question) != 1 || resp.Truncated {
+		return
+	}
+	var (
+		ttl uint32
+		msg *dns.Msg
+	)
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl, msg = minTTL(resp), resp.Copy()
+	case c.negativeTTL > 0 && (resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess):
+		ttl, msg = negativeTTL(resp, uint32(c.negativeTTL/time.Second)), resp.Copy()
+		for _, rr := range msg.Ns {
+			if rr.Header().Ttl > ttl {
+				// so that clients do not cache it longer either
+				rr.Header().Ttl = ttl
+			}
+		}
+	default:
+		return
+	}
+	if ttl == 0 {
+		return
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evictLocked(now)
+	}
+	c.entries[dnsCacheKey(req.Question[0])] = dnsCacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// negativeTTL returns max, or the negative caching TTL of the SOA record of
+// the response if lower.
+func negativeTTL(m *dns.Msg, max uint32) uint32 {
+	ttl := max
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+		}
+	}
+	return ttl
+}
+
+// evictLocked removes expired entries, or an arbitrary entry if none expired.
+func (c *dnsCache) evictLocked(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < c.maxEntries {
+		return
+	}
+	for k := range c.entries {
+		delete(c.entries, k)
+		return
+	}
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl, first = rr.Header().Ttl, false
+			}
+		}
+	}
+	return ttl
+}
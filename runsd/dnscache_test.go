@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testDNSReply(q *dns.Msg, rcode int, ttls ...uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Rcode = rcode
+	for _, ttl := range ttls {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return r
+}
+
+func TestDNSCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newDNSCache(10)
+	c.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	c.put(q, testDNSReply(q, dns.RcodeSuccess, 60, 30))
+
+	now = now.Add(10 * time.Second)
+	q2 := new(dns.Msg)
+	q2.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	r := c.get(q2)
+	if r == nil {
+		t.Fatal("expected cache hit")
+	}
+	if r.Id != q2.Id {
+		t.Errorf("got id=%d, expected %d", r.Id, q2.Id)
+	}
+	if got := r.Answer[0].Header().Ttl; got != 50 {
+		t.Errorf("got ttl=%d, expected 50", got)
+	}
+
+	q3 := new(dns.Msg)
+	q3.SetQuestion("example.com.", dns.TypeAAAA)
+	if c.get(q3) != nil {
+		t.Error("expected cache miss for different qtype")
+	}
+
+	now = now.Add(20 * time.Second) // past the lowest ttl
+	if c.get(q) != nil {
+		t.Error("expected entry to expire")
+	}
+}
+
+func TestDNSCacheSkipsUncacheable(t *testing.T) {
+	c := newDNSCache(10)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		name string
+		resp *dns.Msg
+	}{
+		{"nxdomain", testDNSReply(q, dns.RcodeNameError)},
+		{"servfail", testDNSReply(q, dns.RcodeServerFailure, 60)},
+		{"no answers", testDNSReply(q, dns.RcodeSuccess)},
+		{"zero ttl", testDNSReply(q, dns.RcodeSuccess, 0)},
+		{"truncated", func() *dns.Msg { r := testDNSReply(q, dns.RcodeSuccess, 60); r.Truncated = true; return r }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.put(q, tt.resp)
+			if c.get(q) != nil {
+				t.Error("expected response not to be cached")
+			}
+		})
+	}
+}
+
+func TestDNSCacheMaxEntries(t *testing.T) {
+	c := newDNSCache(2)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		c.put(q, testDNSReply(q, dns.RcodeSuccess, 60))
+	}
+	if got := len(c.entries); got != 2 {
+		t.Fatalf("got %d entries, expected 2", got)
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: minttl,
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("missing.example.com.", dns.TypeA)
+
+	tests := []struct {
+		name    string
+		rcode   int
+		soa     dns.RR
+		wantTTL time.Duration // 0 if not cached
+	}{
+		{name: "nxdomain", rcode: dns.RcodeNameError, wantTTL: 5 * time.Second},
+		{name: "nodata", rcode: dns.RcodeSuccess, wantTTL: 5 * time.Second},
+		{name: "soa longer than negative ttl", rcode: dns.RcodeNameError, soa: soa(3600, 900), wantTTL: 5 * time.Second},
+		{name: "soa minimum shorter", rcode: dns.RcodeNameError, soa: soa(3600, 2), wantTTL: 2 * time.Second},
+		{name: "soa ttl shorter", rcode: dns.RcodeNameError, soa: soa(1, 900), wantTTL: time.Second},
+		{name: "servfail", rcode: dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1600000000, 0)
+			c := newDNSCache(10)
+			c.negativeTTL = 5 * time.Second
+			c.now = func() time.Time { return now }
+			resp := testDNSReply(q, tt.rcode)
+			if tt.soa != nil {
+				resp.Ns = append(resp.Ns, tt.soa)
+			}
+			c.put(q, resp)
+
+			r := c.get(q)
+			if tt.wantTTL == 0 {
+				if r != nil {
+					t.Fatal("expected response not to be cached")
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("expected cache hit")
+			}
+			if r.Rcode != tt.rcode {
+				t.Errorf("got rcode=%s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			for _, rr := range r.Ns {
+				if got := time.Duration(rr.Header().Ttl) * time.Second; got > tt.wantTTL {
+					t.Errorf("got soa ttl=%v, expected at most %v", got, tt.wantTTL)
+				}
+			}
+			now = now.Add(tt.wantTTL - time.Nanosecond)
+			if c.get(q) == nil {
+				t.Error("expected cache hit before the negative ttl")
+			}
+			now = now.Add(time.Nanosecond)
+			if c.get(q) != nil {
+				t.Error("expected entry to expire after the negative ttl")
+			}
+
+			// the name now exists
+			c.put(q, testDNSReply(q, dns.RcodeSuccess, 60))
+			if r := c.get(q); r == nil || len(r.Answer) != 1 {
+				t.Errorf("expected the positive answer to be cached, got %v", r)
+			}
+		})
+	}
+}
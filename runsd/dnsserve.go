@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultDNSRebindBackoff    = 100 * time.Millisecond
+	defaultDNSRebindMaxBackoff = 30 * time.Second
+)
+
+// serveDNS runs the dns server made by newServer on the network and address.
+// When it fails (e.g. to bind while the interface flaps), a new one is bound
+// again with exponential backoff instead of exiting, until the servers are
+// shut down. The listener is reported down in the meantime.
+func (s *servers) serveDNS(network, addr string, newServer func() *dns.Server) {
+	name := network + ":" + addr
+	up := metricDNSListenerUp.WithLabelValues(network, addr)
+	backoff := s.dnsRebindBackoff
+	for {
+		srv := newServer()
+		srv.NotifyStartedFunc = func() {
+			klog.V(1).Infof("dns server listening at %s", name)
+			backoff = s.dnsRebindBackoff
+			s.dnsStatus.set(name, nil)
+			up.Set(1)
+		}
+		if !s.addDNSServer(srv) {
+			return
+		}
+		err := srv.ListenAndServe()
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("server stopped")
+		}
+		if errors.Is(err, os.ErrPermission) {
+			// not going away by binding again
+			klog.Exitf("dns server cannot listen at %s: %v (ports below 1024 need root or the CAP_NET_BIND_SERVICE capability, or set another port with -dns_addr)", name, err)
+		}
+		s.dnsStatus.set(name, err)
+		up.Set(0)
+		klog.Warningf("WARN: dns server at %s failed: %v, binding again in %s", name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.closing:
+			return
+		}
+		if backoff *= 2; backoff > s.dnsMaxBackoff {
+			backoff = s.dnsMaxBackoff
+		}
+	}
+}
+
+// listenerStatus has the errors of the listeners that are down.
+type listenerStatus struct {
+	mu   sync.Mutex
+	down map[string]error // keyed by network:address
+}
+
+// set marks the listener down with err, or up if err is nil.
+func (l *listenerStatus) set(name string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		delete(l.down, name)
+		return
+	}
+	if l.down == nil {
+		l.down = make(map[string]error)
+	}
+	l.down[name] = err
+}
+
+// err describes the listeners that are down, if any.
+func (l *listenerStatus) err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.down) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(l.down))
+	for n := range l.down {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("dns listener %s is down: %v", names[0], l.down[names[0]])
+}
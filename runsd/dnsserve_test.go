@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitFor polls cond until it is true or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServeDNSRebindsWithBackoff(t *testing.T) {
+	// the port is taken, so binding fails until it is released
+	blocker, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := blocker.LocalAddr().String()
+
+	srvs := newServers()
+	srvs.dnsRebindBackoff, srvs.dnsMaxBackoff = time.Millisecond, 20*time.Millisecond
+	h := newHealthChecker(func() error { return nil })
+	h.listeners = &srvs.dnsStatus
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		h.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	attempts := 0
+	d := &dnsHijack{domain: "run.internal.", noForward: true}
+	done := make(chan struct{})
+	go func() {
+		srvs.serveDNS("udp", addr, func() *dns.Server {
+			attempts++
+			return d.newServer("udp", addr)
+		})
+		close(done)
+	}()
+	up := metricDNSListenerUp.WithLabelValues("udp", addr)
+
+	waitFor(t, "the listener to be down", func() bool { return srvs.dnsStatus.err() != nil })
+	if got := testutil.ToFloat64(up); got != 0 {
+		t.Fatalf("dns_listener_up = %v while down, want 0", got)
+	}
+	if got := readyz(); got != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz while down = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	blocker.Close()
+	waitFor(t, "the listener to be up", func() bool { return srvs.dnsStatus.err() == nil })
+	if got := testutil.ToFloat64(up); got != 1 {
+		t.Fatalf("dns_listener_up = %v after binding, want 1", got)
+	}
+	if got := readyz(); got != http.StatusOK {
+		t.Fatalf("/readyz after binding = %d, want %d", got, http.StatusOK)
+	}
+	resp, err := dns.Exchange(new(dns.Msg).SetQuestion("foo.run.internal.", dns.TypeA), addr)
+	if err != nil {
+		t.Fatalf("query after binding again: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srvs.shutdown(ctx)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveDNS did not return after shutdown")
+	}
+	if attempts < 2 {
+		t.Fatalf("got %d bind attempts, want at least 2", attempts)
+	}
+}
+
+func TestListenerStatus(t *testing.T) {
+	var l listenerStatus
+	if err := l.err(); err != nil {
+		t.Fatalf("err() with no listeners = %v", err)
+	}
+	l.set("udp:127.0.0.1:53", nil)
+	l.set("tcp:127.0.0.1:53", errors.New("address already in use"))
+	if err := l.err(); err == nil {
+		t.Fatal("err() with a listener down = nil")
+	}
+	l.set("tcp:127.0.0.1:53", nil)
+	if err := l.err(); err != nil {
+		t.Fatalf("err() after the listener is up again = %v", err)
+	}
+}
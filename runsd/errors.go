@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// proxyError is the body of the error responses of runsd itself (as opposed
+// to the responses of the services), in JSON for the clients that accept it
+// and in plain text for the others.
+type proxyError struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Host      string `json:"host"`
+}
+
+// newProxyError returns the error of the response to the request. The host
+// is the one the client requested even after the Director rewrote it, and
+// the id of the request is the one set by the client if the Director did not
+// run yet.
+func newProxyError(req *http.Request, code int, msg string) *proxyError {
+	id := requestID(req.Context())
+	if id == "" {
+		id = req.Header.Get(headerRequestID)
+	}
+	host := req.Host
+	if t, ok := targetFromContext(req.Context()); ok {
+		host = t.hostname
+	}
+	return &proxyError{Code: code, Message: msg, RequestID: id, Host: host}
+}
+
+// encode returns the content type and body of the error for a client that
+// sent the Accept header values.
+func (e *proxyError) encode(accept []string) (string, []byte) {
+	if !acceptsJSON(accept) {
+		s := fmt.Sprintf("runsd error %d: %s", e.Code, e.Message)
+		if e.RequestID != "" {
+			s += " (request_id=" + e.RequestID + ")"
+		}
+		return "text/plain; charset=utf-8", []byte(s + "\n")
+	}
+	b, _ := json.Marshal(e)
+	return "application/json", b
+}
+
+// acceptsJSON reports whether the Accept header values allow a JSON response.
+// Clients that do not send the header get JSON.
+func acceptsJSON(accept []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, v := range accept {
+		for _, r := range strings.Split(v, ",") {
+			parts := strings.Split(r, ";")
+			switch strings.ToLower(strings.TrimSpace(parts[0])) {
+			case "application/json", "application/*", "*/*":
+			default:
+				continue
+			}
+			q := 1.0
+			for _, p := range parts[1:] {
+				if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+					q, _ = strconv.ParseFloat(p[2:], 64)
+				}
+			}
+			if q > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError responds to the request with an error of runsd.
+func writeError(w http.ResponseWriter, req *http.Request, code int, msg string) {
+	e := newProxyError(req, code, msg)
+	ct, b := e.encode(req.Header["Accept"])
+	w.Header().Set("Content-Type", ct)
+	if e.RequestID != "" {
+		w.Header().Set(headerRequestID, e.RequestID)
+	}
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// errorResponse builds an error response of runsd for the request, for the
+// Director and the transports.
+func errorResponse(req *http.Request, code int, msg string) *http.Response {
+	ct, b := newProxyError(req, code, msg).encode(req.Header["Accept"])
+	return &http.Response{
+		Request:       req,
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:        http.Header{"Content-Type": {ct}},
+		ContentLength: int64(len(b)),
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestErrorResponses(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	ok := func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}
+	cases := []struct {
+		name     string
+		setup    func(*reverseProxy)
+		upstream roundTripFunc
+		req      func(*http.Request)
+		warmup   int // requests sent before the one checked
+		wantCode int
+	}{
+		{
+			name:     "resolution",
+			req:      func(r *http.Request) { r.Host = "a.b.c.d" },
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "region header",
+			req:      func(r *http.Request) { r.Header.Set(headerRegion, "us-mars1") },
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "token",
+			setup: func(rp *reverseProxy) {
+				rp.tokenSource = func(string) (string, error) { return "", errors.New("metadata server is down") }
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "rate limit",
+			setup:    func(rp *reverseProxy) { rp.rateLimits = map[string]float64{"foo": 0.001} },
+			warmup:   1,
+			wantCode: http.StatusTooManyRequests,
+		},
+		{
+			name:  "timeout",
+			setup: func(rp *reverseProxy) { rp.upstreamTimeout = 10 * time.Millisecond },
+			upstream: func(req *http.Request) (*http.Response, error) {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			},
+			wantCode: http.StatusGatewayTimeout,
+		},
+		{
+			name: "upstream error",
+			upstream: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:  "circuit breaker",
+			setup: func(rp *reverseProxy) { rp.breakerFailures, rp.breakerCooldown = 1, time.Minute },
+			upstream: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			warmup:   1,
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:  "body too large",
+			setup: func(rp *reverseProxy) { rp.maxBodyBytes = 1 },
+			req: func(r *http.Request) {
+				r.Method, r.Body, r.ContentLength = http.MethodPost, ioutil.NopCloser(strings.NewReader("large")), 5
+			},
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "source",
+			setup:    func(rp *reverseProxy) { rp.allowSources, _ = parseSourceCIDRs("10.0.0.0/8") },
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "connect",
+			req:      func(r *http.Request) { r.Method = http.MethodConnect },
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:  "no service",
+			setup: func(rp *reverseProxy) { rp.clean404 = true },
+			upstream: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Header:     http.Header{"Content-Type": {"text/html"}},
+					Body:       ioutil.NopCloser(strings.NewReader(testCloudRun404Page)),
+					Request:    req,
+				}, nil
+			},
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			if tt.setup != nil {
+				tt.setup(rp)
+			}
+			upstream := tt.upstream
+			if upstream == nil {
+				upstream = ok
+			}
+			h := rp.newReverseProxyHandler(upstream)
+			var rec *httptest.ResponseRecorder
+			for i := 0; i <= tt.warmup; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+				req.Header.Set(headerRequestID, "req-1")
+				if tt.req != nil {
+					tt.req(req)
+				}
+				rec = httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("got content-type=%q, want application/json", ct)
+			}
+			var got proxyError
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to parse response %q: %v", rec.Body.String(), err)
+			}
+			if got.Message == "" {
+				t.Errorf("no message in %q", rec.Body.String())
+			}
+			got.Message = ""
+			want := proxyError{Code: tt.wantCode, RequestID: "req-1", Host: got.Host}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("error response (-want,+got):\n%s", diff)
+			}
+			if got.Host != "foo" && got.Host != "a.b.c.d" {
+				t.Errorf("got host=%q, want the requested host", got.Host)
+			}
+		})
+	}
+}
+
+func TestErrorResponsesPlainText(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("request was proxied")
+		return nil, nil
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://a.b.c.d/", nil)
+	req.Header.Set(headerRequestID, "req-1")
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("got content-type=%q, want text/plain", ct)
+	}
+	if b := rec.Body.String(); !strings.HasPrefix(b, "runsd error 502: ") || !strings.HasSuffix(b, " (request_id=req-1)\n") {
+		t.Fatalf("unexpected body: %q", b)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	cases := []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{"application/json"}, true},
+		{[]string{"text/html, */*;q=0.8"}, true},
+		{[]string{"text/html", "Application/*"}, true},
+		{[]string{"text/plain"}, false},
+		{[]string{"application/json;q=0, text/plain"}, false},
+		{[]string{"application/xml"}, false},
+	}
+	for _, tt := range cases {
+		if got := acceptsJSON(tt.accept); got != tt.want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFlushStreamingResponses(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	for _, ct := range []string{"application/grpc", "text/event-stream"} {
+		t.Run(ct, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.flushInterval = 0 // buffered, streams must be flushed anyway
+			pr, pw := io.Pipe()
+			srv := httptest.NewServer(rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {ct}, "Content-Length": {"1000"}},
+					ContentLength: 1000,
+					Body:          pr,
+					Request:       req,
+				}, nil
+			})))
+			defer srv.Close()
+			defer pw.Close() // before the server waits for the handler to return
+
+			go pw.Write([]byte("first message")) // the rest of the body never comes
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Host = "foo"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			got := make(chan string, 1)
+			go func() {
+				b := make([]byte, len("first message"))
+				io.ReadFull(resp.Body, b)
+				got <- string(b)
+			}()
+			select {
+			case s := <-got:
+				if s != "first message" {
+					t.Fatalf("got %q", s)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("first message was not flushed to the client")
+			}
+		})
+	}
+}
+
+// BenchmarkUnaryDownload compares the throughput of a large response with a
+// content-length when it is flushed after each write (as runsd used to for
+// all responses) and with -flush_interval.
+func BenchmarkUnaryDownload(b *testing.B) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<20) // 16MiB
+
+	for _, bb := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"flush_every_write", -1},
+		{"flush_interval_100ms", defaultFlushInterval},
+		{"buffered", 0},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.flushInterval = bb.interval
+			srv := httptest.NewServer(rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+					ContentLength: int64(len(body)),
+					Body:          ioutil.NopCloser(bytes.NewReader(body)),
+					Request:       req,
+				}, nil
+			})))
+			defer srv.Close()
+			client := srv.Client()
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Host = "foo"
+
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Do(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusOK {
+					b.Fatalf("got status=%d", resp.StatusCode)
+				}
+				if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
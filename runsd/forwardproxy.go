@@ -0,0 +1,41 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// rejectConnect responds to CONNECT requests with 405. Clients send them to
+// a proxy (HTTPS_PROXY) for https:// URLs, but the identity token cannot be
+// added to the requests in the tunnel since they are encrypted end to end.
+// Requests with an absolute http:// URI (sent to HTTP_PROXY) need nothing
+// special: the server sets their Host from the URI, and they are resolved
+// and authenticated like the others.
+func rejectConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		klog.V(4).Infof("[proxy] rejecting CONNECT request to host=%s", r.Host)
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		writeError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("runsd cannot add identity tokens to tunneled requests, "+
+			"use http://%s URLs with HTTP_PROXY (not HTTPS_PROXY) instead of CONNECT", r.URL.Hostname()))
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestForwardProxyAbsoluteURI(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	var got *http.Request
+	srv := httptest.NewServer(rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		url      string
+		wantURL  string
+		wantHost string
+	}{
+		{url: "http://foo/a?b=c", wantURL: "https://foo-hash-uc.a.run.app/a?b=c", wantHost: "foo-hash-uc.a.run.app"},
+		{url: "http://foo.europe-west1.run.internal:8080/", wantURL: "https://foo-hash-ew.a.run.app/", wantHost: "foo-hash-ew.a.run.app"},
+	}
+	for _, tt := range tests {
+		got = nil
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status=%d, want 200", tt.url, resp.StatusCode)
+		}
+		if got == nil {
+			t.Fatalf("%s: request not proxied", tt.url)
+		}
+		if got.URL.String() != tt.wantURL || got.Host != tt.wantHost {
+			t.Errorf("%s: proxied to url=%s host=%s, want url=%s host=%s", tt.url, got.URL, got.Host, tt.wantURL, tt.wantHost)
+		}
+		if v := got.Header.Get("Authorization"); v != "Bearer token" {
+			t.Errorf("%s: got authorization=%q, want the identity token", tt.url, v)
+		}
+	}
+}
+
+func TestForwardProxyRejectsConnect(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	var up bool
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		up = true
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+
+	req := httptest.NewRequest(http.MethodConnect, "foo:443", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status=%d, want 405 (body=%q)", rec.Code, rec.Body.String())
+	}
+	if up {
+		t.Fatal("CONNECT request was sent upstream")
+	}
+}
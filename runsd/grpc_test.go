@@ -0,0 +1,300 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/http2"
+)
+
+// grpcFrame is a length-prefixed gRPC message.
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(msg)))
+	copy(b[5:], msg)
+	return b
+}
+
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+var (
+	// grpc.health.v1.HealthCheckResponse messages
+	healthServing    = []byte{0x08, 0x01}
+	healthNotServing = []byte{0x08, 0x02}
+)
+
+// newGRPCHealthBackend serves the grpc.health.v1.Health service over TLS with
+// HTTP/2 like Cloud Run does. Watch sends SERVING, and NOT_SERVING once
+// notServing is closed.
+func newGRPCHealthBackend(t *testing.T, notServing <-chan struct{}, hdrs chan<- http.Header) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrs <- r.Header.Clone()
+		if r.ProtoMajor != 2 {
+			t.Errorf("backend got proto=%s, want HTTP/2", r.Proto)
+		}
+		if _, err := readGRPCFrame(r.Body); err != nil {
+			t.Errorf("failed to read request message: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame(healthServing))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/grpc.health.v1.Health/Watch" {
+			select {
+			case <-notServing:
+				w.Write(grpcFrame(healthNotServing))
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+func TestGRPCHealthThroughProxy(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	notServing := make(chan struct{})
+	hdrs := make(chan http.Header, 1)
+	backend := newGRPCHealthBackend(t, notServing, hdrs)
+	defer backend.Close()
+
+	upstream := newUpstreamTransport(upstreamOptions{})
+	upstream.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	upstream.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.upstreamTimeout = 50 * time.Millisecond // streaming grpc requests are exempt
+	proxy := httptest.NewServer(allowh2c(rp.newReverseProxyHandler(upstream), h2Options{idleTimeout: defaultH2IdleTimeout}))
+	defer proxy.Close()
+
+	// h2c client, like grpc-go with insecure credentials
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	call := func(method string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, proxy.URL+"/grpc.health.v1.Health/"+method, bytes.NewReader(grpcFrame(nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "foo"
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatalf("got status=%d proto=%s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+		}
+		h := <-hdrs
+		if got := h.Get("Te"); got != "trailers" {
+			t.Errorf("backend got te=%q, want trailers", got)
+		}
+		if got := h.Get("Content-Type"); got != "application/grpc" {
+			t.Errorf("backend got content-type=%q, want application/grpc", got)
+		}
+		if got := h.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("backend got authorization=%q, want the identity token", got)
+		}
+		return resp
+	}
+
+	t.Run("Check", func(t *testing.T) {
+		resp := call("Check")
+		defer resp.Body.Close()
+		msg, err := readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(healthServing, msg); diff != "" {
+			t.Fatalf("response message (-want,+got):\n%s", diff)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Fatalf("got grpc-status=%q, want 0", got)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		resp := call("Watch")
+		defer resp.Body.Close()
+		// the first update is received while the stream is still open, and
+		// after the upstream timeout
+		msg, err := readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(healthServing, msg); diff != "" {
+			t.Fatalf("first message (-want,+got):\n%s", diff)
+		}
+		time.Sleep(2 * rp.upstreamTimeout)
+		close(notServing)
+		msg, err = readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(healthNotServing, msg); diff != "" {
+			t.Fatalf("second message (-want,+got):\n%s", diff)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Fatalf("got grpc-status=%q, want 0", got)
+		}
+	})
+}
+
+func TestGRPCErrorStatusThroughProxy(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "declared trailers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.Write(grpcFrame(healthServing))
+				w.Header().Set("Grpc-Status", "5")
+				w.Header().Set("Grpc-Message", "service foo not found")
+			},
+		},
+		{
+			name: "undeclared trailers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Write(grpcFrame(healthServing))
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+				w.Header().Set(http.TrailerPrefix+"Grpc-Message", "service foo not found")
+			},
+		},
+		{
+			// errors without messages are sent in the headers of an empty
+			// response (Trailers-Only)
+			name: "trailers-only",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", "5")
+				w.Header().Set("Grpc-Message", "service foo not found")
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Te"); got != "trailers" {
+					t.Errorf("backend got te=%q, want trailers", got)
+				}
+				io.Copy(ioutil.Discard, r.Body)
+				tt.handler(w, r)
+			}))
+			backend.EnableHTTP2 = true
+			backend.StartTLS()
+			defer backend.Close()
+
+			upstream := newUpstreamTransport(upstreamOptions{})
+			upstream.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			upstream.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+			}
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			// none of the response middleware should touch the trailers
+			rp.compress, rp.clean404, rp.debugHeaders = true, true, true
+			rp.accessLog = newAccessLogger(ioutil.Discard)
+			proxy := httptest.NewServer(allowh2c(rp.newReverseProxyHandler(upstream), h2Options{}))
+			defer proxy.Close()
+
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+			req, err := http.NewRequest(http.MethodPost, proxy.URL+"/grpc.health.v1.Health/Check", bytes.NewReader(grpcFrame([]byte("\x0a\x03foo"))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "foo"
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("Te", "trailers")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status=%d, want 200 (grpc errors are in the trailers)", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("got content-encoding=%q, want none", got)
+			}
+			if _, err := ioutil.ReadAll(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			// grpc clients take the status from the headers of Trailers-Only
+			// responses, and from the trailers otherwise
+			status := func(k string) string {
+				if v := resp.Trailer.Get(k); v != "" {
+					return v
+				}
+				return resp.Header.Get(k)
+			}
+			if got := status("Grpc-Status"); got != "5" {
+				t.Errorf("got grpc-status=%q, want 5 (trailer=%v header=%v)", got, resp.Trailer, resp.Header)
+			}
+			if got := status("Grpc-Message"); got != "service foo not found" {
+				t.Errorf("got grpc-message=%q, want the backend's message", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// parseHeaderPatterns parses comma-separated header names, or patterns with
+// "*" wildcards (e.g. X-Internal-*, see matchWildcard).
+func parseHeaderPatterns(s string) ([]string, error) {
+	var out []string
+	for _, v := range splitList(s) {
+		if strings.Trim(v, "*") == "" || !httpguts.ValidHeaderFieldName(v) {
+			return nil, fmt.Errorf("%q is not a valid header name or pattern", v)
+		}
+		out = append(out, http.CanonicalHeaderKey(v))
+	}
+	return out, nil
+}
+
+// stripHeaders deletes the headers matching the patterns from h.
+func stripHeaders(h http.Header, patterns []string) {
+	for _, p := range patterns {
+		if strings.Contains(p, "*") {
+			for k := range h {
+				if matchWildcard(p, k) {
+					delete(h, k)
+				}
+			}
+			continue
+		}
+		h.Del(p)
+	}
+}
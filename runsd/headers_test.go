@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseHeaderPatterns(t *testing.T) {
+	got, err := parseHeaderPatterns("x-user-token, X-Internal-*, *-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"X-User-Token", "X-Internal-*", "*-Debug"}, got); diff != "" {
+		t.Fatalf("parseHeaderPatterns() (-want,+got):\n%s", diff)
+	}
+	for _, in := range []string{"*", "**", "x y", "a:b"} {
+		if _, err := parseHeaderPatterns(in); err == nil {
+			t.Errorf("parseHeaderPatterns(%q) expected error", in)
+		}
+	}
+}
+
+func TestReverseProxyStripHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		strip     []string
+		trustXFF  bool
+		noUA      bool
+		in        http.Header
+		want      http.Header
+		wantNoHdr []string
+	}{
+		{
+			name:      "strip names and prefixes",
+			strip:     []string{"X-User-Token", "X-Internal-*"},
+			in:        http.Header{"X-User-Token": {"a"}, "X-Internal-Id": {"b"}, "X-Internal-Role": {"c"}, "X-Other": {"d"}},
+			want:      http.Header{"X-Other": {"d"}},
+			wantNoHdr: []string{"X-User-Token", "X-Internal-Id", "X-Internal-Role"},
+		},
+		{
+			name:      "strip suffix and infix patterns",
+			strip:     []string{"*-Debug", "X-*-Secret"},
+			in:        http.Header{"X-Trace-Debug": {"a"}, "X-Db-Secret": {"b"}, "X-Debug-Id": {"c"}},
+			want:      http.Header{"X-Debug-Id": {"c"}},
+			wantNoHdr: []string{"X-Trace-Debug", "X-Db-Secret"},
+		},
+		{
+			name: "spoofed forwarded for is replaced",
+			in:   http.Header{"X-Forwarded-For": {"203.0.113.1"}},
+			want: http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+		},
+		{
+			name:     "trusted forwarded for is appended to",
+			trustXFF: true,
+			in:       http.Header{"X-Forwarded-For": {"203.0.113.1"}},
+			want:     http.Header{"X-Forwarded-For": {"203.0.113.1, 192.0.2.1"}},
+		},
+		{
+			name: "runsd is appended to the user agent",
+			in:   http.Header{"User-Agent": {"curl/8.0 (linux)"}},
+			want: http.Header{"User-Agent": {"curl/8.0 (linux) runsd/" + version}},
+		},
+		{
+			name: "runsd is the user agent of requests without one",
+			want: http.Header{"User-Agent": {"runsd/" + version}},
+		},
+		{
+			name: "user agent is kept as is with no_user_agent",
+			noUA: true,
+			in:   http.Header{"User-Agent": {"curl/8.0 (linux)"}},
+			want: http.Header{"User-Agent": {"curl/8.0 (linux)"}},
+		},
+		{
+			name: "no user agent with no_user_agent",
+			noUA: true,
+			want: http.Header{"User-Agent": {""}}, // not sent by the transport
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.tokenSource = func(string) (string, error) { return "token", nil }
+			rp.strippedHeaders = tt.strip
+			rp.trustForwardedFor = tt.trustXFF
+			rp.noUserAgent = tt.noUA
+			var got http.Header
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				got = req.Header
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+			req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.in {
+				req.Header[k] = v
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			for k, v := range tt.want {
+				if diff := cmp.Diff(v, got[k]); diff != "" {
+					t.Errorf("header %s (-want,+got):\n%s", k, diff)
+				}
+			}
+			for _, k := range tt.wantNoHdr {
+				if v, ok := got[k]; ok {
+					t.Errorf("header %s=%q was forwarded", k, v)
+				}
+			}
+		})
+	}
+}
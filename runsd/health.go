@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// readinessRetryInterval is how long a failed readiness check result is
+	// served before the check is attempted again.
+	readinessRetryInterval = 5 * time.Second
+
+	// readinessAudience is the audience used for the test token fetch.
+	readinessAudience = "https://runsd-readiness-check"
+)
+
+// healthChecker serves liveness (/healthz) and readiness (/readyz) probes.
+type healthChecker struct {
+	proxyListening int32 // accessed atomically
+	check          func() error
+	now            func() time.Time
+	listeners      *listenerStatus // if set, not ready while one of them is down
+
+	mu        sync.Mutex
+	ready     bool
+	lastErr   error
+	lastCheck time.Time
+}
+
+func newHealthChecker(check func() error) *healthChecker {
+	return &healthChecker{check: check, now: time.Now}
+}
+
+// setProxyListening marks the proxy (if any) as accepting connections.
+func (h *healthChecker) setProxyListening() {
+	atomic.StoreInt32(&h.proxyListening, 1)
+}
+
+// readiness returns nil once the readiness check has succeeded. Once ready,
+// the check is not run again; failures are cached for readinessRetryInterval.
+func (h *healthChecker) readiness() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ready {
+		return nil
+	}
+	if !h.lastCheck.IsZero() && h.now().Sub(h.lastCheck) < readinessRetryInterval {
+		return h.lastErr
+	}
+	h.lastCheck = h.now()
+	h.lastErr = h.check()
+	if h.lastErr != nil {
+		klog.V(3).Infof("[health] readiness check failed: %v", h.lastErr)
+		return h.lastErr
+	}
+	klog.V(3).Info("[health] readiness check succeeded")
+	h.ready = true
+	return nil
+}
+
+func (h *healthChecker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&h.proxyListening) == 0 {
+			http.Error(w, "proxy is not listening", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if h.listeners != nil {
+			if err := h.listeners.err(); err != nil {
+				http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if err := h.readiness(); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// metadataReadinessCheck verifies that an identity token can be fetched and
+// that the region can be looked up from the metadata server.
+func metadataReadinessCheck(tokenSource func(string) (string, error), lookupRegion bool) func() error {
+	return func() error {
+		if _, err := tokenSource(readinessAudience); err != nil {
+			return fmt.Errorf("failed to fetch identity token: %w", err)
+		}
+		if lookupRegion {
+			if _, err := regionFromMetadata(); err != nil {
+				return fmt.Errorf("failed to look up region: %w", err)
+			}
+		}
+		return nil
+	}
+}
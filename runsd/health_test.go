@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	now := time.Unix(1620000000, 0)
+	checks := 0
+	checkErr := errors.New("metadata server unavailable")
+
+	h := newHealthChecker(func() error {
+		checks++
+		return checkErr
+	})
+	h.now = func() time.Time { return now }
+	srv := h.handler()
+
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if got := probe("/healthz"); got != http.StatusServiceUnavailable {
+		t.Fatalf("/healthz before listening = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	h.setProxyListening()
+	if got := probe("/healthz"); got != http.StatusOK {
+		t.Fatalf("/healthz after listening = %d, want %d", got, http.StatusOK)
+	}
+
+	if got := probe("/readyz"); got != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz with failing check = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	probe("/readyz")
+	if checks != 1 {
+		t.Fatalf("expected failed check result to be cached, got %d checks", checks)
+	}
+
+	checkErr = nil
+	now = now.Add(readinessRetryInterval)
+	if got := probe("/readyz"); got != http.StatusOK {
+		t.Fatalf("/readyz with passing check = %d, want %d", got, http.StatusOK)
+	}
+	now = now.Add(time.Hour)
+	probe("/readyz")
+	if checks != 2 {
+		t.Fatalf("expected readiness to be latched, got %d checks", checks)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// defaultHTTP3Addr is where the HTTP/3 listeners are, since the clients of
+// https:// URLs connect to port 443 of the loopback addresses internal names
+// resolve to.
+const defaultHTTP3Addr = ":443"
+
+// loadHTTP3Config returns the tls config of the HTTP/3 (QUIC) listeners with
+// the PEM certificate and key, which are required as QUIC always uses TLS.
+func loadHTTP3Config(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the certificate and key must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// newHTTP3Server returns an HTTP/3 server that is shut down with the other
+// servers.
+func (s *servers) newHTTP3Server(h http.Handler, tlsConfig *tls.Config) *http3.Server {
+	srv := &http3.Server{
+		Handler:   h,
+		TLSConfig: tlsConfig,
+	}
+	s.mu.Lock()
+	s.http3 = append(s.http3, srv)
+	s.mu.Unlock()
+	return srv
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import "testing"
+
+func TestMatchWildcard(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{pattern: "foo", name: "foo", want: true},
+		{pattern: "foo", name: "FOO", want: true},
+		{pattern: "foo", name: "foobar"},
+		{pattern: "foo", name: "xfoo"},
+		{pattern: "payments-*", name: "payments-api", want: true},
+		{pattern: "payments-*", name: "payments-", want: true},
+		{pattern: "payments-*", name: "old-payments-api"},
+		{pattern: "payments-*", name: "payments"},
+		{pattern: "*-internal", name: "billing-internal", want: true},
+		{pattern: "*-internal", name: "billing-internal-v2"},
+		{pattern: "X-Internal-*", name: "x-internal-role", want: true},
+		{pattern: "a*b*c", name: "abc", want: true},
+		{pattern: "a*b*c", name: "axxbyyc", want: true},
+		{pattern: "a*b*c", name: "abcbc", want: true},
+		{pattern: "a*b*c", name: "acb"},
+		{pattern: "ab*ba", name: "aba"},
+		{pattern: "ab*ba", name: "abba", want: true},
+		{pattern: "*", name: "anything", want: true},
+		{pattern: "**", name: "", want: true},
+		{pattern: "web-?", name: "web-a"},
+		{pattern: "web-[ab]", name: "web-a"},
+	}
+	for _, tt := range cases {
+		if got := matchWildcard(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchWildcard(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
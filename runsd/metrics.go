@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricProxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "runsd",
+		Name:      "proxy_requests_total",
+		Help:      "Number of proxied requests by target host and response code.",
+	}, []string{"host", "code"})
+
+	metricProxyRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "runsd",
+		Name:      "proxy_request_duration_seconds",
+		Help:      "Time until response headers are received from the upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host"})
+
+	metricTokenFetches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "runsd",
+		Name:      "token_fetches_total",
+		Help:      "Number of identity token fetches.",
+	})
+
+	metricTokenFetchFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "runsd",
+		Name:      "token_fetch_failures_total",
+		Help:      "Number of failed identity token fetches.",
+	})
+
+	metricDNSQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "runsd",
+		Name:      "dns_queries_total",
+		Help:      "Number of DNS queries by query type and response code.",
+	}, []string{"qtype", "rcode"})
+
+	metricMetadataReachable = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "metadata_reachable",
+		Help:      "Whether the last query to the metadata server got a response (1) or failed to connect (0).",
+	})
+
+	metricLastTokenFetchSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "last_token_fetch_success_timestamp",
+		Help:      "Unix time of the last successful identity token fetch.",
+	})
+
+	metricDNSLastQuery = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "dns_last_query_timestamp",
+		Help:      "Unix time of the last DNS query handled.",
+	})
+
+	metricDNSListenerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "dns_listener_up",
+		Help:      "Whether the DNS server is listening (1) or failed and is waiting to bind again (0), by network and address.",
+	}, []string{"net", "addr"})
+
+	metricActiveRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "active_requests",
+		Help:      "Number of in-flight proxied requests, including the streams.",
+	})
+
+	metricActiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      "active_streams",
+		Help:      "Number of in-flight streaming (gRPC, upgraded) proxied requests.",
+	})
+
+	metricTokenCache  = newCacheMetrics("token", "identity token")
+	metricRegionCache = newCacheMetrics("region", "probed service region")
+)
+
+// cacheMetrics counts the hits and misses of a cache, and exposes their
+// ratio so that a cache that keeps missing (e.g. from churn) stands out.
+type cacheMetrics struct {
+	nHits, nMisses uint64 // for the ratio, accessed atomically
+
+	hits, misses prometheus.Counter
+}
+
+func newCacheMetrics(name, desc string) *cacheMetrics {
+	m := &cacheMetrics{
+		hits: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "runsd",
+			Name:      name + "_cache_hits_total",
+			Help:      "Number of " + desc + " lookups served from the cache.",
+		}),
+		misses: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "runsd",
+			Name:      name + "_cache_misses_total",
+			Help:      "Number of " + desc + " lookups not served from the cache.",
+		}),
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "runsd",
+		Name:      name + "_cache_hit_ratio",
+		Help:      "Ratio of the " + desc + " lookups served from the cache since start, 0 before the first lookup.",
+	}, m.ratio)
+	return m
+}
+
+func (m *cacheMetrics) hit() {
+	atomic.AddUint64(&m.nHits, 1)
+	m.hits.Inc()
+}
+
+func (m *cacheMetrics) miss() {
+	atomic.AddUint64(&m.nMisses, 1)
+	m.misses.Inc()
+}
+
+func (m *cacheMetrics) ratio() float64 {
+	hits, misses := atomic.LoadUint64(&m.nHits), atomic.LoadUint64(&m.nMisses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// metricsTransport records the status and latency of upstream requests.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+var _ http.Flusher = metricsTransport{} // ensure it's a Flusher
+
+func (m metricsTransport) Flush() {
+	if v, ok := m.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (m metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := m.next.RoundTrip(req)
+	host := req.URL.Host
+	metricProxyRequestDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metricProxyRequests.WithLabelValues(host, code).Inc()
+	return resp, err
+}
+
+// dnsMetrics counts the DNS queries handled by d.
+func dnsMetrics(d dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		metricDNSLastQuery.SetToCurrentTime()
+		d(&rcodeRecorder{ResponseWriter: w, qtype: qtypeOf(r)}, r)
+	}
+}
+
+func qtypeOf(r *dns.Msg) string {
+	if len(r.Question) == 0 {
+		return ""
+	}
+	return dns.TypeToString[r.Question[0].Qtype]
+}
+
+// rcodeRecorder counts the written responses by their rcode.
+type rcodeRecorder struct {
+	dns.ResponseWriter
+	qtype string
+}
+
+func (w *rcodeRecorder) WriteMsg(m *dns.Msg) error {
+	metricDNSQueries.WithLabelValues(w.qtype, dns.RcodeToString[m.Rcode]).Inc()
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetadataReachableMetric(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	url := srv.URL
+
+	// an error response still means the server is reachable
+	queryMetadata(url)
+	if got := testutil.ToFloat64(metricMetadataReachable); got != 1 {
+		t.Fatalf("after response: got metadata_reachable=%v, want 1", got)
+	}
+	srv.Close()
+	queryMetadata(url)
+	if got := testutil.ToFloat64(metricMetadataReachable); got != 0 {
+		t.Fatalf("after connection failure: got metadata_reachable=%v, want 0", got)
+	}
+}
+
+func TestLastTokenFetchSuccessMetric(t *testing.T) {
+	metricLastTokenFetchSuccess.Set(0)
+	c := newTokenCache(defaultTokenRefreshAhead)
+	c.fetch = func(string) (string, error) { return "", errors.New("fail") }
+	c.fetchToken("https://foo")
+	if got := testutil.ToFloat64(metricLastTokenFetchSuccess); got != 0 {
+		t.Fatalf("after failure: got timestamp=%v, want 0", got)
+	}
+
+	start := time.Now().Unix()
+	c.fetch = func(string) (string, error) { return "token", nil }
+	c.fetchToken("https://foo")
+	if got := testutil.ToFloat64(metricLastTokenFetchSuccess); got < float64(start) {
+		t.Fatalf("after success: got timestamp=%v, want >= %d", got, start)
+	}
+}
+
+func TestDNSLastQueryMetric(t *testing.T) {
+	metricDNSLastQuery.Set(0)
+	start := time.Now().Unix()
+	dnsMetrics(func(dns.ResponseWriter, *dns.Msg) {})(nil, new(dns.Msg).SetQuestion("foo.", dns.TypeA))
+	if got := testutil.ToFloat64(metricDNSLastQuery); got < float64(start) {
+		t.Fatalf("got timestamp=%v, want >= %d", got, start)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	delta := func(m *cacheMetrics, f func()) (float64, float64) {
+		hits, misses := testutil.ToFloat64(m.hits), testutil.ToFloat64(m.misses)
+		f()
+		return testutil.ToFloat64(m.hits) - hits, testutil.ToFloat64(m.misses) - misses
+	}
+
+	c, _, _ := newTestTokenCache()
+	hits, misses := delta(metricTokenCache, func() {
+		c.get("https://foo")
+		c.get("https://foo")
+		c.get("https://foo")
+	})
+	if hits != 2 || misses != 1 {
+		t.Errorf("token cache: got hits=%v misses=%v, want 2 and 1", hits, misses)
+	}
+
+	p := newRegionProber([]string{"us-central1"}, func(svc, r string) string { return svc + "." + r })
+	p.probe = func(string) (bool, error) { return true, nil }
+	hits, misses = delta(metricRegionCache, func() {
+		p.region("foo")
+		p.region("foo")
+		p.region("bar")
+	})
+	if hits != 1 || misses != 2 {
+		t.Errorf("region cache: got hits=%v misses=%v, want 1 and 2", hits, misses)
+	}
+
+	m := &cacheMetrics{hits: prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"}), misses: prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"})}
+	if got := m.ratio(); got != 0 {
+		t.Errorf("ratio before lookups = %v, want 0", got)
+	}
+	m.hit()
+	m.hit()
+	m.hit()
+	m.miss()
+	if got := m.ratio(); got != 0.75 {
+		t.Errorf("ratio = %v, want 0.75", got)
+	}
+}
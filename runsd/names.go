@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	// regionLike matches names that look like a GCP region, so that unknown
+	// regions are reported as such instead of being parsed as a service name.
+	regionLike = regexp.MustCompile(`^(africa|asia|australia|europe|me|northamerica|southamerica|us)-[a-z]+[0-9]+$`)
+
+	// dnsLabel matches revision tags, which must be valid DNS labels that start
+	// with a letter.
+	dnsLabel = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+	// projectHashFormat matches the project hashes in the Cloud Run URLs
+	// (e.g. dpyb4duzqq in foo-dpyb4duzqq-uc.a.run.app).
+	projectHashFormat = regexp.MustCompile(`^[a-z0-9]+$`)
+
+	// projectNumberFormat matches the project numbers in the Cloud Run URLs
+	// of URLFormatNumber.
+	projectNumberFormat = regexp.MustCompile(`^[0-9]{1,20}$`)
+
+	// hostnameProfile is the idna.Lookup profile without the hyphen checks,
+	// which parseInternalName does with better errors.
+	hostnameProfile = idna.New(idna.MapForLookup(), idna.Transitional(true), idna.CheckHyphens(false))
+)
+
+// internalName is a parsed internal hostname.
+type internalName struct {
+	tag     string
+	service string
+	region  string // empty if not specified
+	project string // empty if not specified
+}
+
+// parseInternalName parses the labels of an internal hostname (without the
+// internal domain) in [TAG.]SERVICE[.REGION][.PROJECT] format. PROJECT must
+// be one of projects.
+func parseInternalName(labels []string, projects map[string]string) (internalName, error) {
+	var n internalName
+	rest := labels
+	if last := rest[len(rest)-1]; len(rest) > 1 {
+		if _, ok := projects[last]; ok {
+			n.project = last
+			rest = rest[:len(rest)-1]
+		}
+	}
+	if last := rest[len(rest)-1]; len(rest) > 1 {
+		if _, ok := regionCode(last); ok {
+			n.region = last
+			rest = rest[:len(rest)-1]
+		} else if regionLike.MatchString(last) {
+			return internalName{}, &unhandledRegionError{region: last}
+		}
+	}
+	switch len(rest) {
+	case 1:
+		n.service = rest[0]
+	case 2:
+		n.tag, n.service = rest[0], rest[1]
+		if !dnsLabel.MatchString(n.tag) || strings.Contains(n.tag, "--") {
+			return internalName{}, fmt.Errorf("%q is not a valid revision tag", n.tag)
+		}
+	case 3:
+		if _, ok := regionCode(rest[1]); ok {
+			return internalName{}, fmt.Errorf("project %q is not configured", rest[2])
+		}
+		return internalName{}, fmt.Errorf("found too many dots")
+	default:
+		return internalName{}, fmt.Errorf("found too many dots")
+	}
+	if n.service == "" {
+		return internalName{}, fmt.Errorf("empty service name")
+	}
+	return n, nil
+}
+
+// hostOnly strips the port of the host (if any) and the brackets of IPv6
+// literals. IP addresses fail with ErrIPAddress, as they are not the names of
+// services.
+func hostOnly(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"); net.ParseIP(ip) != nil {
+		return "", fmt.Errorf("%w: %q", ErrIPAddress, ip)
+	}
+	return host, nil
+}
+
+// urlHost returns the host the request is addressed to: the URL host, which
+// is set on outgoing and absolute-form (HTTP_PROXY) requests, or else the Host
+// header of the inbound request.
+func urlHost(r *http.Request) string {
+	if r.URL != nil && r.URL.Host != "" {
+		return r.URL.Host
+	}
+	return r.Host
+}
+
+// canonicalHostname lowercases the hostname, strips its trailing dot and
+// converts internationalized labels to their ASCII (punycode) form, so that
+// the different spellings of a name resolve the same.
+func canonicalHostname(hostname string) (string, error) {
+	h := strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if h == "" {
+		return "", fmt.Errorf("empty hostname")
+	}
+	a, err := hostnameProfile.ToASCII(h)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %w", hostname, err)
+	}
+	return a, nil
+}
+
+// internalDomainOf returns the longest of the internal domains (in any form
+// accepted by normalizeDomain) that the canonical hostname is in.
+func internalDomainOf(hostname string, domains []string) (string, bool) {
+	var match string
+	for _, d := range domains {
+		d = strings.Trim(d, ".")
+		if strings.HasSuffix(hostname, "."+d) && len(d) > len(match) {
+			match = d
+		}
+	}
+	return match, match != ""
+}
+
+// trimInternalDomain removes the internal domain that the canonical hostname
+// is in (if any) from its end.
+func trimInternalDomain(hostname string, domains []string) string {
+	if d, ok := internalDomainOf(hostname, domains); ok {
+		return strings.TrimSuffix(hostname, "."+d)
+	}
+	return hostname
+}
+
+// validateProjectHash checks that the hash can be part of a Cloud Run URL.
+func validateProjectHash(hash string) error {
+	if !projectHashFormat.MatchString(hash) {
+		return fmt.Errorf("project hash %q must be lowercase letters and digits (e.g. 'dpyb4duzqq' if the URLs are like 'foo-dpyb4duzqq-uc.a.run.app')", hash)
+	}
+	return nil
+}
+
+// validateProjectNumber checks that the project number can be part of a Cloud
+// Run URL of URLFormatNumber.
+func validateProjectNumber(number string) error {
+	if !projectNumberFormat.MatchString(number) {
+		return fmt.Errorf("project number %q must be digits (e.g. '123456789012' if the URLs are like 'foo-123456789012.us-central1.run.app')", number)
+	}
+	return nil
+}
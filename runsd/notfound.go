@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// cloudRun404Marker is in the HTML page Cloud Run responds with to requests
+// to *.a.run.app hosts that no service is deployed at.
+const cloudRun404Marker = "<title>Error 404 (Not Found)!!1</title>"
+
+// maxCloudRun404Bytes is the size of the largest body looked at for
+// cloudRun404Marker, the page itself is about 1.5KiB.
+const maxCloudRun404Bytes = 8 << 10
+
+// cleanNotFound replaces the HTML 404 page of Cloud Run for hosts without a
+// service with a JSON error saying so. The 404 responses of the services
+// themselves, and of custom domains, are left as is. At most maxBuffer bytes
+// of the body are buffered to look at it.
+func cleanNotFound(resp *http.Response, maxBuffer int64) error {
+	if resp.StatusCode != http.StatusNotFound || resp.Request == nil || resp.Body == nil {
+		return nil
+	}
+	target, ok := targetFromContext(resp.Request.Context())
+	if !ok || target.customDomain {
+		return nil
+	}
+	if !strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/html") ||
+		resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if maxBuffer > maxCloudRun404Bytes {
+		maxBuffer = maxCloudRun404Bytes
+	}
+	b, ok, err := bufferResponse(resp, maxBuffer)
+	if err != nil || !ok {
+		return err
+	}
+	if !bytes.Contains(b, []byte(cloudRun404Marker)) {
+		// a page of the service, put back what was read
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	where := "region " + target.region
+	if target.project != "" {
+		where += " of project " + target.project
+	}
+	klog.V(4).Infof("[proxy] cloud run has no service at host=%s id=%s", target.host, requestID(resp.Request.Context()))
+	ct, body := newProxyError(resp.Request, http.StatusNotFound, fmt.Sprintf("Cloud Run has no service %q in %s (https://%s responded with 404)", target.service, where, target.host)).encode(resp.Request.Header["Accept"])
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Type", ct)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
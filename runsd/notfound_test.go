@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testCloudRun404Page = `<!DOCTYPE html>
+<html lang=en>
+  <meta charset=utf-8>
+  <title>Error 404 (Not Found)!!1</title>
+  <p><b>404.</b> <ins>That’s an error.</ins>
+  <p>The requested URL <code>/</code> was not found on this server.  <ins>That’s all we know.</ins>`
+
+func TestNotFoundResponses(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	tests := []struct {
+		name        string
+		host        string
+		clean404    bool
+		maxBuffer   int64
+		respType    string
+		respBody    string
+		wantCode    int
+		wantType    string
+		wantBody    string // substring
+		wantUpCalls int
+	}{
+		{name: "cloud run 404 passed through", host: "nope", respType: "text/html; charset=UTF-8", respBody: testCloudRun404Page,
+			wantCode: http.StatusNotFound, wantType: "text/html; charset=UTF-8", wantBody: "That’s all we know.", wantUpCalls: 1},
+		{name: "cloud run 404 cleaned", host: "nope.europe-west1", clean404: true, respType: "text/html; charset=UTF-8", respBody: testCloudRun404Page,
+			wantCode: http.StatusNotFound, wantType: "application/json", wantBody: `Cloud Run has no service \"nope\" in region europe-west1`, wantUpCalls: 1},
+		{name: "cloud run 404 over the buffer passed through", host: "nope", clean404: true, maxBuffer: 100, respType: "text/html; charset=UTF-8", respBody: testCloudRun404Page,
+			wantCode: http.StatusNotFound, wantType: "text/html; charset=UTF-8", wantBody: testCloudRun404Page, wantUpCalls: 1},
+		{name: "service html 404 kept", host: "web", clean404: true, respType: "text/html", respBody: "<h1>no such page</h1>",
+			wantCode: http.StatusNotFound, wantType: "text/html", wantBody: "<h1>no such page</h1>", wantUpCalls: 1},
+		{name: "service json 404 kept", host: "api", clean404: true, respType: "application/json", respBody: `{"error":"no such user"}`,
+			wantCode: http.StatusNotFound, wantType: "application/json", wantBody: "no such user", wantUpCalls: 1},
+		{name: "custom domain 404 kept", host: "payments", clean404: true, respType: "text/html", respBody: testCloudRun404Page,
+			wantCode: http.StatusNotFound, wantType: "text/html", wantBody: "That’s all we know.", wantUpCalls: 1},
+		{name: "resolution failure", host: "a.b.c.d.e", clean404: true,
+			wantCode: http.StatusBadGateway, wantType: "application/json", wantBody: "runsd doesn't know how to handle host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.customDomains = map[string]string{"payments": "payments.example.com"}
+			rp.clean404 = tt.clean404
+			if tt.maxBuffer > 0 {
+				rp.maxResponseBuffer = tt.maxBuffer
+			}
+			var upCalls int
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				upCalls++
+				return &http.Response{
+					StatusCode:    http.StatusNotFound,
+					Header:        http.Header{"Content-Type": {tt.respType}},
+					Body:          ioutil.NopCloser(strings.NewReader(tt.respBody)),
+					ContentLength: int64(len(tt.respBody)),
+					Request:       req,
+				}, nil
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got content-type=%q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got body=%q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+			if strings.HasPrefix(tt.wantType, "application/json") && !json.Valid(rec.Body.Bytes()) {
+				t.Errorf("got invalid json body=%q", rec.Body.String())
+			}
+			if upCalls != tt.wantUpCalls {
+				t.Errorf("got %d upstream calls, want %d", upCalls, tt.wantUpCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// resolveOverrides maps internal hostnames to the hosts requests to them are
+// sent to instead of the resolved Cloud Run host, loaded from a hosts-style
+// file (-resolve_overrides). It is safe for concurrent use.
+type resolveOverrides struct {
+	path string
+
+	mu    sync.RWMutex
+	hosts map[string]string // by canonical hostname
+}
+
+func newResolveOverrides(path string) (*resolveOverrides, error) {
+	o := &resolveOverrides{path: path}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// reload reads the file again. On error, the previous overrides are kept.
+func (o *resolveOverrides) reload() error {
+	b, err := ioutil.ReadFile(o.path)
+	if err != nil {
+		return fmt.Errorf("failed to read resolve overrides file: %w", err)
+	}
+	hosts, err := parseResolveOverrides(strings.Split(string(b), "\n"), o.path)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.hosts = hosts
+	o.mu.Unlock()
+	klog.V(3).Infof("loaded %d resolve overrides from %s", len(hosts), o.path)
+	return nil
+}
+
+// lookup returns the override of the canonical hostname, or else of the
+// hostname without its internal domain.
+func (o *resolveOverrides) lookup(hostname, trimmed string) (string, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if h, ok := o.hosts[hostname]; ok {
+		return h, true
+	}
+	h, ok := o.hosts[trimmed]
+	return h, ok
+}
+
+// parseResolveOverrides parses lines in "TARGET NAME [NAME...]" format like
+// hosts(5), where TARGET is a hostname (optionally with https://) that the
+// requests to the NAMEs are sent to. Comments start with #.
+func parseResolveOverrides(lines []string, source string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, l := range lines {
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: %q is not in TARGET NAME [NAME...] format", source, strings.TrimSpace(l))
+		}
+		target := fields[0]
+		if i := strings.Index(target, "://"); i >= 0 {
+			if target[:i] != "https" {
+				return nil, fmt.Errorf("%s: target %q must be a hostname or an https:// url", source, fields[0])
+			}
+			target = strings.TrimSuffix(target[i+3:], "/")
+		}
+		d, err := normalizeDomain(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid target: %w", source, err)
+		}
+		target = strings.TrimSuffix(d, ".")
+		if !strings.Contains(target, ".") {
+			return nil, fmt.Errorf("%s: target %q is not fully qualified", source, fields[0])
+		}
+		for _, name := range fields[1:] {
+			h, err := canonicalHostname(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			if prev, ok := out[h]; ok && prev != target {
+				return nil, fmt.Errorf("%s: %q is overridden to both %s and %s", source, name, prev, target)
+			}
+			out[h] = target
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseResolveOverrides(t *testing.T) {
+	lines := []string{
+		"# canary",
+		"hello-canary-abc-uc.a.run.app hello Hello.US-Central1.",
+		"https://staging.example.com/  billing  # staging backend",
+		"",
+	}
+	got, err := parseResolveOverrides(lines, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"hello":             "hello-canary-abc-uc.a.run.app",
+		"hello.us-central1": "hello-canary-abc-uc.a.run.app",
+		"billing":           "staging.example.com",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("(-want,+got):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		"hello-abc-uc.a.run.app",
+		"http://hello-abc-uc.a.run.app hello",
+		"localhost hello",
+		"bad_host.example.com hello",
+		"a.example.com hello\nb.example.com hello",
+	} {
+		if _, err := parseResolveOverrides(strings.Split(in, "\n"), "test"); err == nil {
+			t.Errorf("parseResolveOverrides(%q) expected error", in)
+		}
+	}
+}
+
+func TestResolveCloudRunHostOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides")
+	if err := ioutil.WriteFile(path, []byte("hello-canary-hash-uc.a.run.app hello\nstaging.example.com api.staging.corp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o, err := newResolveOverrides(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.overrides = o
+
+	tests := []struct {
+		hostname string
+		want     cloudRunTarget
+	}{
+		{hostname: "hello", want: cloudRunTarget{service: "hello", host: "hello-canary-hash-uc.a.run.app", customDomain: true, override: true}},
+		{hostname: "hello.run.internal.", want: cloudRunTarget{service: "hello", host: "hello-canary-hash-uc.a.run.app", customDomain: true, override: true}},
+		{hostname: "api.staging.corp", want: cloudRunTarget{service: "api", host: "staging.example.com", customDomain: true, override: true}},
+		{hostname: "hello.us-central1", want: cloudRunTarget{service: "hello", region: "us-central1", host: "hello-hash-uc.a.run.app"}},
+	}
+	for _, tt := range tests {
+		got, err := rp.resolveCloudRunHost(tt.hostname)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.hostname, err)
+		}
+		if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(cloudRunTarget{})); diff != "" {
+			t.Errorf("%s: (-want,+got):\n%s", tt.hostname, diff)
+		}
+	}
+
+	rp.allowServices = []string{"billing"}
+	if _, err := rp.resolveCloudRunHost("hello"); err == nil {
+		t.Fatal("expected overridden hostnames to be subject to -allow_services")
+	}
+	rp.allowServices = nil
+
+	// a bad file does not replace the loaded overrides
+	if err := ioutil.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.reload(); err == nil {
+		t.Fatal("expected reload error")
+	}
+	if got, _ := rp.resolveCloudRunHost("hello"); got.host != "hello-canary-hash-uc.a.run.app" {
+		t.Fatalf("got host=%s after failed reload, want the previous override", got.host)
+	}
+	if err := ioutil.WriteFile(path, []byte("hello-green-hash-uc.a.run.app hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := rp.resolveCloudRunHost("hello"); got.host != "hello-green-hash-uc.a.run.app" {
+		t.Fatalf("got host=%s after reload, want the new override", got.host)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// pathRewrite replaces the from prefix of the request paths to a service with
+// to. Both are escaped paths without the trailing slash, so "" is the root.
+type pathRewrite struct {
+	service string
+	from    string
+	to      string
+}
+
+// parsePathRewrites parses comma-separated SERVICE:/FROM=/TO rules.
+func parsePathRewrites(s string) ([]pathRewrite, error) {
+	var out []pathRewrite
+	for _, v := range splitList(s) {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not in SERVICE:/FROM=/TO format", v)
+		}
+		paths := strings.SplitN(parts[1], "=", 2)
+		if len(paths) != 2 {
+			return nil, fmt.Errorf("%q is not in SERVICE:/FROM=/TO format", v)
+		}
+		svc := strings.ToLower(parts[0])
+		if _, ok := dns.IsDomainName(svc); !ok || svc == "" || strings.Contains(svc, ".") {
+			return nil, fmt.Errorf("service name %q is not a valid dns label", parts[0])
+		}
+		r := pathRewrite{service: svc}
+		for i, p := range []*string{&r.from, &r.to} {
+			if err := validateRewritePath(paths[i]); err != nil {
+				return nil, fmt.Errorf("path rewrite %q: %w", v, err)
+			}
+			*p = strings.TrimSuffix(paths[i], "/")
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func validateRewritePath(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("path %q does not start with /", p)
+	}
+	if strings.ContainsAny(p, "?#") {
+		return fmt.Errorf("path %q has a query or fragment", p)
+	}
+	if _, err := url.PathUnescape(p); err != nil {
+		return fmt.Errorf("path %q is not escaped correctly: %w", p, err)
+	}
+	return nil
+}
+
+// rewritePath applies the first rule of the service whose prefix matches
+// the path of u at a segment boundary, and reports whether it did. The
+// escaped path is rewritten so that the percent-encoding of the rest of the
+// path is kept as is; the query is not changed.
+func rewritePath(rules []pathRewrite, service string, u *url.URL) bool {
+	escaped := u.EscapedPath()
+	for _, r := range rules {
+		if r.service != service {
+			continue
+		}
+		if escaped != r.from && !strings.HasPrefix(escaped, r.from+"/") {
+			continue
+		}
+		p := r.to + strings.TrimPrefix(escaped, r.from)
+		if p == "" {
+			p = "/"
+		}
+		unescaped, err := url.PathUnescape(p)
+		if err != nil {
+			return false // both parts are valid escaped paths
+		}
+		u.Path, u.RawPath = unescaped, p
+		return true
+	}
+	return false
+}
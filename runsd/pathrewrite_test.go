@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePathRewrites(t *testing.T) {
+	got, err := parsePathRewrites("Hello:/svc/=/, hello:/=/v1,billing:/a%2Fb=/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pathRewrite{
+		{service: "hello", from: "/svc", to: ""},
+		{service: "hello", from: "", to: "/v1"},
+		{service: "billing", from: "/a%2Fb", to: "/c"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(pathRewrite{})); diff != "" {
+		t.Fatalf("parsePathRewrites() (-want,+got):\n%s", diff)
+	}
+
+	for _, in := range []string{"hello", "hello:/svc", ":/a=/b", "a.b:/a=/b", "hello:svc=/", "hello:/a=b", "hello:/a?x=/b", "hello:/a%zz=/b"} {
+		if _, err := parsePathRewrites(in); err == nil {
+			t.Errorf("parsePathRewrites(%q) expected error", in)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	rules, err := parsePathRewrites("hello:/svc=/,hello:/=/v1,billing:/old/=/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		service string
+		url     string
+		want    string
+	}{
+		{name: "strip", service: "hello", url: "/svc/foo?a=b", want: "/foo?a=b"},
+		{name: "strip to root", service: "hello", url: "/svc", want: "/"},
+		{name: "add", service: "hello", url: "/foo?a=%2F", want: "/v1/foo?a=%2F"},
+		{name: "add to root", service: "hello", url: "/", want: "/v1/"},
+		{name: "replace", service: "billing", url: "/old/x", want: "/new/x"},
+		{name: "percent-encoding kept", service: "billing", url: "/old/a%2Fb%20c", want: "/new/a%2Fb%20c"},
+		{name: "no-op other prefix", service: "billing", url: "/older/x", want: "/older/x"},
+		{name: "no-op other service", service: "other", url: "/svc/foo", want: "/svc/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten := rewritePath(rules, tt.service, u)
+			if got := u.RequestURI(); got != tt.want {
+				t.Fatalf("rewritePath(%s) = %s, want %s", tt.url, got, tt.want)
+			}
+			if rewritten != (tt.url != tt.want) {
+				t.Fatalf("rewritePath(%s) reported rewritten=%v", tt.url, rewritten)
+			}
+		})
+	}
+}
+
+func TestReverseProxyPathRewrite(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.pathRewrites = []pathRewrite{{service: "hello", from: "/svc", to: ""}}
+	var got string
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.URL.String()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://hello.us-central1/svc/a%2Fb?q=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status=%d, want 200", rec.Code)
+	}
+	if want := "https://hello-hash-uc.a.run.app/a%2Fb?q=1"; got != want {
+		t.Fatalf("got upstream url=%s, want %s", got, want)
+	}
+}
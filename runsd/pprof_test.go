@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofListenAddr(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: ":6060", want: "127.0.0.1:6060"},
+		{in: "6060", want: "127.0.0.1:6060"},
+		{in: "localhost:6060", want: "localhost:6060"},
+		{in: "0.0.0.0:6060", want: "0.0.0.0:6060"},
+		{in: "[::1]:6060", want: "[::1]:6060"},
+		{in: "localhost:", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := pprofListenAddr(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pprofListenAddr(%q) error = %v, wantErr = %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("pprofListenAddr(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	pprofHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status=%d, want 200", rec.Code)
+	}
+}
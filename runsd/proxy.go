@@ -12,17 +12,19 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -31,93 +33,582 @@ import (
 )
 
 type reverseProxy struct {
-	projectHash    string
-	currentRegion  string
+	projectHash    string                 // the project number with URLFormatNumber
+	urlFormat      string                 // of the hosts of the services, URLFormatHash if empty
+	currentRegion  string                 // the configured region, used if lookupRegion is not set or fails
+	lookupRegion   func() (string, error) // looks up the region of the instance (from the metadata server), if set
+	regionFallback sync.Once              // warns that currentRegion is used because lookupRegion failed
 	internalDomain string
+	aliasDomains   []string          // other internal domains resolved like internalDomain
+	regionProber   *regionProber     // finds the regions of bare service names, if set
+	overrides      *resolveOverrides // hosts of hostnames that are not resolved, if set
+
+	configMu sync.RWMutex // guards resolverConfig, which is replaced on reloads
+	resolverConfig
+
+	upstreamRetries int
+	retryMaxBackoff time.Duration
+	breakerFailures int // consecutive failures that open the circuit breaker of a host, disabled if 0
+	breakerCooldown time.Duration
+	authPassthrough bool
+	authHeader      string // the identity tokens are sent in (default: Authorization)
+	authNoBearer    bool   // send the identity tokens without the "Bearer " prefix
+	noAuthServices  []string
+	pathRewrites    []pathRewrite
+
+	allowSources []*net.IPNet // if not empty, the only networks requests are accepted from
+
+	strippedHeaders   []string // header names or patterns (with *) not forwarded
+	trustForwardedFor bool     // forward the X-Forwarded-For of the callers
+	noUserAgent       bool     // forward the User-Agent without the runsd token
+	preserveHost      bool     // send the caller's Host (also in X-Forwarded-Host), while dialing and authenticating for the resolved host
+
+	splitter *splitter // splits the traffic of services between revision tags, if set
+
+	rateLimits       map[string]float64 // requests per second, keyed by service name
+	defaultRateLimit float64            // requests per second of other services, unlimited if 0
+
+	upgradeIdleTimeout time.Duration
+	upstreamTimeout    time.Duration
+	serviceTimeouts    map[string]time.Duration // upstreamTimeout of some services, keyed by service name
+	maxBodyBytes       int64                    // limit of non-streaming request bodies, if positive
+	maxResponseBuffer  int64                    // of the response bodies buffered by the ModifyResponse transformations
+
+	flushInterval time.Duration // of the responses of known length, 0 to only flush full buffers, negative for every write
+
+	compress         bool     // gzip the responses for clients that accept it
+	compressMinBytes int64    // size of the smallest response to compress
+	compressRequests []string // service names or patterns to gzip the request bodies of
+
+	accessLog    *accessLogger // if set, requests are logged as json lines
+	debugHeaders bool          // set the X-Runsd-* headers on the responses
+	clean404     bool          // replace the 404 page of Cloud Run for hosts without a service
+
+	tokenSource   func(audience string) (string, error) // fetches identity tokens
+	tokenExpiry   func(token string) (time.Time, error) // of the tokenSource tokens, if they are not jwts
+	tokenCacheDir string                                // if set, identity tokens are also cached in files in it
+
+	tokenRefreshJitter float64 // fraction of the refresh-ahead time background token refreshes are randomly moved by
 }
 
+// defaultFlushInterval is how often the responses of known length are
+// flushed to the client while they are copied. Other responses (e.g. grpc
+// and event streams) are flushed after each write.
+const defaultFlushInterval = 100 * time.Millisecond
+
 func newReverseProxy(projectHash, currentRegion, internalDomain string) *reverseProxy {
 	return &reverseProxy{
-		projectHash:    projectHash,
-		currentRegion:  currentRegion,
-		internalDomain: internalDomain,
+		projectHash:       projectHash,
+		currentRegion:     currentRegion,
+		internalDomain:    internalDomain,
+		upstreamRetries:   defaultUpstreamRetries,
+		retryMaxBackoff:   defaultRetryMaxBackoff,
+		breakerCooldown:   defaultBreakerCooldown,
+		compressMinBytes:  defaultCompressMinBytes,
+		maxResponseBuffer: defaultMaxResponseBuffer,
+		flushInterval:     defaultFlushInterval,
+		tokenSource:       identityToken,
+
+		tokenRefreshJitter: defaultTokenRefreshJitter,
 	}
 }
 
+// headerRegion is the request header callers can set to the region of the
+// service to send the request to (e.g. for a failover), for hostnames that
+// do not have a region. It is not forwarded to the service.
+const headerRegion = "X-Runsd-Region"
+
+type ctxKey string
+
 const (
-	ctxKeyEarlyResponse = `early-response`
+	// ctxKeyEarlyResponse holds an *http.Response the Director decided to
+	// respond with instead of proxying the request.
+	ctxKeyEarlyResponse ctxKey = `early-response`
+
+	// ctxKeyTarget holds the cloudRunTarget the request is routed to.
+	ctxKeyTarget ctxKey = `target`
 )
 
+// cloudRunTarget is the Cloud Run service a hostname resolves to.
+type cloudRunTarget struct {
+	hostname string // requested hostname, without the port
+	service  string
+	tag      string // revision tag, if any
+	region   string
+	project  string // empty for the current project
+	host     string // e.g. foo-dpyb4duzqq-uc.a.run.app
+
+	customDomain bool // whether host is configured by the user (a custom domain or an override)
+	override     bool // whether host is from the resolve overrides
+}
+
+// targetFromContext returns the resolved target of a proxied request.
+func targetFromContext(ctx context.Context) (cloudRunTarget, bool) {
+	v, ok := ctx.Value(ctxKeyTarget).(cloudRunTarget)
+	return v, ok
+}
+
 func (rp *reverseProxy) newReverseProxyHandler(tr http.RoundTripper) http.Handler {
-	tokenInject := authenticatingTransport{next: tr}
-	transport := loggingTransport{next: tokenInject}
+	tokens := newTokenCache(defaultTokenRefreshAhead)
+	tokens.fetch = rp.tokenSource
+	if rp.tokenExpiry != nil {
+		tokens.expiry = rp.tokenExpiry
+	}
+	tokens.jitter = rp.tokenRefreshJitter
+	if rp.tokenCacheDir != "" {
+		tokens.dir = rp.tokenCacheDir
+		if err := tokens.loadDir(); err != nil {
+			klog.Warningf("WARN: not using cached tokens: %v", err)
+		}
+	}
+	tokenInject := authenticatingTransport{
+		next:        tr,
+		tokens:      tokens,
+		passthrough: rp.authPassthrough,
+		noAuth:      rp.noAuthServices,
+		header:      rp.authHeader,
+		noBearer:    rp.authNoBearer,
+	}
+	retrying := retryingTransport{next: tokenInject, retries: rp.upstreamRetries, maxBackoff: rp.retryMaxBackoff}
+	compressRequest := compressRequestTransport{next: retrying, services: rp.compressRequests, minSize: rp.compressMinBytes}
+	breaker := breakerTransport{next: compressRequest}
+	if rp.breakerFailures > 0 {
+		breaker.breaker = newCircuitBreaker(rp.breakerFailures, rp.breakerCooldown)
+	}
+	upgrade := upgradeTransport{next: breaker, idleTimeout: rp.upgradeIdleTimeout}
+	timeout := timeoutTransport{next: upgrade, timeout: rp.upstreamTimeout, services: rp.serviceTimeouts}
+	rateLimit := rateLimitTransport{next: timeout}
+	if len(rp.rateLimits) > 0 || rp.defaultRateLimit > 0 {
+		rateLimit.limiter = newRateLimiter(rp.rateLimits, rp.defaultRateLimit)
+	}
+	earlyResponse := earlyResponseTransport{next: rateLimit}
+	logging := loggingTransport{next: earlyResponse, accessLog: rp.accessLog}
+	tracing := tracingTransport{next: logging}
+	transport := metricsTransport{next: tracing}
 
-	return &httputil.ReverseProxy{
+	return tracingHandler(allowSources(rp.allowSources, rejectConnect(maxBodyHandler(rp.maxBodyBytes, &httputil.ReverseProxy{
 		Transport:     transport,
-		FlushInterval: -1, // to support grpc streaming responses
+		FlushInterval: rp.flushInterval, // responses of unknown length are flushed after each write
+		ErrorHandler:  proxyErrorHandler,
+		ModifyResponse: func(resp *http.Response) error {
+			if isStreamingResponse(resp) {
+				// so that ReverseProxy flushes them after each write, even
+				// if the upstream sets a content-length
+				resp.ContentLength = -1
+				resp.Header.Del("Content-Length")
+			}
+			if rp.clean404 {
+				if err := cleanNotFound(resp, rp.maxResponseBuffer); err != nil {
+					return err
+				}
+			}
+			if rp.compress {
+				gzipResponse(resp, rp.compressMinBytes)
+			}
+			if rp.debugHeaders {
+				setDebugHeaders(resp)
+			}
+			return echoRequestID(resp)
+		},
 		Director: func(req *http.Request) {
-			klog.V(5).Infof("[director] receive req host=%s", req.Host)
+			id := req.Header.Get(headerRequestID)
+			if id == "" {
+				id = newRequestID()
+				req.Header.Set(headerRequestID, id)
+			}
+			newReq := req.WithContext(context.WithValue(req.Context(), ctxKeyRequestID, id))
+			*req = *newReq
+
+			klog.V(5).Infof("[director] receive req host=%s id=%s", req.Host, id)
 			origHost := req.Host
 			if h, p, err := net.SplitHostPort(origHost); err == nil {
 				klog.V(6).Infof("discarding port=%v in host=%s", p, origHost)
 				origHost = h
 			}
-			runHost, err := resolveCloudRunHost(rp.internalDomain, origHost, rp.currentRegion, rp.projectHash)
+			var region string
+			if v := req.Header.Get(headerRegion); v != "" {
+				req.Header.Del(headerRegion) // not forwarded
+				region = strings.ToLower(strings.TrimSpace(v))
+				if _, ok := regionCode(region); !ok {
+					klog.V(1).Infof("WARN: unknown region=%q in %s header host=%s id=%s", v, headerRegion, req.Host, id)
+					resp := errorResponse(req, http.StatusBadRequest, fmt.Sprintf("region %q in the %s header does not have a region code", v, headerRegion))
+					newReq = req.WithContext(context.WithValue(req.Context(), ctxKeyEarlyResponse, resp))
+					*req = *newReq
+					return
+				}
+			}
+			target, err := rp.resolveCloudRunHostInRegion(origHost, region)
 			if err != nil {
-				// this only fails due to region code not being registered –which would be handled
-				// by the DNS resolver so the request should not come here with an invalid region.
-				klog.Warningf("WARN: reverse proxy failed to find a Cloud Run URL for host=%s: %v", req.Host, err)
-				resp := &http.Response{
-					Request:    req,
-					StatusCode: http.StatusInternalServerError,
-					Body: ioutil.NopCloser(bytes.NewReader([]byte(
-						fmt.Sprintf("runsd doesn't know how to handle host=%q: %v", req.Host, err)))),
+				code := resolveErrorCode(err)
+				msg := fmt.Sprintf("runsd doesn't know how to handle host=%q: %v", req.Host, err)
+				if code == http.StatusForbidden {
+					klog.V(1).Infof("WARN: blocked request to a service not in the allowed services host=%s id=%s", req.Host, id)
+					msg = fmt.Sprintf("runsd is not allowed to send requests to host=%q: %v", req.Host, err)
+				} else {
+					klog.Warningf("WARN: reverse proxy failed to find a Cloud Run URL for host=%s id=%s: %v", req.Host, id, err)
 				}
-				newReq := req.WithContext(context.WithValue(req.Context(), ctxKeyEarlyResponse, resp))
+				resp := errorResponse(req, code, msg)
+				newReq = req.WithContext(context.WithValue(req.Context(), ctxKeyEarlyResponse, resp))
 				*req = *newReq
 				return
 			}
+			target.hostname = origHost
+			splitKey := req.Header.Get(headerSplitKey)
+			req.Header.Del(headerSplitKey) // not forwarded
+			if rp.splitter != nil && target.tag == "" && !target.customDomain {
+				if tag, ok := rp.splitter.choose(target.service, splitKey); ok && tag != "" {
+					if h, err := tagHost(target.host, tag); err != nil {
+						klog.Warningf("WARN: cannot split traffic of service=%s to tag=%s id=%s: %v", target.service, tag, id, err)
+					} else {
+						klog.V(6).Infof("[director] split service=%s to tag=%s id=%s", target.service, tag, id)
+						target.tag, target.host = tag, h
+					}
+				}
+			}
+			stripHeaders(req.Header, rp.strippedHeaders)
+			if !rp.noUserAgent {
+				setUserAgent(req)
+			}
+			if !rp.trustForwardedFor {
+				// ReverseProxy sets it to the caller's address instead
+				req.Header.Del("X-Forwarded-For")
+			}
+			if before := req.URL.EscapedPath(); rewritePath(rp.pathRewrites, target.service, req.URL) {
+				klog.V(6).Infof("[director] rewrote path=%s to=%s id=%s", before, req.URL.EscapedPath(), id)
+			}
+			runHost := target.host
 			req.URL.Scheme = "https"
 			req.URL.Host = runHost
-			req.Host = runHost
-			req.Header.Set("host", runHost)
-			klog.V(5).Infof("[director] rewrote host=%s to=%s new_url=%q", origHost, runHost, req.URL)
+			req.Host = runHost // the transport sends it as the Host header
+			if rp.preserveHost {
+				// the transport still dials (and sends the SNI of) the url
+				// host, and the token is for it
+				req.Host = origHost
+				req.Header.Set("X-Forwarded-Host", origHost)
+			}
+			ctx := context.WithValue(req.Context(), ctxKeyTarget, target)
+			if rp.debugHeaders {
+				ctx = context.WithValue(ctx, ctxKeyDebugInfo, new(debugInfo))
+			}
+			newReq = req.WithContext(ctx)
+			*req = *newReq
+			klog.V(5).Infof("[director] rewrote host=%s to=%s new_url=%q id=%s", origHost, runHost, req.URL, id)
 		},
+	}))))
+}
+
+// echoRequestID sets the correlation id of the request on the response,
+// unless the upstream already did.
+func echoRequestID(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
 	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if id := requestID(resp.Request.Context()); id != "" && resp.Header.Get(headerRequestID) == "" {
+		resp.Header.Set(headerRequestID, id)
+	}
+	return nil
+}
+
+// Errors returned by resolveCloudRunHost, see resolveErrorCode.
+var (
+	ErrRegionNotHandled    = errors.New("region is not handled")
+	ErrMetadataUnavailable = errors.New("metadata is unavailable")
+	ErrServiceNotAllowed   = errors.New("service is not allowed")
+	ErrIPAddress           = errors.New("hostname is an ip address, not a service name")
+)
+
+// unhandledRegionError indicates a region without a known region code. It
+// matches ErrRegionNotHandled.
+type unhandledRegionError struct {
+	region string
+}
+
+func (e *unhandledRegionError) Error() string {
+	return fmt.Sprintf("region %q is not handled", e.region)
 }
 
-func resolveCloudRunHost(internalDomain, hostname, curRegion, projectHash string) (string, error) {
-	hostname = strings.ToLower(hostname) // TODO surprisingly not canonicalized by now
+func (e *unhandledRegionError) Is(target error) bool { return target == ErrRegionNotHandled }
 
-	if !strings.Contains(hostname, ".") {
-		// in the same region
-		rc, ok := cloudRunRegionCodes[curRegion]
-		if !ok {
-			return "", fmt.Errorf("region %q is not handled", curRegion)
+// resolveErrorCode is the status code of the response to requests whose
+// hostname failed to resolve with err.
+func resolveErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrRegionNotHandled):
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, ErrServiceNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrIPAddress):
+		return http.StatusBadRequest
+	default: // incl. ErrMetadataUnavailable
+		return http.StatusBadGateway
+	}
+}
+
+// resolveCloudRunHost finds the Cloud Run service for hostnames in
+// [TAG.]SERVICE[.REGION][.PROJECT][.DOMAIN] format. PROJECT must be one of the
+// projectHashes, otherwise the current project is used. Without a REGION, the
+// region from serviceRegions, or the probed region for bare SERVICE names, or
+// else the current region is used. Bare SERVICE names in customDomains
+// resolve to their custom domain. Hostnames in overrides resolve to their
+// override before anything else. A port in the hostname is ignored, and IP
+// addresses are rejected.
+func (rp *reverseProxy) resolveCloudRunHost(hostname string) (cloudRunTarget, error) {
+	return rp.resolveCloudRunHostInRegion(hostname, "")
+}
+
+// resolveCloudRunHostInRegion is resolveCloudRunHost for hostnames without a
+// REGION resolving as if they had the region, if it is set (e.g. from the
+// X-Runsd-Region header).
+func (rp *reverseProxy) resolveCloudRunHostInRegion(hostname, region string) (cloudRunTarget, error) {
+	hostname, err := hostOnly(hostname)
+	if err != nil {
+		return cloudRunTarget{}, err
+	}
+	if hostname, err = canonicalHostname(hostname); err != nil {
+		return cloudRunTarget{}, err
+	}
+	c := rp.config()
+	trimmed := trimInternalDomain(hostname, append([]string{rp.internalDomain}, rp.aliasDomains...))
+	n, err := parseInternalName(strings.Split(trimmed, "."), c.projectHashes)
+	if rp.overrides != nil {
+		if h, ok := rp.overrides.lookup(hostname, trimmed); ok {
+			t := cloudRunTarget{service: n.service, tag: n.tag, region: n.region, project: n.project, host: h, customDomain: true, override: true}
+			if err != nil {
+				t = cloudRunTarget{service: strings.SplitN(trimmed, ".", 2)[0], host: h, customDomain: true, override: true}
+			}
+			if len(c.allowServices) > 0 && !matchService(c.allowServices, t.service) {
+				return cloudRunTarget{}, fmt.Errorf("%w: %q is not in -allow_services", ErrServiceNotAllowed, t.service)
+			}
+			return t, nil
 		}
-		return mkCloudRunHost(hostname, rc, projectHash), nil
+	}
+	if err != nil {
+		return cloudRunTarget{}, fmt.Errorf("%w (inferred from hostname %s, trimmed: %s), try upgrading runsd", err, hostname, trimmed)
 	}
 
-	trimmed := strings.TrimSuffix(hostname, "."+strings.Trim(internalDomain, "."))
-	if strings.Count(trimmed, ".") != 1 {
-		return "", fmt.Errorf("found too many dots in hostname %q, (trimmed: %s)", hostname, trimmed)
+	t := cloudRunTarget{service: n.service, tag: n.tag, region: n.region, project: n.project}
+	if t.region == "" {
+		t.region = region
+	}
+	if len(c.allowServices) > 0 && !matchService(c.allowServices, t.service) {
+		return cloudRunTarget{}, fmt.Errorf("%w: %q is not in -allow_services", ErrServiceNotAllowed, t.service)
+	}
+	if d, ok := c.customDomains[t.service]; ok && t.tag == "" && t.region == "" && t.project == "" {
+		t.host, t.customDomain = d, true
+		return t, nil
+	}
+	if t.region == "" {
+		if r, ok := c.serviceRegions[t.service]; ok {
+			t.region = r
+		} else if rp.regionProber != nil && t.tag == "" && t.project == "" {
+			t.region = rp.regionProber.region(t.service)
+		} else {
+			// in the same region
+			t.region = rp.region()
+		}
 	}
+	if t.region == "" {
+		// the current region comes from the metadata server (or -gcp_region)
+		return cloudRunTarget{}, fmt.Errorf("%w: the current region is not known", ErrMetadataUnavailable)
+	}
+	hash := rp.projectHash
+	if t.project != "" {
+		hash = c.projectHashes[t.project]
+	}
+	host, err := rp.serviceHost(t.service, t.region, hash)
+	if err != nil {
+		return cloudRunTarget{}, err
+	}
+	if t.host, err = tagHost(host, t.tag); err != nil {
+		return cloudRunTarget{}, err
+	}
+	return t, nil
+}
 
-	splits := strings.SplitN(trimmed, ".", 2)
-	svc, svcRegion := splits[0], splits[1]
+// region returns the region of the services reached with hostnames without a
+// region: the region of the instance, or currentRegion if lookupRegion is not
+// set or fails (e.g. the metadata server is unreachable). The fallback is
+// logged once, and not for every request.
+func (rp *reverseProxy) region() string {
+	if rp.lookupRegion == nil {
+		return rp.currentRegion
+	}
+	r, err := rp.lookupRegion()
+	if err == nil && r == "" {
+		err = errors.New("empty region")
+	}
+	if err != nil {
+		if rp.currentRegion != "" {
+			rp.regionFallback.Do(func() {
+				klog.Warningf("WARN: metadata unreachable, using configured region %s: %v", rp.currentRegion, err)
+			})
+		}
+		return rp.currentRegion
+	}
+	return r
+}
 
-	rc, ok := cloudRunRegionCodes[svcRegion]
+// serviceHost returns the host of the service in the region of the project
+// with the hash (or number), in the URL format of the proxy.
+func (rp *reverseProxy) serviceHost(svc, region, hash string) (string, error) {
+	rc, ok := regionCode(region)
 	if !ok {
-		return "", fmt.Errorf("region %q is not handled (inferred from hostname %s), try upgrading runsd", svcRegion, hostname)
+		return "", &unhandledRegionError{region: region}
+	}
+	if rp.urlFormat == URLFormatNumber {
+		return mkCloudRunNumberHost(svc, region, hash), nil
+	}
+	return mkCloudRunHost(svc, rc, hash), nil
+}
+
+// tagHost returns the host of the revision tag (if any) of the service at
+// the *.run.app host.
+func tagHost(host, tag string) (string, error) {
+	if tag != "" {
+		host = tag + "---" + host
+	}
+	if l := strings.Index(host, "."); l > 63 {
+		return "", fmt.Errorf("hostname %q is too long for a dns label", host[:l])
+	}
+	return host, nil
+}
+
+// explainResolution describes where requests to the hostname would be sent,
+// for -resolve.
+func (rp *reverseProxy) explainResolution(hostname string) (string, error) {
+	t, err := rp.resolveCloudRunHost(hostname)
+	if err != nil {
+		return "", err
+	}
+	or := func(v, empty string) string {
+		if v == "" {
+			return empty
+		}
+		return v
+	}
+	audience := "https://" + t.host
+	if matchService(rp.noAuthServices, t.service) {
+		audience = "(none, service is in -no_auth)"
+	}
+	host := t.host
+	if t.override {
+		host += " (from -resolve_overrides)"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "host:       %s\n", host)
+	fmt.Fprintf(&b, "service:    %s\n", t.service)
+	fmt.Fprintf(&b, "tag:        %s\n", or(t.tag, "(none)"))
+	fmt.Fprintf(&b, "region:     %s\n", or(t.region, "(custom domain)"))
+	fmt.Fprintf(&b, "project:    %s\n", or(t.project, "(current)"))
+	fmt.Fprintf(&b, "audience:   %s\n", audience)
+	return b.String(), nil
+}
+
+// matchService reports whether the service name matches any of the patterns
+// (see matchWildcard, e.g. "public-*").
+func matchService(patterns []string, svc string) bool {
+	for _, p := range patterns {
+		if matchWildcard(p, svc) {
+			return true
+		}
+	}
+	return false
+}
+
+// servicePattern matches the service names with "*" wildcards.
+var servicePattern = regexp.MustCompile(`^[a-zA-Z0-9*-]+$`)
+
+// validateServicePatterns checks the patterns are service names with "*"
+// wildcards.
+func validateServicePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if !servicePattern.MatchString(p) {
+			return fmt.Errorf("invalid service pattern %q: only letters, digits, - and * wildcards are allowed", p)
+		}
 	}
-	return mkCloudRunHost(svc, rc, projectHash), nil
+	return nil
 }
 
 func mkCloudRunHost(svc, regionCode, projectHash string) string {
 	return fmt.Sprintf("%s-%s-%s.a.run.app", svc, projectHash, regionCode)
 }
 
-func allowh2c(next http.Handler) http.Handler {
-	h2server := &http2.Server{IdleTimeout: time.Second * 60}
-	return h2c.NewHandler(next, h2server)
+// mkCloudRunNumberHost returns the host of the service in URLFormatNumber.
+func mkCloudRunNumberHost(svc, region, projectNumber string) string {
+	return fmt.Sprintf("%s-%s.%s.run.app", svc, projectNumber, region)
+}
+
+const (
+	defaultH2IdleTimeout = 60 * time.Second
+
+	// defaults of the http2 package when the values are left unset
+	h2DefaultMaxConcurrentStreams = 250
+	h2DefaultMaxReadFrameSize     = 1 << 20
+)
+
+// h2Options configures the HTTP/2 (h2c) server of the proxy. Zero values use
+// the http2 package defaults.
+type h2Options struct {
+	maxConcurrentStreams uint32
+	idleTimeout          time.Duration
+	maxReadFrameSize     uint32
+}
+
+func (o h2Options) validate() error {
+	// http2.Server silently ignores the frame sizes outside the range allowed
+	// by RFC 7540 section 4.2
+	if o.maxReadFrameSize != 0 && (o.maxReadFrameSize < 1<<14 || o.maxReadFrameSize > 1<<24-1) {
+		return fmt.Errorf("max read frame size %d is not between 16KiB and 16MiB", o.maxReadFrameSize)
+	}
+	if o.idleTimeout < 0 {
+		return fmt.Errorf("idle timeout %v is negative", o.idleTimeout)
+	}
+	return nil
+}
+
+// String returns the effective values, with the defaults filled in.
+func (o h2Options) String() string {
+	streams, frame, idle := o.maxConcurrentStreams, o.maxReadFrameSize, o.idleTimeout.String()
+	if streams == 0 {
+		streams = h2DefaultMaxConcurrentStreams
+	}
+	if frame == 0 {
+		frame = h2DefaultMaxReadFrameSize
+	}
+	if o.idleTimeout == 0 {
+		idle = "none"
+	}
+	return fmt.Sprintf("max_concurrent_streams=%d idle_timeout=%s max_read_frame_size=%d", streams, idle, frame)
+}
+
+func allowh2c(next http.Handler, o h2Options) http.Handler {
+	h2server := &http2.Server{
+		MaxConcurrentStreams: o.maxConcurrentStreams,
+		IdleTimeout:          o.idleTimeout,
+		MaxReadFrameSize:     o.maxReadFrameSize,
+	}
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &closeOnceBody{ReadCloser: r.Body}
+		}
+		next.ServeHTTP(w, r)
+	}), h2server)
+}
+
+// closeOnceBody closes the body of an h2c request only once. ReverseProxy and
+// the upstream transport both close it, at the same time when the response
+// comes before the request is sent (e.g. gRPC errors), and the request body of
+// http2.Server is not safe for concurrent Close calls.
+type closeOnceBody struct {
+	io.ReadCloser
+	once sync.Once
+	err  error
+}
+
+func (b *closeOnceBody) Close() error {
+	b.once.Do(func() { b.err = b.ReadCloser.Close() })
+	return b.err
 }
@@ -0,0 +1,827 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/klog/v2"
+)
+
+func TestResolveCloudRunHost(t *testing.T) {
+	cases := []struct {
+		hostname   string
+		curRegion  string
+		want       string
+		wantErrMsg string
+	}{
+		{hostname: "foo", curRegion: "us-central1", want: "foo-hash-uc.a.run.app"},
+		{hostname: "FOO", curRegion: "us-central1", want: "foo-hash-uc.a.run.app"},
+		{hostname: "foo.", curRegion: "us-central1", want: "foo-hash-uc.a.run.app"},
+		{hostname: "Foo.Europe-West1.Run.Internal.", curRegion: "us-central1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "bücher", curRegion: "us-central1", want: "xn--bcher-kva-hash-uc.a.run.app"},
+		{hostname: "foo_bar", curRegion: "us-central1", wantErrMsg: "invalid hostname"},
+		{hostname: "foo.europe-west1", curRegion: "us-central1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "foo.europe-west1.run.internal", curRegion: "us-central1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "foo", curRegion: "mars-east1", wantErrMsg: `"mars-east1"`},
+		{hostname: "foo.us-mars1", curRegion: "us-central1", wantErrMsg: `"us-mars1"`},
+		{hostname: "a.foo.bar.us-central1", curRegion: "us-central1", wantErrMsg: "too many dots"},
+		{hostname: "foo:8080", curRegion: "us-central1", want: "foo-hash-uc.a.run.app"},
+		{hostname: "foo.europe-west1:8080", curRegion: "us-central1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "10.0.0.1", curRegion: "us-central1", wantErrMsg: "ip address"},
+		{hostname: "10.0.0.1:8080", curRegion: "us-central1", wantErrMsg: "ip address"},
+		{hostname: "[::1]", curRegion: "us-central1", wantErrMsg: "ip address"},
+		{hostname: "[::1]:8080", curRegion: "us-central1", wantErrMsg: "ip address"},
+		{hostname: "::1", curRegion: "us-central1", wantErrMsg: "ip address"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, err := newReverseProxy("hash", tt.curRegion, "run.internal.").resolveCloudRunHost(tt.hostname)
+			if tt.wantErrMsg != "" {
+				if err == nil {
+					t.Fatalf("expected error, got host=%s", got.host)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.host != tt.want {
+				t.Fatalf("resolveCloudRunHost(%s) = %s, want %s", tt.hostname, got.host, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkResolveCloudRunHost measures the resolution done for each proxied
+// request, with the region prober of -region_fallbacks mocked (and warm, as
+// its results are cached).
+func BenchmarkResolveCloudRunHost(b *testing.B) {
+	for _, bb := range []struct {
+		name     string
+		hostname string
+		probe    bool
+	}{
+		{name: "bare", hostname: "foo"},
+		{name: "bare probed", hostname: "foo", probe: true},
+		{name: "region", hostname: "foo.europe-west1"},
+		{name: "tag", hostname: "green.foo"},
+		{name: "fqdn", hostname: "Foo.Europe-West1.Run.Internal."},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			if bb.probe {
+				rp.regionProber = newRegionProber([]string{"us-central1", "europe-west1"}, func(svc, r string) string { return svc + "." + r })
+				rp.regionProber.probe = func(host string) (bool, error) { return strings.HasSuffix(host, ".europe-west1"), nil }
+			}
+			if _, err := rp.resolveCloudRunHost(bb.hostname); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rp.resolveCloudRunHost(bb.hostname); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveCloudRunHostNumberFormat(t *testing.T) {
+	rp := newReverseProxy("123456789012", "us-central1", "run.internal.")
+	rp.urlFormat = URLFormatNumber
+	rp.setConfig(resolverConfig{projectHashes: map[string]string{"shared": "42"}})
+	for hostname, want := range map[string]string{
+		"foo":                  "foo-123456789012.us-central1.run.app",
+		"foo.europe-west1":     "foo-123456789012.europe-west1.run.app",
+		"green.foo":            "green---foo-123456789012.us-central1.run.app",
+		"foo.shared":           "foo-42.us-central1.run.app",
+		"foo.us-east1.shared.": "foo-42.us-east1.run.app",
+	} {
+		got, err := rp.resolveCloudRunHost(hostname)
+		if err != nil {
+			t.Fatalf("resolveCloudRunHost(%s): %v", hostname, err)
+		}
+		if got.host != want {
+			t.Errorf("resolveCloudRunHost(%s) = %s, want %s", hostname, got.host, want)
+		}
+		if err := validateAudienceHost(got.host); err != nil {
+			t.Errorf("resolveCloudRunHost(%s) = %s: %v", hostname, got.host, err)
+		}
+	}
+	if _, err := rp.resolveCloudRunHost("foo.us-mars1"); err == nil {
+		t.Error("unknown region resolved")
+	}
+}
+
+func TestResolveCloudRunHostAliasDomains(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.aliasDomains = []string{"old.example.", "internal."}
+	for _, hostname := range []string{
+		"foo.europe-west1",
+		"foo.europe-west1.run.internal",
+		"foo.europe-west1.old.example.",
+		"foo.europe-west1.internal",
+	} {
+		got, err := rp.resolveCloudRunHost(hostname)
+		if err != nil {
+			t.Fatalf("resolveCloudRunHost(%s): %v", hostname, err)
+		}
+		if want := "foo-hash-ew.a.run.app"; got.host != want {
+			t.Fatalf("resolveCloudRunHost(%s) = %s, want %s", hostname, got.host, want)
+		}
+	}
+}
+
+func TestResolveCloudRunHostOtherProjects(t *testing.T) {
+	projects := map[string]string{"shared": "sharedhash"}
+	cases := []struct {
+		hostname    string
+		want        string
+		wantProject string
+		wantErrMsg  string
+	}{
+		{hostname: "foo", want: "foo-hash-uc.a.run.app"},
+		{hostname: "foo.europe-west1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "auth.shared", want: "auth-sharedhash-uc.a.run.app", wantProject: "shared"},
+		{hostname: "auth.shared.run.internal", want: "auth-sharedhash-uc.a.run.app", wantProject: "shared"},
+		{hostname: "auth.europe-west1.shared", want: "auth-sharedhash-ew.a.run.app", wantProject: "shared"},
+		{hostname: "auth.europe-west1.shared.run.internal", want: "auth-sharedhash-ew.a.run.app", wantProject: "shared"},
+		{hostname: "auth.europe-west1.other", wantErrMsg: `project "other" is not configured`},
+		{hostname: "auth.us-mars1.shared", wantErrMsg: `"us-mars1"`},
+		{hostname: "a.b.c.d", wantErrMsg: "too many dots"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.projectHashes = projects
+			got, err := rp.resolveCloudRunHost(tt.hostname)
+			if tt.wantErrMsg != "" {
+				if err == nil {
+					t.Fatalf("expected error, got host=%s", got.host)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.host != tt.want || got.project != tt.wantProject {
+				t.Fatalf("resolveCloudRunHost(%s) = (%s, project=%q), want (%s, project=%q)", tt.hostname, got.host, got.project, tt.want, tt.wantProject)
+			}
+		})
+	}
+}
+
+func TestResolveCloudRunHostTags(t *testing.T) {
+	projects := map[string]string{"shared": "sharedhash"}
+	cases := []struct {
+		hostname   string
+		want       string
+		wantTag    string
+		wantErrMsg string
+	}{
+		{hostname: "foo", want: "foo-hash-uc.a.run.app"},
+		{hostname: "foo.europe-west1", want: "foo-hash-ew.a.run.app"},
+		{hostname: "green.foo", want: "green---foo-hash-uc.a.run.app", wantTag: "green"},
+		{hostname: "green.foo.run.internal", want: "green---foo-hash-uc.a.run.app", wantTag: "green"},
+		{hostname: "v2.foo.europe-west1", want: "v2---foo-hash-ew.a.run.app", wantTag: "v2"},
+		{hostname: "v2.foo.europe-west1.shared", want: "v2---foo-sharedhash-ew.a.run.app", wantTag: "v2"},
+		{hostname: "v2.foo.shared", want: "v2---foo-sharedhash-uc.a.run.app", wantTag: "v2"},
+		{hostname: "2x.foo", wantErrMsg: "not a valid revision tag"},
+		{hostname: "a--b.foo", wantErrMsg: "not a valid revision tag"},
+		{hostname: "green-.foo", wantErrMsg: "not a valid revision tag"},
+		{hostname: strings.Repeat("t", 50) + ".foo", wantErrMsg: "too long"},
+		{hostname: "green.foo.us-mars1", wantErrMsg: `"us-mars1"`},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.projectHashes = projects
+			got, err := rp.resolveCloudRunHost(tt.hostname)
+			if tt.wantErrMsg != "" {
+				if err == nil {
+					t.Fatalf("expected error, got host=%s", got.host)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.host != tt.want || got.tag != tt.wantTag {
+				t.Fatalf("resolveCloudRunHost(%s) = (%s, tag=%q), want (%s, tag=%q)", tt.hostname, got.host, got.tag, tt.want, tt.wantTag)
+			}
+		})
+	}
+}
+
+func TestResolveCloudRunHostServiceRegions(t *testing.T) {
+	cases := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "payments", want: "payments-hash-uc.a.run.app"},
+		{hostname: "green.payments", want: "green---payments-hash-uc.a.run.app"},
+		{hostname: "payments.asia-east1", want: "payments-hash-de.a.run.app"},
+		{hostname: "payments.shared", want: "payments-sharedhash-uc.a.run.app"},
+		{hostname: "foo", want: "foo-hash-ew.a.run.app"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			rp := newReverseProxy("hash", "europe-west1", "run.internal.")
+			rp.projectHashes = map[string]string{"shared": "sharedhash"}
+			rp.serviceRegions = map[string]string{"payments": "us-central1"}
+			got, err := rp.resolveCloudRunHost(tt.hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.host != tt.want {
+				t.Fatalf("resolveCloudRunHost(%s) = %s, want %s", tt.hostname, got.host, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCloudRunHostMetadataRegion(t *testing.T) {
+	cases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		hostname string
+		want     string
+	}{
+		{
+			name: "metadata region",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("projects/123/zones/europe-west1-1"))
+			},
+			hostname: "foo",
+			want:     "foo-hash-ew.a.run.app",
+		},
+		{
+			name: "metadata unreachable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			hostname: "foo",
+			want:     "foo-hash-uc.a.run.app", // the configured region
+		},
+		{
+			name: "region in hostname",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			hostname: "foo.asia-east1",
+			want:     "foo-hash-de.a.run.app",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.lookupRegion = func() (string, error) {
+				v, err := queryMetadata(srv.URL)
+				if err != nil {
+					return "", err
+				}
+				return regionFromZone(v)
+			}
+			for i := 0; i < 3; i++ {
+				got, err := rp.resolveCloudRunHost(tt.hostname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.host != tt.want {
+					t.Fatalf("resolveCloudRunHost(%s) = %s, want %s", tt.hostname, got.host, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReverseProxyRegionFallbackWarnsOnce(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+	buf, restore := captureLogs()
+	defer restore()
+	// only capture the warnings, and not their copies in the info log
+	klog.SetOutputBySeverity("INFO", ioutil.Discard)
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.lookupRegion = func() (string, error) {
+		return "", errors.New("metadata server did not respond")
+	}
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "foo-hash-uc.a.run.app" {
+			t.Errorf("got upstream host=%q, want the configured region", req.URL.Host)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://foo/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("got status=%d, want %d", rec.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := strings.Count(buf.String(), "metadata unreachable, using configured region us-central1"); n != 1 {
+		t.Fatalf("fallback warning logged %d times, want once; logs:\n%s", n, buf.String())
+	}
+}
+
+func TestResolveCloudRunHostCustomDomains(t *testing.T) {
+	cases := []struct {
+		hostname         string
+		want             string
+		wantCustomDomain bool
+	}{
+		{hostname: "payments", want: "payments.example.com", wantCustomDomain: true},
+		{hostname: "payments.run.internal", want: "payments.example.com", wantCustomDomain: true},
+		{hostname: "payments.europe-west1", want: "payments-hash-ew.a.run.app"},
+		{hostname: "green.payments", want: "green---payments-hash-uc.a.run.app"},
+		{hostname: "foo", want: "foo-hash-uc.a.run.app"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.customDomains = map[string]string{"payments": "payments.example.com"}
+			got, err := rp.resolveCloudRunHost(tt.hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.host != tt.want || got.customDomain != tt.wantCustomDomain {
+				t.Fatalf("resolveCloudRunHost(%s) = (%s, custom=%v), want (%s, custom=%v)", tt.hostname, got.host, got.customDomain, tt.want, tt.wantCustomDomain)
+			}
+		})
+	}
+}
+
+func TestReverseProxyCustomDomainAudience(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.customDomains = map[string]string{"payments": "payments.example.com"}
+	var audience, gotURL string
+	rp.tokenSource = func(aud string) (string, error) {
+		audience = aud
+		return "token", nil
+	}
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotURL = req.URL.String()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://payments/pay", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status=%d, want 200", rec.Code)
+	}
+	if gotURL != "https://payments.example.com/pay" {
+		t.Errorf("got upstream url=%q", gotURL)
+	}
+	if audience != "https://payments.example.com" {
+		t.Errorf("got token audience=%q", audience)
+	}
+}
+
+func TestReverseProxySingleHostHeader(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	// raw backend, since net/http servers already merge the Host headers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	hosts := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var got []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			if kv := strings.SplitN(line, ":", 2); len(kv) == 2 && strings.EqualFold(kv[0], "host") {
+				got = append(got, strings.TrimSpace(kv[1]))
+			}
+		}
+		hosts <- got
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}()
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	h := rp.newReverseProxyHandler(&http.Transport{
+		// the listener stands in for the TLS connection to Cloud Run
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, ln.Addr().String())
+		},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://foo/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status=%d, want 200: %s", rec.Code, rec.Body)
+	}
+	if diff := cmp.Diff([]string{"foo-hash-uc.a.run.app"}, <-hosts); diff != "" {
+		t.Fatalf("backend host headers (-want,+got):\n%s", diff)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestReverseProxyEarlyResponse(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected outbound request to %s", req.URL)
+		return nil, errors.New("unexpected outbound request")
+	}))
+
+	cases := []struct {
+		host     string
+		wantCode int
+	}{
+		{host: "foo.us-mars1", wantCode: http.StatusMisdirectedRequest},
+		{host: "a.b.c.d", wantCode: http.StatusBadGateway},
+	}
+	for _, tt := range cases {
+		t.Run(tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d", rec.Code, tt.wantCode)
+			}
+			if ct := rec.Header().Get("content-type"); ct != "application/json" {
+				t.Fatalf("got content-type=%q, want application/json", ct)
+			}
+			var body struct {
+				Message string `json:"message"`
+				Host    string `json:"host"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to parse response %q: %v", rec.Body.String(), err)
+			}
+			if body.Host != tt.host || !strings.Contains(body.Message, "doesn't know how to handle") {
+				t.Fatalf("unexpected body: %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReverseProxyPropagatesTraceContext(t *testing.T) {
+	if _, err := setupTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	var got string
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Get("traceparent")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+	req.Header.Set("traceparent", traceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.HasPrefix(got, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Fatalf("trace context not propagated, got traceparent=%q", got)
+	}
+}
+
+func TestH2Options(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      h2Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			in:   h2Options{idleTimeout: defaultH2IdleTimeout},
+			want: "max_concurrent_streams=250 idle_timeout=1m0s max_read_frame_size=1048576",
+		},
+		{
+			name: "custom",
+			in:   h2Options{maxConcurrentStreams: 1000, idleTimeout: 10 * time.Minute, maxReadFrameSize: 1 << 14},
+			want: "max_concurrent_streams=1000 idle_timeout=10m0s max_read_frame_size=16384",
+		},
+		{
+			name: "no idle timeout",
+			in:   h2Options{},
+			want: "max_concurrent_streams=250 idle_timeout=none max_read_frame_size=1048576",
+		},
+		{name: "frame too small", in: h2Options{maxReadFrameSize: 1024}, wantErr: true},
+		{name: "frame too large", in: h2Options{maxReadFrameSize: 1 << 24}, wantErr: true},
+		{name: "negative idle timeout", in: h2Options{idleTimeout: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.in.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() err=%v, wantErr=%v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := tt.in.String(); got != tt.want {
+				t.Fatalf("String()=%q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReverseProxyAllowServices(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name     string
+		allow    []string
+		host     string
+		wantCode int
+	}{
+		{name: "empty list allows all", host: "foo", wantCode: http.StatusOK},
+		{name: "allowed", allow: []string{"foo", "bar"}, host: "foo", wantCode: http.StatusOK},
+		{name: "allowed in other region", allow: []string{"foo"}, host: "foo.europe-west1", wantCode: http.StatusOK},
+		{name: "allowed with tag", allow: []string{"foo"}, host: "green.foo", wantCode: http.StatusOK},
+		{name: "case insensitive", allow: []string{"foo"}, host: "FOO", wantCode: http.StatusOK},
+		{name: "pattern", allow: []string{"billing-*"}, host: "billing-api", wantCode: http.StatusOK},
+		{name: "blocked", allow: []string{"foo"}, host: "bar", wantCode: http.StatusForbidden},
+		{name: "blocked service named like tag", allow: []string{"foo"}, host: "foo.bar", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.allowServices = tt.allow
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReverseProxyResolveErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		region   string
+		allow    []string
+		host     string
+		wantErr  error
+		wantCode int
+	}{
+		{name: "region not handled", region: "us-central1", host: "foo.us-mars1", wantErr: ErrRegionNotHandled, wantCode: http.StatusMisdirectedRequest},
+		{name: "current region unknown", host: "foo", wantErr: ErrMetadataUnavailable, wantCode: http.StatusBadGateway},
+		{name: "service not allowed", region: "us-central1", allow: []string{"bar"}, host: "foo", wantErr: ErrServiceNotAllowed, wantCode: http.StatusForbidden},
+		{name: "ip address", region: "us-central1", host: "10.0.0.1", wantErr: ErrIPAddress, wantCode: http.StatusBadRequest},
+		{name: "ipv6 address", region: "us-central1", host: "[::1]:8080", wantErr: ErrIPAddress, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", tt.region, "run.internal.")
+			rp.allowServices = tt.allow
+			if _, err := rp.resolveCloudRunHost(tt.host); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveCloudRunHost(%s) err=%v, want %v", tt.host, err, tt.wantErr)
+			}
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				t.Fatal("request should not be sent upstream")
+				return nil, nil
+			}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReverseProxyRegionHeader(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name     string
+		host     string
+		region   string
+		wantCode int
+		wantHost string
+	}{
+		{name: "absent", host: "foo", wantCode: http.StatusOK, wantHost: "foo-hash-uc.a.run.app"},
+		{name: "valid", host: "foo", region: "europe-west1", wantCode: http.StatusOK, wantHost: "foo-hash-ew.a.run.app"},
+		{name: "case insensitive", host: "foo", region: " US-East1 ", wantCode: http.StatusOK, wantHost: "foo-hash-ue.a.run.app"},
+		{name: "over service region", host: "bar", region: "europe-west1", wantCode: http.StatusOK, wantHost: "bar-hash-ew.a.run.app"},
+		{name: "hostname region wins", host: "foo.us-east1", region: "europe-west1", wantCode: http.StatusOK, wantHost: "foo-hash-ue.a.run.app"},
+		{name: "unknown", host: "foo", region: "us-mars1", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.serviceRegions = map[string]string{"bar": "us-east1"}
+			var gotHost string
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if v := req.Header.Get(headerRegion); v != "" {
+					t.Errorf("%s header was forwarded: %q", headerRegion, v)
+				}
+				gotHost = req.URL.Host
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			if tt.region != "" {
+				req.Header.Set(headerRegion, tt.region)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if gotHost != tt.wantHost {
+				t.Fatalf("got upstream host=%q, want %q", gotHost, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestExplainResolution(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.projectHashes = map[string]string{"shared": "other"}
+	rp.customDomains = map[string]string{"web": "web.example.com"}
+	rp.noAuthServices = []string{"public"}
+	rp.allowServices = []string{"foo", "web", "public"}
+
+	tests := []struct {
+		host    string
+		want    string
+		wantErr string
+	}{
+		{
+			host: "green.foo.europe-west1.shared",
+			want: "host:       green---foo-other-ew.a.run.app\n" +
+				"service:    foo\n" +
+				"tag:        green\n" +
+				"region:     europe-west1\n" +
+				"project:    shared\n" +
+				"audience:   https://green---foo-other-ew.a.run.app\n",
+		},
+		{
+			host: "web",
+			want: "host:       web.example.com\n" +
+				"service:    web\n" +
+				"tag:        (none)\n" +
+				"region:     (custom domain)\n" +
+				"project:    (current)\n" +
+				"audience:   https://web.example.com\n",
+		},
+		{
+			host: "public",
+			want: "host:       public-hash-uc.a.run.app\n" +
+				"service:    public\n" +
+				"tag:        (none)\n" +
+				"region:     us-central1\n" +
+				"project:    (current)\n" +
+				"audience:   (none, service is in -no_auth)\n",
+		},
+		{host: "bar", wantErr: "not in -allow_services"},
+		{host: "foo.us-mars1", wantErr: `"us-mars1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := rp.explainResolution(tt.host)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got err=%v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("explainResolution(%s) (-want,+got):\n%s", tt.host, diff)
+			}
+		})
+	}
+}
+
+func TestReverseProxyPreserveHost(t *testing.T) {
+	type seen struct {
+		audience, sni, host, forwardedHost, authz string
+	}
+	cases := []struct {
+		name         string
+		preserveHost bool
+		want         seen
+	}{
+		{name: "default", want: seen{audience: "https://hello-hash-uc.a.run.app", sni: "hello-hash-uc.a.run.app", host: "hello-hash-uc.a.run.app", authz: "Bearer token"}},
+		{name: "preserve host", preserveHost: true,
+			want: seen{audience: "https://hello-hash-uc.a.run.app", sni: "hello-hash-uc.a.run.app", host: "hello", forwardedHost: "hello", authz: "Bearer token"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				got seen
+			)
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				got.host, got.forwardedHost, got.authz = r.Host, r.Header.Get("X-Forwarded-Host"), r.Header.Get("Authorization")
+			}))
+			backend.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				got.sni = hello.ServerName
+				return nil, nil
+			}}
+			backend.StartTLS()
+			defer backend.Close()
+
+			// every upstream host is dialed at the backend
+			tr := &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+			defer tr.CloseIdleConnections()
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.preserveHost = tt.preserveHost
+			rp.tokenSource = func(audience string) (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				got.audience = audience
+				return "token", nil
+			}
+			h := rp.newReverseProxyHandler(tr)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://hello/", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status=%d (body=%q)", rec.Code, rec.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(seen{})); diff != "" {
+				t.Fatalf("upstream request (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -12,20 +12,36 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
+// authenticatingTransport injects identity tokens to the outbound requests.
+// If the request already has an Authorization header, it is left intact and
+// the token is not injected, unless passthrough is set, in which case the
+// token is sent in the X-Serverless-Authorization header instead.
+//
+// Requests to services matching one of the noAuth patterns are sent without
+// a token.
+//
+// The token is sent in the header (Authorization by default) with the
+// "Bearer " prefix, unless noBearer is set.
 type authenticatingTransport struct {
-	next http.RoundTripper
+	next        http.RoundTripper
+	tokens      *tokenCache
+	passthrough bool
+	noAuth      []string
+	header      string
+	noBearer    bool
 }
 
 var _ http.Flusher = authenticatingTransport{} // ensure it's a Flusher
@@ -37,33 +53,114 @@ func (a authenticatingTransport) Flush() {
 }
 
 func (a authenticatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if v, ok := req.Context().Value(ctxKeyEarlyResponse).(*http.Response); ok {
-		return v, nil
+	if target, ok := targetFromContext(req.Context()); ok && matchService(a.noAuth, target.service) {
+		klog.V(6).Infof("[proxy] not injecting token for service=%s id=%s", target.service, requestID(req.Context()))
+		if d := debugInfoFromContext(req.Context()); d != nil {
+			d.setAuth(debugAuthNone)
+		}
+		return a.next.RoundTrip(req)
 	}
 
-	idToken, err := identityToken("https://" + req.Host)
+	// the token is for the host dialed, even if the Host header is the
+	// caller's (-preserve_host)
+	host := req.URL.Host
+	// custom domains are configured by the user, not constructed by runsd
+	if target, ok := targetFromContext(req.Context()); !ok || !target.customDomain {
+		if err := validateAudienceHost(host); err != nil {
+			klog.V(1).Infof("WARN: not fetching ID token for host=%s id=%s: %v", host, requestID(req.Context()), err)
+			return errorResponse(req, http.StatusBadGateway, fmt.Sprintf("runsd resolved an invalid upstream host: %v", err)), nil
+		}
+	}
+	idToken, cached, err := a.tokens.get("https://" + host)
 	if err != nil {
-		klog.V(1).Infof("WARN: failed to get ID token for host=%s: %v", req.Host, err)
-		r := new(http.Response)
-		r.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf("failed to fetch metadata token: %v", err)))
-		r.StatusCode = http.StatusInternalServerError
-		return r, nil
+		klog.V(1).Infof("WARN: failed to get ID token for host=%s id=%s: %v", host, requestID(req.Context()), err)
+		// never forward the request without the token the service expects
+		return errorResponse(req, http.StatusInternalServerError, fmt.Sprintf("runsd failed to fetch an identity token for https://%s: %v", host, err)), nil
+	}
+	trace.SpanFromContext(req.Context()).SetAttributes(attrTokenCached.Bool(cached))
+	injected := true
+	header, value := a.header, "Bearer "+idToken
+	if header == "" {
+		header = "authorization"
 	}
-	if req.Header.Get("authorization") == "" {
-		req.Header.Set("authorization", "Bearer "+idToken)
+	if a.noBearer {
+		value = idToken
 	}
-	ua := req.Header.Get("user-agent")
-	req.Header.Set("user-agent", fmt.Sprintf("runsd version=%s", version))
-	if ua != "" {
-		req.Header.Set("user-agent", req.Header.Get("user-agent")+"; "+ua)
+	if req.Header.Get(header) == "" {
+		req.Header.Set(header, value)
+	} else if a.passthrough {
+		klog.V(6).Infof("[proxy] passing through authorization header for host=%s id=%s", host, requestID(req.Context()))
+		req.Header.Set("x-serverless-authorization", "Bearer "+idToken)
+	} else {
+		injected = false
+	}
+	if e := accessLogFromContext(req.Context()); e != nil {
+		e.TokenInjected = injected
+	}
+	if d := debugInfoFromContext(req.Context()); d != nil {
+		switch {
+		case !injected:
+			d.setAuth(debugAuthNone)
+		case cached:
+			d.setAuth(debugAuthCached)
+		default:
+			d.setAuth(debugAuthFresh)
+		}
 	}
 	return a.next.RoundTrip(req)
 }
 
-type loggingTransport struct {
+// runAppHost matches the hostnames of Cloud Run services (see mkCloudRunHost
+// and mkCloudRunNumberHost), including the revision tag prefix.
+var runAppHost = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.(a|[a-z]+-[a-z]+[0-9]+)\.run\.app$`)
+
+// validateAudienceHost checks that the host is a Cloud Run hostname that an
+// identity token can be fetched for.
+func validateAudienceHost(host string) error {
+	if !runAppHost.MatchString(host) {
+		return fmt.Errorf("host %q is not a *.run.app hostname", host)
+	}
+	return nil
+}
+
+// setUserAgent appends the runsd/VERSION product token to the User-Agent
+// header of the request, so that the services can tell the requests that
+// came through runsd.
+func setUserAgent(req *http.Request) {
+	token := "runsd/" + version
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		token = ua + " " + token
+	}
+	req.Header.Set("User-Agent", token)
+}
+
+// earlyResponseTransport responds with the response stored in the request
+// context by the Director (if any) without dialing out.
+type earlyResponseTransport struct {
 	next http.RoundTripper
 }
 
+var _ http.Flusher = earlyResponseTransport{} // ensure it's a Flusher
+
+func (e earlyResponseTransport) Flush() {
+	if v, ok := e.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (e earlyResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if v, ok := req.Context().Value(ctxKeyEarlyResponse).(*http.Response); ok {
+		klog.V(5).Infof("[proxy] responding early with code=%d for host=%s id=%s", v.StatusCode, req.Host, requestID(req.Context()))
+		return v, nil
+	}
+	return e.next.RoundTrip(req)
+}
+
+type loggingTransport struct {
+	next      http.RoundTripper
+	accessLog *accessLogger // if set, requests are logged as json lines instead
+}
+
 var _ http.Flusher = loggingTransport{} // ensure it's a Flusher
 
 func (l loggingTransport) Flush() {
@@ -73,21 +170,69 @@ func (l loggingTransport) Flush() {
 }
 
 func (l loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if l.accessLog != nil {
+		return l.accessLog.roundTrip(l.next, req)
+	}
 	start := time.Now()
-	klog.V(5).Infof("[proxy] start: %s url=%s", req.Method, req.URL)
+	id := requestID(req.Context())
+	klog.V(5).Infof("[proxy] start: %s url=%s id=%s", req.Method, req.URL, id)
 	for k, v := range req.Header {
-		klog.V(6).Infof("[proxy]       > hdr=%s v=%#v", k, v)
+		klog.V(6).Infof("[proxy]       > hdr=%s v=%#v", k, redactHeader(k, v))
 	}
 	defer func() {
-		klog.V(5).Infof("[proxy]   end: %s url=%s took=%s",
-			req.Method, req.URL, time.Since(start).Truncate(time.Millisecond))
+		klog.V(5).Infof("[proxy]   end: %s url=%s id=%s took=%s",
+			req.Method, req.URL, id, time.Since(start).Truncate(time.Millisecond))
 	}()
 
 	resp, err := l.next.RoundTrip(req)
 	if err != nil {
 		for k, v := range req.Header {
-			klog.V(6).Infof("[proxy]       < hdr=%s v=%#v", k, v)
+			klog.V(6).Infof("[proxy]       < hdr=%s v=%#v", k, redactHeader(k, v))
+		}
+		return resp, err
+	}
+	if klog.V(6).Enabled() {
+		// e.g. the www-authenticate header of a 401 or 403 of Cloud Run
+		klog.V(6).Infof("[proxy] response: code=%d url=%s id=%s", resp.StatusCode, req.URL, id)
+		for k, v := range resp.Header {
+			klog.V(6).Infof("[proxy]       < resp hdr=%s v=%#v", k, redactHeader(k, v))
 		}
 	}
 	return resp, err
 }
+
+// credentialHeaders are the headers whose values are not logged.
+var credentialHeaders = map[string]bool{
+	"Authorization":              true,
+	"X-Serverless-Authorization": true,
+	"Proxy-Authorization":        true,
+	"Cookie":                     true,
+	"Set-Cookie":                 true,
+}
+
+// redactHeader returns the header values to log, with the credentials
+// redacted.
+func redactHeader(key string, values []string) []string {
+	if !credentialHeaders[http.CanonicalHeaderKey(key)] {
+		return values
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = redactCredential(v)
+	}
+	return out
+}
+
+// redactCredential keeps the auth scheme (e.g. "Bearer") and the first 8
+// characters of the credential, so that tokens can be told apart in the logs.
+func redactCredential(v string) string {
+	scheme, cred := "", v
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		scheme, cred = v[:i+1], v[i+1:]
+	}
+	prefix := cred
+	if len(prefix) > 8 {
+		prefix = prefix[:8]
+	}
+	return fmt.Sprintf("%s%s...(redacted, len=%d)", scheme, prefix, len(cred))
+}
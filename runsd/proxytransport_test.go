@@ -0,0 +1,330 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+func TestAuthenticatingTransportHeaders(t *testing.T) {
+	cases := []struct {
+		name                string
+		passthrough         bool
+		header              string
+		noBearer            bool
+		inAuthz             string
+		wantAuthz           string
+		wantServerlessAuthz string
+		wantAuthToken       string
+	}{
+		{name: "empty authz", wantAuthz: "Bearer token"},
+		{name: "empty authz, passthrough", passthrough: true, wantAuthz: "Bearer token"},
+		{name: "existing authz", inAuthz: "Bearer user", wantAuthz: "Bearer user"},
+		{name: "existing authz, passthrough", passthrough: true, inAuthz: "Bearer user",
+			wantAuthz: "Bearer user", wantServerlessAuthz: "Bearer token"},
+		{name: "no bearer prefix", noBearer: true, wantAuthz: "token"},
+		{name: "custom header", header: "X-Auth-Token", wantAuthToken: "Bearer token"},
+		{name: "custom header, no bearer prefix", header: "x-auth-token", noBearer: true, wantAuthToken: "token"},
+		{name: "custom header, existing authz", header: "X-Auth-Token", inAuthz: "Bearer user",
+			wantAuthz: "Bearer user", wantAuthToken: "Bearer token"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenCache(defaultTokenRefreshAhead)
+			tokens.fetch = func(string) (string, error) { return "token", nil }
+
+			var got http.Header
+			tr := authenticatingTransport{
+				tokens:      tokens,
+				passthrough: tt.passthrough,
+				header:      tt.header,
+				noBearer:    tt.noBearer,
+				next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					got = req.Header
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+				}),
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://foo.a.run.app/", nil)
+			if tt.inAuthz != "" {
+				req.Header.Set("authorization", tt.inAuthz)
+			}
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if v := got.Get("authorization"); v != tt.wantAuthz {
+				t.Errorf("authorization=%q, want %q", v, tt.wantAuthz)
+			}
+			if v := got.Get("x-serverless-authorization"); v != tt.wantServerlessAuthz {
+				t.Errorf("x-serverless-authorization=%q, want %q", v, tt.wantServerlessAuthz)
+			}
+			if v := got.Get("x-auth-token"); v != tt.wantAuthToken {
+				t.Errorf("x-auth-token=%q, want %q", v, tt.wantAuthToken)
+			}
+		})
+	}
+}
+
+func TestAuthenticatingTransportTokenTypes(t *testing.T) {
+	jwt := testJWT(time.Now().Add(time.Hour))
+	cases := []struct {
+		name      string
+		tokens    func() *tokenCache
+		wantAuthz string
+	}{
+		{name: "id", tokens: func() *tokenCache {
+			c := newTokenCache(defaultTokenRefreshAhead)
+			c.fetch = func(string) (string, error) { return jwt, nil }
+			return c
+		}, wantAuthz: "Bearer " + jwt},
+		{name: "access", tokens: func() *tokenCache {
+			src := newAccessTokenSource([]string{defaultAccessTokenScopes})
+			src.query = func(string) (string, error) { return `{"access_token":"ya29.token","expires_in":3599}`, nil }
+			c := newTokenCache(defaultTokenRefreshAhead)
+			c.fetch, c.expiry = src.accessToken, src.expiry
+			return c
+		}, wantAuthz: "Bearer ya29.token"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := tt.tokens()
+			var got string
+			tr := authenticatingTransport{
+				tokens: tokens,
+				next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					got = req.Header.Get("authorization")
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+				}),
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://foo.a.run.app/", nil)
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wantAuthz {
+				t.Fatalf("authorization=%q, want %q", got, tt.wantAuthz)
+			}
+			if _, cached, err := tokens.get("https://foo.a.run.app"); err != nil || !cached {
+				t.Fatalf("token was not cached (err=%v)", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticatingTransportNoAuth(t *testing.T) {
+	fetches := 0
+	tokens := newTokenCache(defaultTokenRefreshAhead)
+	tokens.fetch = func(string) (string, error) { fetches++; return "token", nil }
+
+	var got string
+	tr := authenticatingTransport{
+		tokens: tokens,
+		noAuth: []string{"public", "web-*"},
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = req.Header.Get("authorization")
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	for _, tt := range []struct {
+		svc      string
+		wantAuth bool
+	}{
+		{svc: "public"},
+		{svc: "web-frontend"},
+		{svc: "private", wantAuth: true},
+		{svc: "publicity", wantAuth: true},
+	} {
+		fetches, got = 0, ""
+		req, _ := http.NewRequest(http.MethodGet, "https://x.a.run.app/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyTarget, cloudRunTarget{service: tt.svc}))
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if hasAuth := got != ""; hasAuth != tt.wantAuth || (fetches > 0) != tt.wantAuth {
+			t.Errorf("svc=%s: authorization=%q fetches=%d, want auth=%v", tt.svc, got, fetches, tt.wantAuth)
+		}
+	}
+}
+
+func TestAuthenticatingTransportInvalidHost(t *testing.T) {
+	for _, host := range []string{
+		"",
+		"foo",
+		"foo-hash-uc.a.run.app.evil.com",
+		"Foo-hash-uc.a.run.app",
+		"-foo-hash-uc.a.run.app",
+		strings.Repeat("a", 64) + ".a.run.app",
+		"foo.bar.a.run.app",
+	} {
+		fetches := 0
+		tokens := newTokenCache(defaultTokenRefreshAhead)
+		tokens.fetch = func(string) (string, error) { fetches++; return "token", nil }
+		tr := authenticatingTransport{
+			tokens: tokens,
+			next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				t.Errorf("host=%q: unexpected upstream request", host)
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			}),
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://x.a.run.app/", nil)
+		req.URL.Host, req.Host = host, host
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadGateway || fetches != 0 {
+			t.Errorf("host=%q: got code=%d fetches=%d, want code=502 and no fetches", host, resp.StatusCode, fetches)
+		}
+	}
+
+	// tagged revisions and the hosts with project numbers are allowed
+	for _, host := range []string{"green---foo-hash-uc.a.run.app", "foo-123456789012.us-central1.run.app", "green---foo-42.europe-west1.run.app"} {
+		if err := validateAudienceHost(host); err != nil {
+			t.Errorf("unexpected error for host=%s: %v", host, err)
+		}
+	}
+}
+
+func TestAuthenticatingTransportTokenError(t *testing.T) {
+	tokens := newTokenCache(defaultTokenRefreshAhead)
+	tokens.fetch = func(string) (string, error) { return "", errors.New("metadata server unreachable") }
+	tr := authenticatingTransport{
+		tokens: tokens,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			t.Error("unexpected upstream request without a token")
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://foo-hash-uc.a.run.app/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got code=%d, want 500", resp.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Contains(body, []byte("identity token")) || !bytes.Contains(body, []byte("metadata server unreachable")) {
+		t.Fatalf("body %q does not describe the token error", body)
+	}
+}
+
+// captureLogs sends the klog output at -v=10 to the returned buffer until the
+// returned func is called.
+func captureLogs() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	fs.Set("logtostderr", "false")
+	fs.Set("alsologtostderr", "false")
+	fs.Set("stderrthreshold", "FATAL")
+	fs.Set("v", "10")
+	klog.SetOutput(&buf)
+	return &buf, func() {
+		fs.Set("v", "0")
+		fs.Set("logtostderr", "true")
+		klog.SetOutput(os.Stderr)
+	}
+}
+
+func TestLoggingRedactsCredentials(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+
+	const (
+		idToken    = "eyJhbGciOiJSUzI1NiJ9.c2VjcmV0LWlkLXRva2Vu.c2lnbmF0dXJl"
+		callerCred = "caller-secret-credential"
+	)
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.authPassthrough = true
+	rp.upstreamRetries = 0
+	rp.tokenSource = func(string) (string, error) { return idToken, nil }
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused") // also logs the headers again
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+	req.Header.Set("authorization", "Bearer "+callerCred)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	klog.Flush()
+
+	out := buf.String()
+	if !strings.Contains(out, "redacted") {
+		t.Fatalf("headers were not logged redacted:\n%s", out)
+	}
+	for _, secret := range []string{idToken, callerCred} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("log output contains the credential %q:\n%s", secret, out)
+		}
+	}
+}
+
+func TestRedactCredential(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Bearer eyJhbGciOiJSUzI1NiJ9.payload.sig", "Bearer eyJhbGci...(redacted, len=32)"},
+		{"short", "short...(redacted, len=5)"},
+		{"Basic dXNlcjpwYXNz", "Basic dXNlcjpw...(redacted, len=12)"},
+	}
+	for _, tt := range tests {
+		if got := redactCredential(tt.in); got != tt.want {
+			t.Errorf("redactCredential(%q)=%q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoggingResponseHeaders(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+
+	const cookie = "session=response-secret-cookie"
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.tokenSource = func(string) (string, error) { return "token", nil }
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Header: http.Header{
+				"Www-Authenticate": {`Bearer error="invalid_token"`},
+				"Set-Cookie":       {cookie},
+			},
+			Body:    ioutil.NopCloser(strings.NewReader("denied")),
+			Request: req,
+		}, nil
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://foo/", nil))
+	klog.Flush()
+
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "denied" {
+		t.Fatalf("got code=%d body=%q, want the upstream response", rec.Code, rec.Body.String())
+	}
+	out := buf.String()
+	if !strings.Contains(out, "code=403") || !strings.Contains(out, `invalid_token`) {
+		t.Fatalf("response headers were not logged:\n%s", out)
+	}
+	if strings.Contains(out, cookie) {
+		t.Fatalf("log output contains the cookie:\n%s", out)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// rateLimiter is a token bucket per service, allowing rps requests per second
+// on average with bursts of up to a second worth of requests. Services
+// without a rate use the default rate, and are unlimited if it is 0.
+type rateLimiter struct {
+	rates       map[string]float64
+	defaultRate float64
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rates map[string]float64, defaultRate float64) *rateLimiter {
+	return &rateLimiter{
+		rates:       rates,
+		defaultRate: defaultRate,
+		now:         time.Now,
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+// allow reports whether a request can be sent to the service now, and
+// otherwise how long until the next one can.
+func (l *rateLimiter) allow(service string) (bool, time.Duration) {
+	rate, ok := l.rates[service]
+	if !ok {
+		rate = l.defaultRate
+	}
+	if rate <= 0 {
+		return true, 0
+	}
+	burst := math.Max(1, rate)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[service]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[service] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimitTransport responds with 429 to the requests exceeding the rate
+// limit of their resolved service.
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter // disabled if nil
+}
+
+var _ http.Flusher = rateLimitTransport{} // ensure it's a Flusher
+
+func (r rateLimitTransport) Flush() {
+	if v, ok := r.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (r rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, ok := targetFromContext(req.Context())
+	if r.limiter == nil || !ok {
+		return r.next.RoundTrip(req)
+	}
+	if ok, wait := r.limiter.allow(target.service); !ok {
+		klog.V(4).Infof("[ratelimit] rejecting request to service=%s id=%s", target.service, requestID(req.Context()))
+		resp := errorResponse(req, http.StatusTooManyRequests, fmt.Sprintf("runsd rate limit of requests to service %q exceeded, retry later", target.service))
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return resp, nil
+	}
+	return r.next.RoundTrip(req)
+}
+
+// parseRateLimits parses comma-separated SERVICE=RPS pairs.
+func parseRateLimits(s string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, kv := range splitList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in SERVICE=RPS format", kv)
+		}
+		svc := strings.ToLower(parts[0])
+		if _, ok := dns.IsDomainName(svc); !ok || strings.Contains(svc, ".") {
+			return nil, fmt.Errorf("service name %q is not a valid dns label", parts[0])
+		}
+		rps, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || !(rps > 0) || math.IsInf(rps, 0) {
+			return nil, fmt.Errorf("rate %q of service %q is not a positive number", parts[1], parts[0])
+		}
+		out[svc] = rps
+	}
+	return out, nil
+}
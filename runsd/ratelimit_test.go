@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(map[string]float64{"foo": 2, "slow": 0.5}, 0)
+	l.now = func() time.Time { return now }
+
+	steps := []struct {
+		name     string
+		service  string
+		advance  time.Duration
+		want     bool
+		wantWait time.Duration
+	}{
+		{name: "burst 1", service: "foo", want: true},
+		{name: "burst 2", service: "foo", want: true},
+		{name: "exceeded", service: "foo", wantWait: 500 * time.Millisecond},
+		{name: "refilled", service: "foo", advance: 500 * time.Millisecond, want: true},
+		{name: "exceeded again", service: "foo", advance: 250 * time.Millisecond, wantWait: 250 * time.Millisecond},
+		{name: "burst of a single request", service: "slow", want: true},
+		{name: "slow exceeded", service: "slow", wantWait: 2 * time.Second},
+		{name: "no default is unlimited", service: "bar", want: true},
+		{name: "no default is unlimited again", service: "bar", want: true},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		ok, wait := l.allow(s.service)
+		if ok != s.want || wait != s.wantWait {
+			t.Fatalf("%s: allow(%s) = (%v, %s), want (%v, %s)", s.name, s.service, ok, wait, s.want, s.wantWait)
+		}
+	}
+}
+
+func TestRateLimiterDefault(t *testing.T) {
+	l := newRateLimiter(map[string]float64{"foo": 100}, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	// concurrent requests share the bucket of the service
+	var mu sync.Mutex
+	allowed := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, svc := range []string{"foo", "bar", "baz"} {
+			wg.Add(1)
+			go func(svc string) {
+				defer wg.Done()
+				if ok, _ := l.allow(svc); ok {
+					mu.Lock()
+					allowed[svc]++
+					mu.Unlock()
+				}
+			}(svc)
+		}
+	}
+	wg.Wait()
+	if diff := cmp.Diff(map[string]int{"foo": 50, "bar": 1, "baz": 1}, allowed); diff != "" {
+		t.Fatalf("allowed requests (-want,+got):\n%s", diff)
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	l := newRateLimiter(map[string]float64{"foo": 0.1}, 0)
+	upstream := 0
+	tr := rateLimitTransport{
+		limiter: l,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			upstream++
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	send := func(service string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "https://x.a.run.app/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyTarget, cloudRunTarget{service: service}))
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := send("foo"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request: got status=%d, want 200", resp.StatusCode)
+	}
+	resp := send("foo")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request: got status=%d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "10" {
+		t.Errorf("got Retry-After=%q, want 10", got)
+	}
+	if resp := send("bar"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other service: got status=%d, want 200", resp.StatusCode)
+	}
+	if upstream != 2 {
+		t.Fatalf("got %d upstream requests, want 2", upstream)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	got, err := parseRateLimits("Foo=10, bar=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]float64{"foo": 10, "bar": 0.5}, got); diff != "" {
+		t.Fatalf("parseRateLimits() (-want,+got):\n%s", diff)
+	}
+	for _, in := range []string{"foo", "foo=", "=1", "foo=x", "foo=0", "foo=-1", "foo=Inf", "foo=NaN", "a.b=1"} {
+		if _, err := parseRateLimits(in); err == nil {
+			t.Errorf("parseRateLimits(%q) expected error", in)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// regionProbeTTL is how long the probed region of a service is used.
+	regionProbeTTL     = 5 * time.Minute
+	regionProbeTimeout = 2 * time.Second
+)
+
+// regionProber finds the region a service is deployed in by sending HEAD
+// requests to its URL in each of the regions, in order. Cloud Run responds
+// with 404 for services that do not exist (and 401/403 without a token for
+// the ones that do), so the first region without a 404 wins. If no region
+// has the service, the first region is used.
+type regionProber struct {
+	regions []string
+	hostFor func(service, region string) string
+	probe   func(host string) (bool, error) // reports whether the host exists
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]probedRegion
+}
+
+type probedRegion struct {
+	region  string
+	expires time.Time
+}
+
+func newRegionProber(regions []string, hostFor func(service, region string) string) *regionProber {
+	client := &http.Client{
+		Timeout: regionProbeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &regionProber{
+		regions: regions,
+		hostFor: hostFor,
+		probe:   func(host string) (bool, error) { return probeHost(client, host) },
+		now:     time.Now,
+		cache:   make(map[string]probedRegion),
+	}
+}
+
+func probeHost(client *http.Client, host string) (bool, error) {
+	resp, err := client.Head("https://" + host + "/")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+// region returns the region of the service, probing the regions if it is not
+// cached. Concurrent callers may probe the same service more than once.
+func (p *regionProber) region(service string) string {
+	now := p.now()
+	p.mu.Lock()
+	e, ok := p.cache[service]
+	p.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		metricRegionCache.hit()
+		return e.region
+	}
+	metricRegionCache.miss()
+
+	region := p.regions[0]
+	for _, r := range p.regions {
+		host := p.hostFor(service, r)
+		ok, err := p.probe(host)
+		if err != nil {
+			klog.V(3).Infof("[regions] probing service=%s in region=%s (host=%s) failed: %v", service, r, host, err)
+			continue
+		}
+		if ok {
+			region = r
+			break
+		}
+		klog.V(5).Infof("[regions] service=%s not found in region=%s", service, r)
+	}
+	klog.V(4).Infof("[regions] using region=%s for service=%s", region, service)
+
+	p.mu.Lock()
+	p.cache[service] = probedRegion{region: region, expires: now.Add(regionProbeTTL)}
+	p.mu.Unlock()
+	return region
+}
+
+// parseRegionList parses comma-separated region names that have region codes.
+func parseRegionList(s string) ([]string, error) {
+	var out []string
+	for _, r := range splitList(s) {
+		r = strings.ToLower(r)
+		if _, ok := regionCode(r); !ok {
+			return nil, fmt.Errorf("region %q does not have a region code", r)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegionProber(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     map[string]bool // by region
+		errs       map[string]bool
+		want       string
+		wantProbes []string
+	}{
+		{name: "in current region", exists: map[string]bool{"us-central1": true, "europe-west1": true},
+			want: "us-central1", wantProbes: []string{"us-central1"}},
+		{name: "in fallback", exists: map[string]bool{"europe-west1": true},
+			want: "europe-west1", wantProbes: []string{"us-central1", "us-east1", "europe-west1"}},
+		{name: "probe errors are skipped", exists: map[string]bool{"us-central1": true, "us-east1": true}, errs: map[string]bool{"us-central1": true},
+			want: "us-east1", wantProbes: []string{"us-central1", "us-east1"}},
+		{name: "not found anywhere", exists: map[string]bool{},
+			want: "us-central1", wantProbes: []string{"us-central1", "us-east1", "europe-west1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			var probes []string
+			p := newRegionProber([]string{"us-central1", "us-east1", "europe-west1"}, func(svc, r string) string { return svc + "." + r })
+			p.now = func() time.Time { return now }
+			p.probe = func(host string) (bool, error) {
+				r := strings.TrimPrefix(host, "foo.")
+				probes = append(probes, r)
+				if tt.errs[r] {
+					return false, errors.New("timeout")
+				}
+				return tt.exists[r], nil
+			}
+
+			if got := p.region("foo"); got != tt.want {
+				t.Fatalf("got region=%s, want %s", got, tt.want)
+			}
+			if diff := cmp.Diff(tt.wantProbes, probes); diff != "" {
+				t.Fatalf("probed regions (-want,+got):\n%s", diff)
+			}
+
+			probes = nil
+			now = now.Add(regionProbeTTL - time.Second)
+			if got := p.region("foo"); got != tt.want || len(probes) != 0 {
+				t.Fatalf("cached: got region=%s probes=%v, want %s without probes", got, probes, tt.want)
+			}
+			now = now.Add(time.Second)
+			p.region("foo")
+			if len(probes) == 0 {
+				t.Fatal("expected probes after the cache expired")
+			}
+		})
+	}
+}
+
+func TestProbeHost(t *testing.T) {
+	for _, tt := range []struct {
+		code int
+		want bool
+	}{
+		{http.StatusNotFound, false},
+		{http.StatusForbidden, true},
+		{http.StatusOK, true},
+		{http.StatusFound, true},
+	} {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodHead {
+				t.Errorf("got method=%s, want HEAD", r.Method)
+			}
+			if tt.code == http.StatusFound {
+				w.Header().Set("Location", "/elsewhere")
+			}
+			w.WriteHeader(tt.code)
+		}))
+		client := srv.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		got, err := probeHost(client, strings.TrimPrefix(srv.URL, "https://"))
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code=%d: got exists=%v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestResolveCloudRunHostRegionProber(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.serviceRegions = map[string]string{"pinned": "asia-northeast1"}
+	rp.regionProber = newRegionProber([]string{"us-central1", "europe-west1"}, func(svc, r string) string { return svc + "." + r })
+	rp.regionProber.probe = func(host string) (bool, error) { return strings.HasSuffix(host, ".europe-west1"), nil }
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "foo", want: "foo-hash-ew.a.run.app"},
+		{hostname: "pinned", want: "pinned-hash-an.a.run.app"},         // -service_regions takes precedence
+		{hostname: "foo.us-central1", want: "foo-hash-uc.a.run.app"},   // explicit region
+		{hostname: "green.foo", want: "green---foo-hash-uc.a.run.app"}, // only bare names are probed
+	}
+	for _, tt := range tests {
+		got, err := rp.resolveCloudRunHost(tt.hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.host != tt.want {
+			t.Errorf("resolveCloudRunHost(%s) = %s, want %s", tt.hostname, got.host, tt.want)
+		}
+	}
+}
+
+func TestParseRegionList(t *testing.T) {
+	got, err := parseRegionList("us-east1, Europe-West1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"us-east1", "europe-west1"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := parseRegionList("us-mars1"); err == nil {
+		t.Fatal("expected error for unknown region")
+	}
+}
@@ -12,17 +12,32 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package runsd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
 )
 
+const defaultMetadataTimeout = 5 * time.Second
+
+// metadataTimeout is the deadline of each metadata server query (region
+// lookups and token fetches).
+var metadataTimeout = defaultMetadataTimeout
+
 var (
 	cloudRunRegionCodes = map[string]string{
+		"africa-south1":           "bq",
 		"asia-east1":              "de",
 		"asia-east2":              "df",
 		"asia-northeast1":         "an",
@@ -36,52 +51,271 @@ var (
 		"australia-southeast2":    "km",
 		"europe-central2":         "lm",
 		"europe-north1":           "lz",
+		"europe-southwest1":       "no",
 		"europe-west1":            "ew",
 		"europe-west2":            "nw",
 		"europe-west3":            "ey",
 		"europe-west4":            "ez",
 		"europe-west6":            "oa",
+		"europe-west8":            "oc",
+		"europe-west9":            "od",
+		"me-west1":                "zf",
 		"northamerica-northeast1": "nn",
+		"northamerica-northeast2": "pd",
+		"northamerica-south1":     "ve",
 		"southamerica-east1":      "rj",
+		"southamerica-west1":      "tl",
 		"us-central1":             "uc",
 		"us-east1":                "ue",
 		"us-east4":                "uk",
+		"us-east5":                "ul",
+		"us-south1":               "vp",
 		"us-west1":                "uw",
 		"us-west2":                "wl",
 		"us-west3":                "wm",
 		"us-west4":                "wn",
 	}
+
+	// metadataClient is used for all metadata server queries so that
+	// connections are reused across lookups.
+	metadataClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        10,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
 )
 
+var regionCodeFormat = regexp.MustCompile(`^[a-z]{2}$`)
+
+// builtinRegionCodes are the region codes loadRegionCodes starts from.
+var builtinRegionCodes = copyRegionCodes(cloudRunRegionCodes)
+
+// regionCodeSources has where the codes of the regions overridden by
+// loadRegionCodes came from (the file path or "env").
+var regionCodeSources = map[string]string{}
+
+// regionCodesMu guards cloudRunRegionCodes and regionCodeSources, which are
+// replaced when the region codes are loaded again on SIGHUP.
+var regionCodesMu sync.RWMutex
+
+// regionCode returns the code of the region, if it has one.
+func regionCode(region string) (string, bool) {
+	regionCodesMu.RLock()
+	defer regionCodesMu.RUnlock()
+	c, ok := cloudRunRegionCodes[region]
+	return c, ok
+}
+
+func copyRegionCodes(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// loadRegionCodes merges region codes from the file at path (if set) and the
+// env value (if set) over the built-in region codes, and replaces
+// cloudRunRegionCodes with them. Both are in REGION=CODE format, one per line
+// in the file and comma-separated in env. On error, the codes are unchanged.
+func loadRegionCodes(path, env string) error {
+	codes := copyRegionCodes(builtinRegionCodes)
+	sources := make(map[string]string, len(codes))
+	for r := range codes {
+		sources[r] = "built-in"
+	}
+
+	var overrides []regionCodeOverride
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read region codes file: %w", err)
+		}
+		v, err := parseRegionCodes(strings.Split(string(b), "\n"), path)
+		if err != nil {
+			return err
+		}
+		overrides = append(overrides, v...)
+	}
+	if env != "" {
+		v, err := parseRegionCodes(strings.Split(env, ","), "env")
+		if err != nil {
+			return err
+		}
+		overrides = append(overrides, v...)
+	}
+
+	overridden := make(map[string]string, len(overrides))
+	for _, o := range overrides {
+		codes[o.region] = o.code
+		sources[o.region] = o.source
+		overridden[o.region] = o.source
+	}
+	for r, src := range sources {
+		klog.V(6).Infof("region code %s=%s (from %s)", r, codes[r], src)
+	}
+	regionCodesMu.Lock()
+	cloudRunRegionCodes, regionCodeSources = codes, overridden
+	regionCodesMu.Unlock()
+	return nil
+}
+
+// addRegionCodes adds the region codes (keyed by region) over the current
+// ones, e.g. the ones given to NewResolver.
+func addRegionCodes(codes map[string]string, source string) {
+	if len(codes) == 0 {
+		return
+	}
+	regionCodesMu.Lock()
+	defer regionCodesMu.Unlock()
+	merged, sources := copyRegionCodes(cloudRunRegionCodes), copyRegionCodes(regionCodeSources)
+	for r, c := range codes {
+		merged[r], sources[r] = c, source
+	}
+	cloudRunRegionCodes, regionCodeSources = merged, sources
+}
+
+type regionCodeOverride struct {
+	region, code, source string
+}
+
+func parseRegionCodes(lines []string, source string) ([]regionCodeOverride, error) {
+	var out []regionCodeOverride
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: %q is not in REGION=CODE format", source, l)
+		}
+		region, code := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !dnsLabel.MatchString(region) {
+			return nil, fmt.Errorf("%s: %q is not a valid region name", source, region)
+		}
+		if !regionCodeFormat.MatchString(code) {
+			return nil, fmt.Errorf("%s: %q is not a valid region code (must be two lowercase letters)", source, code)
+		}
+		out = append(out, regionCodeOverride{region: region, code: code, source: source})
+	}
+	return out, nil
+}
+
+var (
+	metadataRegionOnce sync.Once
+	metadataRegion     string
+	metadataRegionErr  error
+)
+
+// regionFromMetadata returns the region of the current instance. The region
+// of an instance never changes, so the metadata server is queried only once.
 func regionFromMetadata() (string, error) {
+	metadataRegionOnce.Do(func() {
+		metadataRegion, metadataRegionErr = queryRegionFromMetadata()
+	})
+	return metadataRegion, metadataRegionErr
+}
+
+func queryRegionFromMetadata() (string, error) {
 	v, err := queryMetadata("http://metadata.google.internal/computeMetadata/v1/instance/zone")
 	if err != nil {
 		return "", err // TODO wrap
 	}
-	vs := strings.SplitAfter(v, "/zones/")
-	if len(vs) != 2 {
-		return "", fmt.Errorf("malformed zone value split into %#v", vs)
+	return regionFromZone(v)
+}
+
+// selectRegion returns the region of the instance and where it came from: the
+// override if it is set, or else the region from lookup (if not nil), or the
+// fallback if the lookup fails.
+func selectRegion(override, fallback string, lookup func() (string, error)) (string, string, error) {
+	if override != "" {
+		return override, "-gcp_region", nil
+	}
+	if lookup == nil {
+		return "", "", nil
+	}
+	r, err := lookup()
+	if err == nil {
+		return r, "metadata server", nil
+	}
+	if fallback == "" {
+		return "", "", err
+	}
+	return fallback, "-fallback_region", nil
+}
+
+// regionFromZone parses the region out of a metadata zone value which is in
+// projects/PROJECT_NUMBER/zones/REGION-1 format.
+func regionFromZone(v string) (string, error) {
+	_, region, err := parseZone(v)
+	return region, err
+}
+
+// projectNumberFromMetadata returns the number of the project of the Cloud
+// Run service, for URLFormatNumber.
+func projectNumberFromMetadata() (string, error) {
+	v, err := queryMetadata("http://metadata.google.internal/computeMetadata/v1/instance/zone")
+	if err != nil {
+		return "", err
+	}
+	number, _, err := parseZone(v)
+	return number, err
+}
+
+// parseZone returns the project number and region of a metadata zone value.
+func parseZone(v string) (string, string, error) {
+	parts := strings.Split(v, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "zones" {
+		return "", "", fmt.Errorf("malformed zone value %q (expected projects/NNN/zones/ZONE)", v)
+	}
+	if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return "", "", fmt.Errorf("malformed project number in zone value %q", v)
+	}
+	region := strings.TrimSuffix(parts[3], "-1")
+	if region == "" {
+		return "", "", fmt.Errorf("empty zone in zone value %q", v)
 	}
-	return strings.TrimSuffix(vs[1], "-1"), nil
+	return parts[1], region, nil
 }
 
 func queryMetadata(url string) (string, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err // TODO wrap
 	}
 	req.Header.Set("Metadata-Flavor", "Google")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := metadataClient.Do(req)
 	if err != nil {
+		metricMetadataReachable.Set(0)
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("metadata server did not respond within %s for %s: %w", metadataTimeout, url, ctx.Err())
+		}
 		return "", err // TODO wrap
 	}
+	metricMetadataReachable.Set(1)
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("metadata server responeded with code=%d %s", resp.StatusCode, resp.Status)
+		return "", fmt.Errorf("metadata server responded with code=%d %s for %s", resp.StatusCode, resp.Status, url)
 	}
-	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("metadata server did not send the response within %s for %s: %w", metadataTimeout, url, ctx.Err())
+		}
 		return "", err // TODO wrap
 	}
-	return strings.TrimSpace(string(b)), err
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("metadata server returned an empty response for %s", url)
+	}
+	return v, nil
 }
@@ -0,0 +1,217 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegionFromZone(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "projects/123456/zones/us-central1-1", want: "us-central1"},
+		{in: "projects/123456/zones/asia-northeast1-1", want: "asia-northeast1"},
+		{in: "", wantErr: true},
+		{in: "us-central1-1", wantErr: true},
+		{in: "projects/123456/zones/", wantErr: true},
+		{in: "projects/123456/zones/-1", wantErr: true},
+		{in: "projects/abc/zones/us-central1-1", wantErr: true},
+		{in: "projects/123456/regions/us-central1", wantErr: true},
+		{in: "projects/123456/zones/us-central1-1/extra", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := regionFromZone(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("regionFromZone(%q) error = %v, wantErr = %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("regionFromZone(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectRegion(t *testing.T) {
+	metadata := func() (string, error) { return "europe-west1", nil }
+	unreachable := func() (string, error) { return "", errors.New("metadata server did not respond") }
+	tests := []struct {
+		name       string
+		override   string
+		fallback   string
+		lookup     func() (string, error)
+		want       string
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "metadata", lookup: metadata, want: "europe-west1", wantSource: "metadata server"},
+		{name: "override beats metadata", override: "us-central1", fallback: "asia-east1", lookup: metadata, want: "us-central1", wantSource: "-gcp_region"},
+		{name: "override without lookup", override: "us-central1", want: "us-central1", wantSource: "-gcp_region"},
+		{name: "metadata beats fallback", fallback: "asia-east1", lookup: metadata, want: "europe-west1", wantSource: "metadata server"},
+		{name: "fallback", fallback: "asia-east1", lookup: unreachable, want: "asia-east1", wantSource: "-fallback_region"},
+		{name: "no fallback", lookup: unreachable, wantErr: true},
+		{name: "off cloud run", fallback: "asia-east1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := tt.lookup
+			if tt.override != "" && lookup != nil {
+				lookup = func() (string, error) {
+					t.Fatal("region looked up despite the override")
+					return "", nil
+				}
+			}
+			got, source, err := selectRegion(tt.override, tt.fallback, lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err=%v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want || source != tt.wantSource {
+				t.Fatalf("got region=%q source=%q, want %q and %q", got, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestRegionCodes(t *testing.T) {
+	want := []string{
+		"africa-south1", "asia-east1", "asia-east2", "asia-northeast1",
+		"asia-northeast2", "asia-northeast3", "asia-south1", "asia-south2",
+		"asia-southeast1", "asia-southeast2", "australia-southeast1",
+		"australia-southeast2", "europe-central2", "europe-north1",
+		"europe-southwest1", "europe-west1", "europe-west2", "europe-west3",
+		"europe-west4", "europe-west6", "europe-west8", "europe-west9",
+		"me-west1", "northamerica-northeast1", "northamerica-northeast2",
+		"northamerica-south1", "southamerica-east1", "southamerica-west1",
+		"us-central1", "us-east1", "us-east4", "us-east5", "us-south1",
+		"us-west1", "us-west2", "us-west3", "us-west4",
+	}
+	for _, region := range want {
+		if _, ok := cloudRunRegionCodes[region]; !ok {
+			t.Errorf("no region code for %s", region)
+		}
+	}
+	regions := make(map[string]string)
+	for region, code := range cloudRunRegionCodes {
+		if !regionCodeFormat.MatchString(code) {
+			t.Errorf("malformed region code %q for %s", code, region)
+		}
+		if other, ok := regions[code]; ok {
+			t.Errorf("region code %q is used by both %s and %s", code, region, other)
+		}
+		regions[code] = region
+	}
+}
+
+func TestLoadRegionCodes(t *testing.T) {
+	orig := make(map[string]string)
+	for k, v := range cloudRunRegionCodes {
+		orig[k] = v
+	}
+	defer func() { cloudRunRegionCodes = orig }()
+
+	f, err := ioutil.TempFile("", "region-codes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "# new regions")
+	fmt.Fprintln(f, "me-central1=xa")
+	fmt.Fprintln(f, "")
+	fmt.Fprintln(f, "us-central1=xx")
+	f.Close()
+
+	if err := loadRegionCodes(f.Name(), "us-central1=uc, me-west1=xm"); err != nil {
+		t.Fatal(err)
+	}
+	for region, want := range map[string]string{
+		"me-central1":  "xa",
+		"me-west1":     "xm",
+		"us-central1":  "uc", // env takes precedence over file
+		"europe-west1": "ew",
+	} {
+		if got := cloudRunRegionCodes[region]; got != want {
+			t.Errorf("region code for %s = %q, want %q", region, got, want)
+		}
+	}
+
+	for _, env := range []string{"us-central1", "us-central1=u", "us-central1=UC", "=uc"} {
+		if err := loadRegionCodes("", env); err == nil {
+			t.Errorf("loadRegionCodes(env=%q) expected error", env)
+		}
+	}
+	if err := loadRegionCodes("/nonexistent/file", ""); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestQueryMetadataTimeout(t *testing.T) {
+	defer func(v time.Duration) { metadataTimeout = v }(metadataTimeout)
+	metadataTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, done <-chan struct{})
+		wantErr string
+	}{
+		{
+			name:    "no response",
+			handler: func(w http.ResponseWriter, done <-chan struct{}) { <-done },
+			wantErr: "did not respond within 50ms",
+		},
+		{
+			name: "hung body",
+			handler: func(w http.ResponseWriter, done <-chan struct{}) {
+				w.Write([]byte("projects/"))
+				w.(http.Flusher).Flush()
+				<-done
+			},
+			wantErr: "did not send the response within 50ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(w, done)
+			}))
+			defer srv.Close()
+			defer close(done)
+
+			start := time.Now()
+			_, err := queryMetadata(srv.URL)
+			if err == nil {
+				t.Fatal("expected timeout error")
+			}
+			if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got err=%v, want a deadline error containing %q", err, tt.wantErr)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Fatalf("query took %s", took)
+			}
+		})
+	}
+}
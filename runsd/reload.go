@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// resolverConfig is the part of the reverseProxy configuration that is
+// reloaded on SIGHUP. Its maps and slices are replaced, never modified.
+type resolverConfig struct {
+	projectHashes  map[string]string // other projects, keyed by project name
+	serviceRegions map[string]string // regions of services not in the current region
+	customDomains  map[string]string // custom domains mapped to services, keyed by service name
+	allowServices  []string          // if not empty, the only services requests can be sent to
+}
+
+// config returns the current resolverConfig of the proxy.
+func (rp *reverseProxy) config() resolverConfig {
+	rp.configMu.RLock()
+	defer rp.configMu.RUnlock()
+	return rp.resolverConfig
+}
+
+// setConfig replaces the resolverConfig of the proxy. Requests that already
+// resolved their host are not affected.
+func (rp *reverseProxy) setConfig(c resolverConfig) {
+	rp.configMu.Lock()
+	rp.resolverConfig = c
+	rp.configMu.Unlock()
+}
+
+// reloadableFlags are the flags of the resolverConfig, which can also be set
+// in the -config_file.
+var reloadableFlags = []string{"allow_services", "custom_domains", "project_hashes", "service_regions"}
+
+func isReloadableFlag(name string) bool {
+	for _, f := range reloadableFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolverConfigValues returns the values of the reloadableFlags in fs,
+// replaced by the ones in the config file at path, if set.
+func resolverConfigValues(fs *flag.FlagSet, path string) (map[string]string, error) {
+	out := make(map[string]string, len(reloadableFlags))
+	for _, name := range reloadableFlags {
+		if f := fs.Lookup(name); f != nil {
+			out[name] = f.Value.String()
+		}
+	}
+	if path == "" {
+		return out, nil
+	}
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range file {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// newResolverConfig parses the values of the reloadableFlags, keyed by flag
+// name.
+func newResolverConfig(values map[string]string) (resolverConfig, error) {
+	var c resolverConfig
+	var err error
+	if c.projectHashes, err = parseProjectHashes(values["project_hashes"]); err != nil {
+		return resolverConfig{}, fmt.Errorf("invalid -project_hashes value: %w", err)
+	}
+	if c.serviceRegions, err = parseServiceRegions(values["service_regions"]); err != nil {
+		return resolverConfig{}, fmt.Errorf("invalid -service_regions value: %w", err)
+	}
+	if c.customDomains, err = parseCustomDomains(values["custom_domains"]); err != nil {
+		return resolverConfig{}, fmt.Errorf("invalid -custom_domains value: %w", err)
+	}
+	// service names are matched in lowercase after hostname canonicalization
+	c.allowServices = splitList(strings.ToLower(values["allow_services"]))
+	if err := validateServicePatterns(c.allowServices); err != nil {
+		return resolverConfig{}, fmt.Errorf("invalid -allow_services value: %w", err)
+	}
+	return c, nil
+}
+
+// readConfigFile reads the FLAG=VALUE lines of the -config_file, where FLAG
+// is one of the reloadableFlags. Empty lines and lines starting with # are
+// ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	out := make(map[string]string)
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: %q is not in FLAG=VALUE format", path, l)
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "-")
+		if !isReloadableFlag(name) {
+			return nil, fmt.Errorf("%s: -%s cannot be set in the config file (only -%s)", path, name, strings.Join(reloadableFlags, ", -"))
+		}
+		out[name] = strings.TrimSpace(parts[1])
+	}
+	return out, nil
+}
+
+// reloadConfig loads the region codes, the resolve overrides and the config
+// file of the proxy again on SIGHUP. The ones that fail to load are kept as
+// they were.
+func reloadConfig(rp *reverseProxy, fs *flag.FlagSet, regionCodesPath, regionCodesEnv, configPath string) {
+	klog.V(1).Info("reloading the configuration")
+	if err := loadRegionCodes(regionCodesPath, regionCodesEnv); err != nil {
+		klog.Warningf("WARN: keeping the previous region codes: %v", err)
+	}
+	if rp.overrides != nil {
+		if err := rp.overrides.reload(); err != nil {
+			klog.Warningf("WARN: keeping the previous resolve overrides: %v", err)
+		}
+	}
+	values, err := resolverConfigValues(fs, configPath)
+	if err != nil {
+		klog.Warningf("WARN: keeping the previous configuration: %v", err)
+		return
+	}
+	c, err := newResolverConfig(values)
+	if err != nil {
+		klog.Warningf("WARN: keeping the previous configuration: %v", err)
+		return
+	}
+	rp.setConfig(c)
+}
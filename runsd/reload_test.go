@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolverConfigValues(t *testing.T) {
+	fs := flag.NewFlagSet("runsd", flag.ContinueOnError)
+	fs.String("allow_services", "", "")
+	fs.String("service_regions", "", "")
+	fs.String("custom_domains", "", "")
+	fs.String("project_hashes", "", "")
+	fs.String("no_auth", "", "")
+	if err := fs.Parse([]string{"-allow_services=foo", "-service_regions=foo=us-east1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolverConfigValues(fs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"allow_services": "foo", "service_regions": "foo=us-east1", "custom_domains": "", "project_hashes": ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("without config file (-want,+got):\n%s", diff)
+	}
+
+	path := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(path, []byte("# reloaded on SIGHUP\nallow_services = foo,bar\n-custom_domains=bar=bar.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = resolverConfigValues(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"allow_services": "foo,bar", "service_regions": "foo=us-east1", "custom_domains": "bar=bar.example.com", "project_hashes": ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("with config file (-want,+got):\n%s", diff)
+	}
+
+	for _, in := range []string{"no_auth=foo", "allow_services"} {
+		if err := ioutil.WriteFile(path, []byte(in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resolverConfigValues(fs, path); err == nil {
+			t.Errorf("config file %q: expected error", in)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config")
+	write := func(s string) {
+		t.Helper()
+		if err := ioutil.WriteFile(configPath, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := flag.NewFlagSet("runsd", flag.ContinueOnError)
+	for _, name := range reloadableFlags {
+		fs.String(name, "", "")
+	}
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	resolve := func(hostname string) (string, error) {
+		t.Helper()
+		got, err := rp.resolveCloudRunHost(hostname)
+		return got.host, err
+	}
+	if got, _ := resolve("payments"); got != "payments-hash-uc.a.run.app" {
+		t.Fatalf("before reload: got host=%s", got)
+	}
+
+	write("service_regions=payments=europe-west1\nallow_services=payments\n")
+	reloadConfig(rp, fs, "", "", configPath)
+	if got, err := resolve("payments"); err != nil || got != "payments-hash-ew.a.run.app" {
+		t.Fatalf("after reload: got host=%s err=%v, want the new service region", got, err)
+	}
+	if _, err := resolve("billing"); err == nil {
+		t.Fatal("after reload: expected billing to not be allowed")
+	}
+
+	// an invalid config file leaves the previous configuration in place
+	write("service_regions=payments=mars-north1\n")
+	reloadConfig(rp, fs, "", "", configPath)
+	if got, err := resolve("payments"); err != nil || got != "payments-hash-ew.a.run.app" {
+		t.Fatalf("after failed reload: got host=%s err=%v, want the previous configuration", got, err)
+	}
+}
+
+func TestLoadRegionCodesReplacesOverrides(t *testing.T) {
+	defer func(codes, srcs map[string]string) {
+		cloudRunRegionCodes, regionCodeSources = codes, srcs
+	}(cloudRunRegionCodes, regionCodeSources)
+
+	if err := loadRegionCodes("", "mars-north1=mn,us-central1=xx"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := regionCode("mars-north1"); got != "mn" {
+		t.Fatalf("got code=%q for mars-north1, want mn", got)
+	}
+	// loading again without the overrides goes back to the built-in codes
+	if err := loadRegionCodes("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := regionCode("mars-north1"); ok {
+		t.Fatal("mars-north1 still has a code after it was removed")
+	}
+	if got, _ := regionCode("us-central1"); got != "uc" {
+		t.Fatalf("got code=%q for us-central1, want the built-in uc", got)
+	}
+	if got := regionCodeOverrides(); got != nil {
+		t.Fatalf("got overrides %v, want none", got)
+	}
+}
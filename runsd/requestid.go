@@ -0,0 +1,62 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const headerRequestID = "X-Request-Id"
+
+// ctxKeyRequestID holds the correlation id of the proxied request.
+const ctxKeyRequestID ctxKey = `request-id`
+
+var (
+	// requestIDPrefix is random per process so the ids generated by different
+	// instances do not collide.
+	requestIDPrefix = newRequestIDPrefix()
+	requestIDSeq    uint64 // accessed atomically
+)
+
+func newRequestIDPrefix() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// newRequestID returns a UUID (in version 4 format) made of the process prefix
+// and a sequence number, which is cheaper than reading random bytes for each
+// request.
+func newRequestID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], requestIDPrefix)
+	binary.BigEndian.PutUint64(b[8:], atomic.AddUint64(&requestIDSeq, 1))
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// requestID returns the correlation id of the proxied request, if any.
+func requestID(ctx context.Context) string {
+	v, _ := ctx.Value(ctxKeyRequestID).(string)
+	return v
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewRequestID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newRequestID()
+		if !uuidPattern.MatchString(id) {
+			t.Fatalf("id %q is not a uuid", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestReverseProxyRequestID(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	cases := []struct {
+		name     string
+		host     string
+		inID     string
+		upstream func(*http.Request) (*http.Response, error)
+	}{
+		{name: "generated", host: "hello"},
+		{name: "incoming", host: "hello", inID: "abc-123"},
+		{name: "early response", host: "hello.us-mars1", inID: "abc-123"},
+		{name: "proxy error", host: "hello", inID: "abc-123", upstream: func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var outID string
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.upstreamRetries = 0
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				outID = req.Header.Get("x-request-id")
+				if tt.upstream != nil {
+					return tt.upstream(req)
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			if tt.inID != "" {
+				req.Header.Set("x-request-id", tt.inID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("x-request-id")
+			if tt.inID != "" && got != tt.inID {
+				t.Errorf("got response id=%q, expected %q", got, tt.inID)
+			}
+			if tt.inID == "" && !uuidPattern.MatchString(got) {
+				t.Errorf("got response id=%q, expected a generated uuid", got)
+			}
+			if outID != "" && outID != got {
+				t.Errorf("got outbound id=%q, expected %q", outID, got)
+			}
+		})
+	}
+}
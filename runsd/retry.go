@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultUpstreamRetries       = 2
+	defaultRetryMaxBackoff       = time.Second
+	retryInitialBackoff          = 100 * time.Millisecond
+	maxRetryDrainBytes     int64 = 4 << 10
+)
+
+// retryingTransport retries idempotent requests on connection errors and on
+// 502/503 responses (e.g. while a Cloud Run service is scaling from zero).
+// Requests with a body are retried only if the body can be rewound.
+type retryingTransport struct {
+	next       http.RoundTripper
+	retries    int
+	maxBackoff time.Duration
+}
+
+var _ http.Flusher = retryingTransport{} // ensure it's a Flusher
+
+func (r retryingTransport) Flush() {
+	if v, ok := r.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (r retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if r.retries <= 0 || !isRetryable(req) {
+		return r.next.RoundTrip(req)
+	}
+
+	backoff := retryInitialBackoff
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		attemptReq := req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody && attempt > 0 {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := r.next.RoundTrip(attemptReq)
+		if attempt >= r.retries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+		if err != nil {
+			klog.V(4).Infof("[retry] attempt=%d url=%s id=%s failed: %v, retrying in %s", attempt+1, req.URL, requestID(req.Context()), err, backoff)
+		} else {
+			klog.V(4).Infof("[retry] attempt=%d url=%s id=%s got code=%d, retrying in %s", attempt+1, req.URL, requestID(req.Context()), resp.StatusCode, backoff)
+			io.CopyN(ioutil.Discard, resp.Body, maxRetryDrainBytes)
+			resp.Body.Close()
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// isRetryable reports whether the request can be safely sent again.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
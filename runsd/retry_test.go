@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryingTransport(t *testing.T) {
+	cases := []struct {
+		name         string
+		method       string
+		body         string
+		failures     int
+		connErr      bool
+		wantAttempts int
+		wantCode     int
+	}{
+		{name: "get succeeds after 503s", method: http.MethodGet, failures: 2, wantAttempts: 3, wantCode: http.StatusOK},
+		{name: "get retries connection errors", method: http.MethodGet, failures: 1, connErr: true, wantAttempts: 2, wantCode: http.StatusOK},
+		{name: "get gives up", method: http.MethodGet, failures: 5, wantAttempts: 3, wantCode: http.StatusServiceUnavailable},
+		{name: "post not retried", method: http.MethodPost, body: "x", failures: 1, wantAttempts: 1, wantCode: http.StatusServiceUnavailable},
+		{name: "put not retried", method: http.MethodPut, failures: 1, wantAttempts: 1, wantCode: http.StatusServiceUnavailable},
+		{name: "get with rewindable body", method: http.MethodGet, body: "hello", failures: 1, wantAttempts: 2, wantCode: http.StatusOK},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			tr := retryingTransport{
+				retries:    2,
+				maxBackoff: time.Millisecond,
+				next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					attempts++
+					if req.Body != nil {
+						b, _ := ioutil.ReadAll(req.Body)
+						if string(b) != tt.body {
+							t.Errorf("attempt %d got body=%q, want %q", attempts, b, tt.body)
+						}
+					}
+					if attempts <= tt.failures {
+						if tt.connErr {
+							return nil, errors.New("connection reset by peer")
+						}
+						return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+				}),
+			}
+			var body *strings.Reader
+			req, _ := http.NewRequest(tt.method, "https://foo.a.run.app/", nil)
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+				req, _ = http.NewRequest(tt.method, "https://foo.a.run.app/", body)
+			}
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("got code=%d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("got attempts=%d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryingTransportUnrewindableBody(t *testing.T) {
+	attempts := 0
+	tr := retryingTransport{
+		retries:    2,
+		maxBackoff: time.Millisecond,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody}, nil
+		}),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://foo.a.run.app/", ioutil.NopCloser(strings.NewReader("stream")))
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("request with unrewindable body was attempted %d times", attempts)
+	}
+}
@@ -0,0 +1,1124 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http/httpguts"
+	"k8s.io/klog/v2"
+)
+
+const (
+	resolvConf            = "/etc/resolv.conf"
+	defaultInternalDomain = "run.internal."
+	defaultNdots          = 4
+	defaultDnsPort        = "53"
+	defaultHTTPProxyPort  = "80"
+)
+
+var (
+	flInternalDomain string
+	flNdots          int
+	flResolvConf     string
+	flNameserver     string
+	flRegion         string
+	flFallbackRegion string
+	flProjectHash    string
+	flProjectNumber  string
+	flURLFormat      string
+	flHTTPProxyPort  string
+	flListenAddr     string
+	flDNSPort        string
+	flDNSAddr        string
+	flUser           string
+	flMetricsAddr    string
+	flHealthAddr     string
+	flPprofAddr      string
+
+	flAuthPassthrough bool
+	flAuthHeader      string
+	flAuthBearer      bool
+	flNoAuth          string
+	flAllowServices   string
+	flImpersonateSA   string
+	flLocal           bool
+	flTokenRetries    int
+	flTokenCacheDir   string
+	flTokenJitter     float64
+	flTokenType       string
+	flTokenScopes     string
+	flMetadataTimeout time.Duration
+	flProjectHashes   string
+	flServiceRegions  string
+	flRegionFallbacks string
+	flCustomDomains   string
+	flPathRewrites    string
+	flSplits          string
+	flStripHeaders    string
+	flTrustXFF        bool
+	flNoUserAgent     bool
+	flPreserveHost    bool
+	flAllowSource     string
+	flRegionCodes     string
+	flOverrides       string
+	flConfigFile      string
+
+	flUpstreamRetries int
+	flRetryMaxBackoff time.Duration
+	flBreakerFailures int
+	flBreakerCooldown time.Duration
+
+	flRateLimits       string
+	flRateLimitDefault float64
+
+	flUpstreamMaxIdleConns        int
+	flUpstreamMaxIdleConnsPerHost int
+	flUpstreamMaxConnsPerHost     int
+	flUpstreamIdleConnTimeout     time.Duration
+	flUpstreamDialTimeout         time.Duration
+	flUpstreamKeepAlive           time.Duration
+	flForceHTTP1                  string
+	flClientCert                  string
+	flClientKey                   string
+
+	flLogFormat    string
+	flResolve      string
+	flCheckPath    string
+	flPrintConfig  bool
+	flClean404     bool
+	flDebugHeaders bool
+
+	flUpgradeIdleTimeout time.Duration
+	flUpstreamTimeout    time.Duration
+	flServiceTimeouts    string
+	flShutdownGrace      time.Duration
+	flMaxBodyBytes       int64
+	flMaxResponseBuffer  int64
+	flFlushInterval      time.Duration
+	flCompress           bool
+	flCompressMinBytes   int64
+	flCompressRequest    string
+
+	flH2MaxConcurrentStreams uint
+	flH2IdleTimeout          time.Duration
+	flH2MaxReadFrameSize     uint
+
+	flEnableHTTP3   bool
+	flHTTP3Addr     string
+	flHTTP3CertFile string
+	flHTTP3KeyFile  string
+
+	flSkipDNSServer       bool
+	flNoDNSForward        bool
+	flDNSTTL              time.Duration
+	flDNSNegativeTTL      time.Duration
+	flDNSLoopbackPTR      bool
+	flSkipHTTPProxyServer bool
+
+	ipv4Loopback = net.IPv4(127, 0, 0, 1)
+
+	ipv6OK bool
+)
+
+var (
+	version string = "unknown" // populated by goreleaser (see .goreleaser.yml)
+	commit  string = "unknown" // populated by goreleaser (see .goreleaser.yml)
+)
+
+// Main runs the runsd command with the command-line flags and arguments of
+// the process, proxying the internal names for the subprocess it starts.
+func Main() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	klog.InitFlags(nil)
+	defer klog.Flush()
+	flag.StringVar(&flResolvConf, "resolv_conf_file", resolvConf, "[debug-only] path to resolv.conf(5) file to read/write")
+	flag.StringVar(&flInternalDomain, "domain", "", "internal zone (or use RUNSD_INTERNAL_DOMAIN), or comma-separated zones that are all answered, the first one being added to the resolv.conf search domains (e.g. to migrate from another zone) (default: "+defaultInternalDomain+")")
+	flag.IntVar(&flNdots, "ndots", defaultNdots, "ndots setting for resolv conf (e.g. for -domain=a.b. this should be 4)")
+	flag.StringVar(&flNameserver, "nameserver", "", "override used nameserver (default: from -resolv_conf_file)")
+	flag.StringVar(&flRegion, "gcp_region", "", "[debug-only] override GCP region (do not infer from metadata svc)")
+	flag.StringVar(&flFallbackRegion, "fallback_region", "", "GCP region to use if it cannot be inferred from the metadata svc, instead of exiting")
+	flag.BoolVar(&flSkipDNSServer, "skip_dns_hijack", false, "[debug-only] do not start a DNS server for service discovery")
+	flag.BoolVar(&flNoDNSForward, "no_dns_forward", false, "do not forward dns queries outside the internal domain to the nameserver, answer with REFUSED")
+	flag.DurationVar(&flDNSTTL, "dns_ttl", defaultDNSTTL, "ttl of the dns answers for internal names, mostly affects how often clients query again since they always resolve to loopback")
+	flag.DurationVar(&flDNSNegativeTTL, "dns_negative_ttl", defaultDNSNegativeTTL, "how long to cache NXDOMAIN and NODATA answers of the nameserver (or less if their SOA says so), 0 to not cache them")
+	flag.BoolVar(&flDNSLoopbackPTR, "dns_loopback_ptr", false, "answer the reverse (PTR) queries of the loopback addresses with the internal name resolved last, instead of forwarding them to the nameserver (best effort, since all internal names resolve to the same addresses)")
+	flag.BoolVar(&flSkipHTTPProxyServer, "skip_http_proxy", false, "[debug-only] do not start a HTTP proxy server")
+	flag.StringVar(&flURLFormat, "url_format", URLFormatHash, "format of the URLs of the services: 'hash' for SERVICE-PROJECTHASH-REGIONCODE.a.run.app, or 'number' for SERVICE-PROJECTNUMBER.REGION.run.app (then -gcp_project_number and the values of -project_hashes are project numbers)")
+	flag.StringVar(&flProjectNumber, "gcp_project_number", "", "with -url_format=number, the gcp project number in the URLs of the services, e.g. 123456789012 if the URLs are like foo-123456789012.us-central1.run.app (default: from the metadata server)")
+	flag.StringVar(&flProjectHash, "gcp_project_hash", "", "gcp cloud run project hash, e.g. dpyb4duzqq if the URLs are like foo-dpyb4duzqq-uc.a.run.app (or use RUNSD_PROJECT_HASH or CLOUD_RUN_PROJECT_HASH)")
+	flag.StringVar(&flProjectHashes, "project_hashes", "", "comma-separated NAME=HASH pairs of other projects to discover services in (e.g. shared=dpyb4duzqq for SERVICE.shared)")
+	flag.StringVar(&flServiceRegions, "service_regions", "", "comma-separated SERVICE=REGION pairs of services to reach in REGION instead of the current region when the hostname has no region (e.g. payments=us-central1)")
+	flag.StringVar(&flRegionFallbacks, "region_fallbacks", "", "comma-separated regions to look for services in when the hostname is just SERVICE and it is not in -service_regions: the current region and then these are probed in order with HEAD requests, and the first one that does not respond 404 is used for 5m (e.g. us-east1,europe-west1)")
+	flag.StringVar(&flCustomDomains, "custom_domains", "", "comma-separated SERVICE=DOMAIN pairs of services to reach on their custom domain mapping instead of *.a.run.app when the hostname is just SERVICE (e.g. payments=payments.example.com)")
+	flag.StringVar(&flRegionCodes, "region_codes", "", "path to a file with REGION=CODE lines to add or override region codes (or use RUNSD_REGION_CODES=REGION=CODE,...)")
+	flag.StringVar(&flOverrides, "resolve_overrides", "", "path to a hosts(5)-style file with TARGET NAME [NAME...] lines sending the requests to the internal NAMEs (e.g. hello or hello.us-central1) to the TARGET host (e.g. a canary or staging URL) instead, reloaded on SIGHUP")
+	flag.StringVar(&flConfigFile, "config_file", "", "path to a file with FLAG=VALUE lines setting -"+strings.Join(reloadableFlags, ", -")+" (over the command line), reloaded on SIGHUP with -region_codes and -resolve_overrides")
+	flag.StringVar(&flHTTPProxyPort, "http_proxy_port", defaultHTTPProxyPort, "[debug-only] reverse proxy port to listen on for loopback interface(s)")
+	flag.StringVar(&flListenAddr, "listen_addr", "", "address for the reverse proxy to listen on, the host must be empty (both loopback interfaces), localhost, 127.0.0.1 or ::1 since internal names resolve to loopback (e.g. 127.0.0.1:8080, default: :<http_proxy_port>)")
+	flag.StringVar(&flDNSPort, "dns_port", defaultDnsPort, "[debug-only] custom port to start dns server on loopback interface(s), note resolv.conf doesn't support custom ports")
+	flag.StringVar(&flDNSAddr, "dns_addr", "", "address for the dns server to listen on (udp and tcp), the host must be empty (both loopback interfaces), localhost or a loopback address such as 127.0.0.53 or ::1, note resolv.conf doesn't support ports other than 53 (e.g. 127.0.0.53:53, default: :<dns_port>)")
+	flag.StringVar(&flUser, "user", "", "uid or user name to run the app subprocess as")
+	flag.IntVar(&flUpstreamRetries, "upstream_retries", defaultUpstreamRetries, "number of times to retry idempotent requests on connection errors or 502/503 responses")
+	flag.DurationVar(&flRetryMaxBackoff, "upstream_retry_max_backoff", defaultRetryMaxBackoff, "maximum backoff between upstream request retries")
+	flag.IntVar(&flBreakerFailures, "circuit_breaker_failures", 0, "after this many consecutive connection errors or 502/503/504 responses from a service, respond to its requests with 503 for -circuit_breaker_cooldown before trying it again (default: disabled)")
+	flag.DurationVar(&flBreakerCooldown, "circuit_breaker_cooldown", defaultBreakerCooldown, "how long to fail requests to a service fast once its circuit breaker opens")
+	flag.StringVar(&flRateLimits, "rate_limit", "", "comma-separated SERVICE=RPS pairs limiting the requests to SERVICE to RPS per second on average (with bursts of up to a second worth), others get 429 (e.g. payments=50)")
+	flag.Float64Var(&flRateLimitDefault, "rate_limit_default", 0, "requests per second limit of the services not in -rate_limit (default: unlimited)")
+	flag.IntVar(&flUpstreamMaxIdleConns, "upstream_max_idle_conns", defaultUpstreamMaxIdleConns, "maximum number of idle connections to the upstream services in total, 0 for no limit")
+	flag.IntVar(&flUpstreamMaxIdleConnsPerHost, "upstream_max_idle_conns_per_host", defaultUpstreamMaxIdleConnsPerHost, "maximum number of idle connections kept to each upstream service")
+	flag.IntVar(&flUpstreamMaxConnsPerHost, "upstream_max_conns_per_host", 0, "maximum number of connections to each upstream service, requests wait for a connection when reached (default: no limit)")
+	flag.DurationVar(&flUpstreamIdleConnTimeout, "upstream_idle_conn_timeout", defaultUpstreamIdleConnTimeout, "close idle connections to the upstream services after this long, 0 to keep them open")
+	flag.DurationVar(&flUpstreamDialTimeout, "upstream_dial_timeout", defaultUpstreamDialTimeout, "timeout of connecting to the upstream services, requests get 504 when exceeded, 0 for no timeout")
+	flag.DurationVar(&flUpstreamKeepAlive, "upstream_keep_alive", defaultUpstreamKeepAlive, "interval of tcp keep-alive probes on the upstream connections, negative to disable them")
+	flag.StringVar(&flForceHTTP1, "force_http1", "", "comma-separated upstream hosts (e.g. custom domains) to connect to over HTTP/1.1 only (others negotiate HTTP/2)")
+	flag.StringVar(&flClientCert, "client_cert", "", "path to a PEM client certificate to present to the upstream servers that request one (e.g. custom domains requiring mTLS), in addition to the identity token, requires -client_key")
+	flag.StringVar(&flClientKey, "client_key", "", "path to the PEM private key of -client_cert")
+	flag.BoolVar(&flAuthPassthrough, "auth_passthrough", false, "if the request has an Authorization header, keep it and send the identity token in X-Serverless-Authorization header")
+	flag.StringVar(&flAuthHeader, "auth_header", "Authorization", "header to send the identity token in, for backends that expect it elsewhere (e.g. X-Auth-Token)")
+	flag.BoolVar(&flAuthBearer, "auth_bearer_prefix", true, "prefix the token in -auth_header with \"Bearer \"")
+	flag.BoolVar(&flLocal, "local", false, "run off Google Cloud (e.g. on a workstation) with the identity tokens of the application default credentials, requires -gcp_region and -gcp_project_hash")
+	flag.IntVar(&flTokenRetries, "token_fetch_retries", defaultTokenFetchRetries, "number of times to retry failed identity token fetches (with backoff, for up to "+tokenFetchDeadline.String()+")")
+	flag.StringVar(&flTokenCacheDir, "token_cache_dir", "", "directory to also cache the identity tokens in (as 0600 files), so that they are reused after a restart until they are about to expire (default: in memory only)")
+	flag.Float64Var(&flTokenJitter, "token_refresh_jitter", defaultTokenRefreshJitter, "fraction (0 to 1) of the "+defaultTokenRefreshAhead.String()+" before expiry that background token refreshes are randomly moved earlier or later by, to spread out the refreshes of tokens fetched together")
+	flag.DurationVar(&flMetadataTimeout, "metadata_timeout", defaultMetadataTimeout, "deadline of each metadata server query, for the region lookup at startup and the identity token fetches")
+	flag.StringVar(&flTokenType, "token_type", tokenTypeID, "type of the tokens injected to the requests: 'id' (identity tokens for the service url) or 'access' (oauth2 access tokens of the default service account, with -token_scopes)")
+	flag.StringVar(&flTokenScopes, "token_scopes", defaultAccessTokenScopes, "comma-separated oauth2 scopes of the access tokens with -token_type=access")
+	flag.StringVar(&flImpersonateSA, "impersonate_sa", "", "email of a service account to generate identity tokens as via the IAM Credentials API, instead of the default service account (which needs roles/iam.serviceAccountOpenIdTokenCreator on it)")
+	flag.StringVar(&flNoAuth, "no_auth", "", "comma-separated service names or glob patterns (e.g. 'public-*') to send requests to without an identity token")
+	flag.StringVar(&flPathRewrites, "path_rewrite", "", "comma-separated SERVICE:/FROM=/TO rules replacing the /FROM path prefix of the requests to SERVICE with /TO, the first matching rule of a service is applied (e.g. hello:/svc=/ strips /svc, hello:/=/v1 adds /v1)")
+	flag.StringVar(&flSplits, "split", "", "comma-separated SERVICE=VARIANT:WEIGHT,VARIANT:WEIGHT,... traffic splits sending each request to a service without a revision tag to one of its revision tags at random by weight, where VARIANT 'stable' is the untagged URL (e.g. hello=stable:90,canary:10); requests with the same "+headerSplitKey+" header go to the same variant")
+	flag.StringVar(&flStripHeaders, "strip_headers", "", "comma-separated names of request headers not to forward to the services, or patterns with * wildcards (e.g. X-Internal-*)")
+	flag.BoolVar(&flTrustXFF, "trust_forwarded_for", false, "forward the X-Forwarded-For header of the callers with their address appended, instead of replacing it with their address")
+	flag.BoolVar(&flPreserveHost, "preserve_host", false, "send the Host header of the requests as is (and in X-Forwarded-Host) instead of the resolved hostname, which is still dialed, used for tls and the identity token audience (cloud run routes by the Host, so only for custom domains and overrides that route by the original one)")
+	flag.BoolVar(&flNoUserAgent, "no_user_agent", false, "forward the User-Agent header of the requests as is, without appending runsd/VERSION to it (for services that require an exact User-Agent)")
+	flag.StringVar(&flAllowSource, "allow_source", defaultAllowSources, "comma-separated CIDRs or IP addresses that are the only ones the proxy accepts requests from, others get 403 (empty to accept all)")
+	flag.StringVar(&flAllowServices, "allow_services", "", "comma-separated service names or glob patterns (e.g. 'billing-*') that are the only services the proxy sends requests to, others get 403 (default: all)")
+	flag.DurationVar(&flUpstreamTimeout, "upstream_timeout", 0, "timeout for proxied requests, responded with 504 when exceeded (streaming grpc, sse and websocket requests are exempt) (default: none)")
+	flag.StringVar(&flServiceTimeouts, "service_timeouts", "", "comma-separated SERVICE=DURATION timeouts of the requests to some services instead of -upstream_timeout, 0 for none (e.g. reports=5m,cache=500ms)")
+	flag.DurationVar(&flUpgradeIdleTimeout, "websocket_idle_timeout", 0, "close upgraded (e.g. websocket) connections after no data is sent for this long (default: never)")
+	flag.StringVar(&flLogFormat, "log_format", logFormatText, "format of the proxied request logs: 'text' (klog lines at -v=5) or 'json' (one structured line per request on stdout)")
+	flag.DurationVar(&flShutdownGrace, "shutdown_grace_period", defaultShutdownGracePeriod, "after the subprocess exits, how long to wait for in-flight proxied requests and streams before closing them")
+	flag.DurationVar(&flFlushInterval, "flush_interval", defaultFlushInterval, "how often to flush the proxied responses of known length to the app while they are copied, 0 to only flush full buffers, negative to flush after each write (grpc, sse and other responses of unknown length are always flushed after each write)")
+	flag.Int64Var(&flMaxResponseBuffer, "max_response_buffer", defaultMaxResponseBuffer, "largest response body buffered in memory to transform it (e.g. by -clean_404), larger bodies are streamed as is without the transformation")
+	flag.Int64Var(&flMaxBodyBytes, "max_body_bytes", 0, "respond with 413 to requests with larger bodies, does not apply to streaming requests (grpc, websocket) (default: no limit)")
+	flag.UintVar(&flH2MaxConcurrentStreams, "h2_max_concurrent_streams", 0, "maximum number of concurrent streams per http/2 (h2c) client connection to the proxy (default: 250)")
+	flag.DurationVar(&flH2IdleTimeout, "h2_idle_timeout", defaultH2IdleTimeout, "close http/2 (h2c) client connections to the proxy after they have no streams for this long, 0 to never close them")
+	flag.UintVar(&flH2MaxReadFrameSize, "h2_max_read_frame_size", 0, "largest http/2 frame the proxy reads from clients, between 16384 and 16777215 (default: 1048576)")
+	flag.BoolVar(&flEnableHTTP3, "enable_http3", false, "also accept HTTP/3 (QUIC) on -http3_addr for https:// URLs, with the same handling as the h2c and HTTP/1.1 requests, requires -http3_cert_file and -http3_key_file")
+	flag.StringVar(&flHTTP3Addr, "http3_addr", defaultHTTP3Addr, "UDP address of the HTTP/3 listener with -enable_http3, with the same hosts as -listen_addr")
+	flag.StringVar(&flHTTP3CertFile, "http3_cert_file", "", "path to the PEM certificate of the HTTP/3 listener, which the clients must trust for the internal names they use (QUIC always uses TLS)")
+	flag.StringVar(&flHTTP3KeyFile, "http3_key_file", "", "path to the PEM private key of -http3_cert_file")
+	flag.BoolVar(&flCompress, "compress", false, "gzip the proxied responses for clients that accept it, unless already encoded, compressed (e.g. images) or streamed")
+	flag.Int64Var(&flCompressMinBytes, "compress_min_bytes", defaultCompressMinBytes, "with -compress or -compress_request, do not compress responses or request bodies smaller than this")
+	flag.StringVar(&flCompressRequest, "compress_request", "", "comma-separated service names or glob patterns (e.g. 'ingest-*') to gzip the request bodies to, with Content-Encoding: gzip (the services must decompress them); bodies are buffered to compress them, streaming requests and encoded or compressed (e.g. images) bodies are sent as is")
+	flag.BoolVar(&flClean404, "clean_404", false, "respond with a json 404 error naming the service and region instead of the html page of Cloud Run when no service is deployed at the resolved *.a.run.app host (404 responses of the services are passed through)")
+	flag.BoolVar(&flDebugHeaders, "debug_headers", false, "[debug-only] set X-Runsd-Target, X-Runsd-Region and X-Runsd-Auth (cached, fresh or none) headers on the responses, which reveal the upstream hosts")
+	flag.StringVar(&flResolve, "resolve", "", "print the Cloud Run host, region and token audience a hostname would be proxied to with the current configuration, and exit (no subprocess is run)")
+	flag.StringVar(&flCheckPath, "check_path", "", "path 'runsd check SERVICE' sends a GET request to (default: a HEAD request to /)")
+	flag.BoolVar(&flPrintConfig, "print_config", false, "print the effective configuration (all flags incl. defaults, and the domains, region, project hash and token source in use) as json, and exit (no subprocess is run)")
+	flag.StringVar(&flHealthAddr, "health_addr", "", "address to serve /healthz and /readyz probes on (e.g. :8081, default: disabled)")
+	flag.StringVar(&flMetricsAddr, "metrics_addr", "", "address to serve prometheus metrics on at /metrics (e.g. :9090, default: disabled)")
+	flag.StringVar(&flPprofAddr, "pprof_addr", "", "[debug-only] address to serve net/http/pprof on at /debug/pprof/, bound to localhost if no host is given (e.g. :6060, default: disabled)")
+	flag.Set("logtostderr", "true")
+	// 'runsd check [flags] SERVICE' checks the service is reachable, and exits
+	args := os.Args[1:]
+	check := len(args) > 0 && args[0] == "check"
+	if check {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	klog.V(1).Infof("starting runsd version=%s commit=%s pid=%d", version, commit, os.Getpid())
+
+	new(sync.Once).Do(func() {
+		ipv6OK = ipv6Available()
+	})
+
+	if flListenAddr == "" {
+		flListenAddr = net.JoinHostPort("", flHTTPProxyPort)
+	}
+	proxyAddrs, err := proxyListenAddrs(flListenAddr, ipv6OK)
+	if err != nil {
+		klog.Exitf("invalid -listen_addr value: %v", err)
+	}
+	if _, port, _ := net.SplitHostPort(proxyAddrs[0]); os.Getenv("PORT") == port {
+		klog.Exitf("your Cloud Run application is set to run on PORT=%s, this conflicts with runsd", port)
+	}
+	var (
+		http3Addrs  []string
+		http3Config *tls.Config
+	)
+	if flEnableHTTP3 {
+		if http3Addrs, err = proxyListenAddrs(flHTTP3Addr, ipv6OK); err != nil {
+			klog.Exitf("invalid -http3_addr value: %v", err)
+		}
+		if http3Config, err = loadHTTP3Config(flHTTP3CertFile, flHTTP3KeyFile); err != nil {
+			klog.Exitf("invalid -http3_cert_file or -http3_key_file: %v", err)
+		}
+	}
+	if flDNSAddr == "" {
+		flDNSAddr = net.JoinHostPort("", flDNSPort)
+	}
+	dnsAddrs, err := dnsListenAddrs(flDNSAddr, ipv6OK)
+	if err != nil {
+		klog.Exitf("invalid -dns_addr value: %v", err)
+	}
+
+	var uid *uint32
+	if flUser != "" {
+		u, err := resolveUser(flUser)
+		if err != nil {
+			klog.Exitf("cannot resolve user: %v", err)
+		}
+		uid = &u
+	}
+
+	if err := loadRegionCodes(flRegionCodes, os.Getenv("RUNSD_REGION_CODES")); err != nil {
+		klog.Exitf("failed to load region codes: %v", err)
+	}
+
+	configValues, err := resolverConfigValues(flag.CommandLine, flConfigFile)
+	if err != nil {
+		klog.Exitf("invalid -config_file: %v", err)
+	}
+	resolveConfig, err := newResolverConfig(configValues)
+	if err != nil {
+		klog.Exit(err)
+	}
+
+	regionFallbacks, err := parseRegionList(flRegionFallbacks)
+	if err != nil {
+		klog.Exitf("invalid -region_fallbacks value: %v", err)
+	}
+
+	var overrides *resolveOverrides
+	if flOverrides != "" {
+		overrides, err = newResolveOverrides(flOverrides)
+		if err != nil {
+			klog.Exitf("invalid -resolve_overrides file: %v", err)
+		}
+	}
+
+	noAuthServices := splitList(flNoAuth)
+	if err := validateServicePatterns(noAuthServices); err != nil {
+		klog.Exitf("invalid -no_auth value: %v", err)
+	}
+
+	compressRequests := splitList(flCompressRequest)
+	if err := validateServicePatterns(compressRequests); err != nil {
+		klog.Exitf("invalid -compress_request value: %v", err)
+	}
+
+	rateLimits, err := parseRateLimits(flRateLimits)
+	if err != nil {
+		klog.Exitf("invalid -rate_limit value: %v", err)
+	}
+	if flRateLimitDefault < 0 || math.IsInf(flRateLimitDefault, 0) || math.IsNaN(flRateLimitDefault) {
+		klog.Exitf("invalid -rate_limit_default value %v: must be a non-negative number", flRateLimitDefault)
+	}
+
+	serviceTimeouts, err := parseServiceTimeouts(flServiceTimeouts)
+	if err != nil {
+		klog.Exitf("invalid -service_timeouts value: %v", err)
+	}
+
+	if flMaxResponseBuffer < 0 {
+		klog.Exitf("invalid -max_response_buffer value %d: must not be negative", flMaxResponseBuffer)
+	}
+
+	splits, err := parseSplits(flSplits)
+	if err != nil {
+		klog.Exitf("invalid -split value: %v", err)
+	}
+
+	pathRewrites, err := parsePathRewrites(flPathRewrites)
+	if err != nil {
+		klog.Exitf("invalid -path_rewrite value: %v", err)
+	}
+
+	strippedHeaders, err := parseHeaderPatterns(flStripHeaders)
+	if err != nil {
+		klog.Exitf("invalid -strip_headers value: %v", err)
+	}
+
+	allowSources, err := parseSourceCIDRs(flAllowSource)
+	if err != nil {
+		klog.Exitf("invalid -allow_source value: %v", err)
+	}
+
+	if flDNSTTL < time.Second {
+		klog.Exitf("invalid -dns_ttl value %s: must be at least 1s", flDNSTTL)
+	}
+
+	if flDNSNegativeTTL < 0 {
+		klog.Exitf("invalid -dns_negative_ttl value %s: must not be negative", flDNSNegativeTTL)
+	}
+
+	if flBreakerFailures > 0 && flBreakerCooldown <= 0 {
+		klog.Exitf("invalid -circuit_breaker_cooldown value %s: must be positive", flBreakerCooldown)
+	}
+
+	if !httpguts.ValidHeaderFieldName(flAuthHeader) {
+		klog.Exitf("invalid -auth_header value %q: must be a header name", flAuthHeader)
+	}
+	// the token must not be logged in any header it is sent in
+	credentialHeaders[http.CanonicalHeaderKey(flAuthHeader)] = true
+
+	if flLogFormat != logFormatText && flLogFormat != logFormatJSON {
+		klog.Exitf("invalid -log_format value %q: must be %q or %q", flLogFormat, logFormatText, logFormatJSON)
+	}
+
+	tokenSource, tokenSourceDesc := identityToken, "metadata server"
+	if flLocal {
+		if flRegion == "" {
+			klog.Exit("-local requires -gcp_region since the region cannot be looked up from the metadata server")
+		}
+		if flImpersonateSA != "" {
+			klog.Exit("-local cannot be used with -impersonate_sa")
+		}
+		adc, err := newADCTokenSource(context.Background())
+		if err != nil {
+			klog.Exitf("-local: %v (run \"gcloud auth application-default login\")", err)
+		}
+		klog.V(1).Info("running locally with identity tokens from application default credentials")
+		tokenSource, tokenSourceDesc = adc.identityToken, "application default credentials"
+	}
+	if flImpersonateSA != "" {
+		if !strings.Contains(flImpersonateSA, "@") {
+			klog.Exitf("invalid -impersonate_sa value %q: must be a service account email", flImpersonateSA)
+		}
+		klog.V(3).Infof("generating identity tokens as service account %s", flImpersonateSA)
+		tokenSource = newImpersonatingTokenSource(flImpersonateSA).identityToken
+		tokenSourceDesc = "iam credentials api as " + flImpersonateSA
+	}
+	var tokenExpiry func(string) (time.Time, error)
+	switch flTokenType {
+	case tokenTypeID:
+	case tokenTypeAccess:
+		if flLocal || flImpersonateSA != "" {
+			klog.Exit("-token_type=access cannot be used with -local or -impersonate_sa")
+		}
+		if flTokenCacheDir != "" {
+			klog.Exit("-token_type=access cannot be used with -token_cache_dir")
+		}
+		klog.V(3).Infof("injecting access tokens with scopes=%s", flTokenScopes)
+		src := newAccessTokenSource(splitList(flTokenScopes))
+		tokenSource, tokenExpiry = src.accessToken, src.expiry
+		tokenSourceDesc = "metadata server (access tokens)"
+	default:
+		klog.Exitf("invalid -token_type value %q: must be %q or %q", flTokenType, tokenTypeID, tokenTypeAccess)
+	}
+	if flMetadataTimeout <= 0 {
+		klog.Exitf("invalid -metadata_timeout value %s: must be positive", flMetadataTimeout)
+	}
+	metadataTimeout = flMetadataTimeout
+	if flTokenRetries < 0 {
+		klog.Exitf("invalid -token_fetch_retries value %d: must not be negative", flTokenRetries)
+	}
+	tokenSource = newRetryingTokenSource(tokenSource, flTokenRetries).identityToken
+	if !(flTokenJitter >= 0 && flTokenJitter <= 1) {
+		klog.Exitf("invalid -token_refresh_jitter value %v: must be between 0 and 1", flTokenJitter)
+	}
+	tokenCacheDir := flTokenCacheDir
+	if tokenCacheDir != "" && flImpersonateSA != "" {
+		// tokens of different identities must not be mixed up
+		tokenCacheDir = filepath.Join(tokenCacheDir, flImpersonateSA)
+	}
+
+	posArgs := flag.Args()
+	if check && len(posArgs) != 1 {
+		klog.Exit("specify the service to check, e.g: '/runsd check hello'")
+	}
+	if len(posArgs) == 0 && flResolve == "" && !flPrintConfig {
+		klog.Exit("specify subprocess as positional args, e.g: '/runsd -- python3 server.py'")
+	}
+
+	rc, err := dns.ClientConfigFromFile(flResolvConf)
+	if err != nil {
+		klog.Exitf("failed to read dns client configuration from %s: %v", flResolvConf, err)
+	}
+
+	internalDomain := os.Getenv("RUNSD_INTERNAL_DOMAIN")
+	if flInternalDomain != "" {
+		internalDomain = flInternalDomain
+	}
+	if internalDomain == "" {
+		internalDomain = defaultInternalDomain
+	}
+	internalDomain, aliasDomains, err := parseInternalDomains(internalDomain)
+	if err != nil {
+		klog.Exitf("invalid internal domain: %v", err)
+	}
+	klog.V(3).Infof("using internal domain: %s (aliases: %v)", internalDomain, aliasDomains)
+
+	var useNameserver string
+	if flNameserver != "" {
+		useNameserver = flNameserver
+	} else if len(rc.Servers) > 0 {
+		useNameserver = rc.Servers[0]
+	} else {
+		klog.Exitf("no nameservers in %s and no nameserver is specified as option", flResolvConf)
+	}
+	klog.V(3).Infof("original nameserver: %s, ndots=%d", useNameserver, flNdots)
+
+	// do not hijack dns for this process
+	net.DefaultResolver = resolver(net.JoinHostPort(useNameserver, "53"))
+
+	onCloudRun := flRegion != "" || useNameserver == "169.254.169.254"
+	klog.V(1).Infof("on cloudrun: %v", onCloudRun)
+	projectHash, hashSource := projectHashSetting(flProjectHash, os.Getenv) // TODO find a way to infer this from runtime environment
+	switch flURLFormat {
+	case URLFormatHash:
+		if projectHash != "" {
+			if err := validateProjectHash(projectHash); err != nil {
+				klog.Exitf("invalid %s: %v", hashSource, err)
+			}
+			klog.V(3).Infof("using project hash %s from %s", projectHash, hashSource)
+		}
+	case URLFormatNumber:
+		projectHash, hashSource = flProjectNumber, "-gcp_project_number"
+		if projectHash == "" && onCloudRun {
+			hashSource = "metadata server"
+			if projectHash, err = projectNumberFromMetadata(); err != nil {
+				klog.Exitf("failed to infer project number from metadata service: %v", err)
+			}
+		}
+		if projectHash != "" {
+			if err := validateProjectNumber(projectHash); err != nil {
+				klog.Exitf("invalid %s: %v", hashSource, err)
+			}
+			klog.V(3).Infof("using project number %s from %s", projectHash, hashSource)
+		}
+	default:
+		klog.Exitf("invalid -url_format value %q: must be %q or %q", flURLFormat, URLFormatHash, URLFormatNumber)
+	}
+
+	// -gcp_region skips the lookup, and -fallback_region is used if it fails
+	lookupRegion := flRegion == "" && useNameserver == "169.254.169.254" && !flLocal
+	var lookup func() (string, error)
+	if lookupRegion {
+		klog.V(4).Info("inferring cloud run region from metadata server")
+		lookup = regionFromMetadata
+	}
+	region, regionSource, err := selectRegion(flRegion, flFallbackRegion, lookup)
+	if err != nil {
+		klog.Exitf("failed to infer region from metadata service (set -fallback_region to use a region when it fails): %v", err)
+	}
+	if onCloudRun {
+		klog.V(3).Infof("using cloud run region: %s", region)
+	}
+
+	cfg := Config{
+		InternalDomain:     internalDomain,
+		AliasDomains:       aliasDomains,
+		Region:             region,
+		ProjectHash:        projectHash,
+		URLFormat:          flURLFormat,
+		UpstreamTimeout:    flUpstreamTimeout,
+		UpgradeIdleTimeout: flUpgradeIdleTimeout,
+		MetadataTimeout:    flMetadataTimeout,
+		TokenSource:        tokenSource,
+		AuthPassthrough:    flAuthPassthrough,
+		NoAuth:             noAuthServices,
+		ProjectHashes:      resolveConfig.projectHashes,
+		ServiceRegions:     resolveConfig.serviceRegions,
+		CustomDomains:      resolveConfig.customDomains,
+		AllowServices:      resolveConfig.allowServices,
+	}
+	// off Cloud Run nothing is proxied, and the region is not known
+	if onCloudRun {
+		if err := cfg.Validate(); err != nil {
+			if errors.Is(err, errNoProjectHash) && flURLFormat == URLFormatHash {
+				err = fmt.Errorf("%w: set CLOUD_RUN_PROJECT_HASH (e.g. this value is 'dpyb4duzqq' if the URLs for your project are like 'foo-dpyb4duzqq-uc.run.app')", err)
+			}
+			klog.Exitf("invalid configuration: %v", err)
+		}
+	}
+
+	proxy := cfg.newReverseProxy()
+	if lookupRegion {
+		proxy.lookupRegion = regionFromMetadata
+		proxy.region() // warns now rather than on the first request if the lookup failed
+	}
+	proxy.upstreamRetries = flUpstreamRetries
+	proxy.retryMaxBackoff = flRetryMaxBackoff
+	proxy.breakerFailures = flBreakerFailures
+	proxy.breakerCooldown = flBreakerCooldown
+	proxy.rateLimits = rateLimits
+	proxy.serviceTimeouts = serviceTimeouts
+	proxy.defaultRateLimit = flRateLimitDefault
+	proxy.overrides = overrides
+	if len(regionFallbacks) > 0 {
+		proxy.regionProber = newRegionProber(append([]string{region}, regionFallbacks...), func(svc, r string) string {
+			host, _ := proxy.serviceHost(svc, r, projectHash)
+			return host
+		})
+	}
+	proxy.pathRewrites = pathRewrites
+	if len(splits) > 0 {
+		proxy.splitter = newSplitter(splits)
+	}
+	proxy.allowSources = allowSources
+	proxy.strippedHeaders = strippedHeaders
+	proxy.trustForwardedFor = flTrustXFF
+	proxy.noUserAgent = flNoUserAgent
+	proxy.preserveHost = flPreserveHost
+	proxy.maxBodyBytes = flMaxBodyBytes
+	proxy.maxResponseBuffer = flMaxResponseBuffer
+	proxy.flushInterval = flFlushInterval
+	proxy.compress = flCompress
+	proxy.compressMinBytes = flCompressMinBytes
+	proxy.compressRequests = compressRequests
+	proxy.tokenRefreshJitter = flTokenJitter
+	proxy.tokenCacheDir = tokenCacheDir
+	proxy.tokenExpiry = tokenExpiry
+	proxy.authHeader = flAuthHeader
+	proxy.authNoBearer = !flAuthBearer
+	proxy.debugHeaders = flDebugHeaders
+	proxy.clean404 = flClean404
+	if flLogFormat == logFormatJSON {
+		proxy.accessLog = newAccessLogger(os.Stdout)
+	}
+
+	currentRegionCode, _ := regionCode(region)
+	config := effectiveConfig{
+		Flags:               flagValues(flag.CommandLine),
+		OnCloudRun:          onCloudRun,
+		Nameserver:          useNameserver,
+		InternalDomain:      internalDomain,
+		AliasDomains:        aliasDomains,
+		Region:              region,
+		RegionSource:        regionSource,
+		RegionCode:          currentRegionCode,
+		RegionCodeOverrides: regionCodeOverrides(),
+		ProjectHash:         projectHash,
+		ProjectHashSource:   hashSource,
+		TokenSource:         tokenSourceDesc,
+	}
+	if flPrintConfig {
+		if err := config.write(os.Stdout); err != nil {
+			klog.Exitf("failed to print the configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+	if klog.V(4).Enabled() {
+		var b strings.Builder
+		config.write(&b)
+		klog.V(4).Infof("effective configuration: %s", b.String())
+	}
+
+	if flResolve != "" {
+		out, err := proxy.explainResolution(flResolve)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot resolve %s: %v\n", flResolve, err)
+			os.Exit(1)
+		}
+		fmt.Print(out)
+		os.Exit(0)
+	}
+
+	if check {
+		upstreamOpts, err := upstreamOptionsFromFlags()
+		if err != nil {
+			klog.Exitf("invalid upstream connection options: %v", err)
+		}
+		steps := proxy.checkService(context.Background(), newUpstreamRoundTripper(upstreamOpts), posArgs[0], flCheckPath)
+		if !writeCheck(os.Stdout, steps) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// reload the region codes and the config files on SIGHUP
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			reloadConfig(proxy, flag.CommandLine, flRegionCodes, os.Getenv("RUNSD_REGION_CODES"), flConfigFile)
+		}
+	}()
+
+	srvs := newServers()
+
+	if !onCloudRun || flSkipDNSServer {
+		klog.V(1).Infof("skipping dns servers initialization")
+	} else {
+		// start dns server
+		dnsCache := newDNSCache(defaultDNSCacheSize)
+		dnsCache.negativeTTL = flDNSNegativeTTL
+		_, port, _ := net.SplitHostPort(proxyAddrs[0])
+		proxyPort, _ := strconv.ParseUint(port, 10, 16)
+		dnsSrv := &dnsHijack{
+			nameserver: useNameserver,
+			domain:     internalDomain,
+			aliases:    aliasDomains,
+			dots:       flNdots,
+			serveIPv6:  listensIPv6(proxyAddrs),
+			noForward:  flNoDNSForward,
+			cache:      dnsCache,
+			ttl:        uint32(flDNSTTL / time.Second),
+			answerPTR:  flDNSLoopbackPTR,
+			proxyPort:  uint16(proxyPort),
+		}
+		dnsSrv.currentProjects = func() map[string]string { return proxy.config().projectHashes }
+
+		if !ipv6OK {
+			klog.V(1).Infof("skipping ipv6 dns server, stack not available")
+		}
+		klog.V(1).Infof("dns server addresses: %v", dnsAddrs)
+		if _, port, _ := net.SplitHostPort(dnsAddrs[0]); port != defaultDnsPort {
+			klog.Warningf("WARN: dns server is not on port %s, programs using resolv.conf will not query it", defaultDnsPort)
+		}
+		for _, addr := range dnsAddrs {
+			for _, network := range []string{"udp", "tcp"} {
+				addr, network := addr, network
+				klog.V(1).Infof("starting dns server at %s:%s", network, addr)
+				go srvs.serveDNS(network, addr, func() *dns.Server { return dnsSrv.newServer(network, addr) })
+			}
+		}
+
+		klog.V(4).Infof("hijacking resolv.conf file=%s", flResolvConf)
+		searchDomains := append(cloudRunZones(region, internalDomain), rc.Search...)
+		var resolvers []string
+		for _, addr := range dnsAddrs {
+			host, _, _ := net.SplitHostPort(addr)
+			resolvers = append(resolvers, host)
+		}
+		if err := configureResolvConf(flResolvConf, resolvers, searchDomains, flNdots); err != nil {
+			klog.Fatal(err)
+		}
+		klog.V(1).Info("dns hijack setup complete")
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		klog.Exitf("failed to set up tracing: %v", err)
+	}
+
+	var readinessCheck func() error
+	if onCloudRun {
+		readinessCheck = metadataReadinessCheck(tokenSource, flRegion == "")
+	} else {
+		readinessCheck = func() error { return nil }
+	}
+	health := newHealthChecker(readinessCheck)
+	health.listeners = &srvs.dnsStatus
+
+	// start local proxy
+	if !onCloudRun || flSkipHTTPProxyServer {
+		klog.V(1).Infof("skipping http proxy server initialization")
+		health.setProxyListening()
+	} else {
+		if flH2MaxConcurrentStreams > math.MaxUint32 || flH2MaxReadFrameSize > math.MaxUint32 {
+			klog.Exitf("-h2_max_concurrent_streams and -h2_max_read_frame_size must fit in 32 bits")
+		}
+		h2opts := h2Options{
+			maxConcurrentStreams: uint32(flH2MaxConcurrentStreams),
+			idleTimeout:          flH2IdleTimeout,
+			maxReadFrameSize:     uint32(flH2MaxReadFrameSize),
+		}
+		if err := h2opts.validate(); err != nil {
+			klog.Exitf("invalid http/2 server options: %v", err)
+		}
+		klog.V(1).Infof("http/2 server options: %s", h2opts)
+		upstreamOpts, err := upstreamOptionsFromFlags()
+		if err != nil {
+			klog.Exitf("invalid upstream connection options: %v", err)
+		}
+		proxyHandler := srvs.requests.handler(proxy.newReverseProxyHandler(newUpstreamRoundTripper(upstreamOpts)))
+		handler := allowh2c(proxyHandler, h2opts)
+		if !ipv6OK {
+			klog.V(1).Infof("skipping http proxy server on ipv6, stack not available")
+		}
+		for _, addr := range proxyAddrs {
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				klog.Exitf("reverse proxy listen fail (%s): %v", addr, err)
+			}
+			klog.V(1).Infof("starting reverse proxy server at %s", addr)
+			srv := srvs.newHTTPServer(handler)
+			go func(addr string) {
+				if err := srv.Serve(lis); err != http.ErrServerClosed {
+					klog.Fatalf("reverse proxy fail (%s): %v", addr, err)
+				}
+			}(addr)
+		}
+		for _, addr := range http3Addrs {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				klog.Exitf("http/3 reverse proxy listen fail (%s): %v", addr, err)
+			}
+			klog.V(1).Infof("starting http/3 reverse proxy server at %s", addr)
+			srv := srvs.newHTTP3Server(proxyHandler, http3Config)
+			go func(addr string) {
+				if err := srv.Serve(conn); err != http.ErrServerClosed {
+					klog.Fatalf("http/3 reverse proxy fail (%s): %v", addr, err)
+				}
+			}(addr)
+		}
+		health.setProxyListening()
+		klog.V(1).Info("started reverse proxy server(s)")
+	}
+
+	if flHealthAddr != "" {
+		go func() {
+			klog.V(1).Infof("starting health server at %s", flHealthAddr)
+			klog.Fatalf("health server fail: %v", http.ListenAndServe(flHealthAddr, health.handler()))
+		}()
+	}
+
+	if flMetricsAddr != "" {
+		go func() {
+			klog.V(1).Infof("starting metrics server at %s", flMetricsAddr)
+			klog.Fatalf("metrics server fail: %v", http.ListenAndServe(flMetricsAddr, metricsHandler()))
+		}()
+	}
+
+	if flPprofAddr != "" {
+		addr, err := pprofListenAddr(flPprofAddr)
+		if err != nil {
+			klog.Exitf("invalid -pprof_addr value: %v", err)
+		}
+		go func() {
+			klog.V(1).Infof("starting pprof server at %s", addr)
+			klog.Fatalf("pprof server fail: %v", http.ListenAndServe(addr, pprofHandler()))
+		}()
+	}
+
+	// start subprocess
+	var (
+		cmd  string
+		argv []string
+	)
+	if len(posArgs) > 1 {
+		cmd, argv = posArgs[0], posArgs[1:]
+	} else {
+		cmd = posArgs[0]
+	}
+	klog.V(1).Infof("starting subprocess. cmd=%q argv=%#v", cmd, argv)
+	c := exec.Command(cmd, argv...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+	if uid != nil {
+		if c.SysProcAttr == nil {
+			c.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		if c.SysProcAttr.Credential == nil {
+			c.SysProcAttr.Credential = &syscall.Credential{}
+		}
+		c.SysProcAttr.Credential.Uid = *uid
+	}
+	if err := c.Start(); err != nil {
+		klog.Warningf("failed to start subprocess: %v", err)
+		os.Exit(1)
+	}
+	klog.V(2).Infof("subprocess started successfully pid=%d", c.Process.Pid)
+	go func() {
+		sig := <-sigCh
+		klog.V(2).Infof("received signal=%s", sig)
+		if err := c.Process.Signal(sig); err != nil {
+			klog.Warningf("failed to signal process: %v", err)
+		}
+		klog.V(2).Infof("delivered signal=%s to child=%d", sig, c.Process.Pid)
+	}()
+	err = c.Wait()
+
+	// the proxy keeps serving until the subprocess exits, so it can make
+	// requests while shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), flShutdownGrace)
+	srvs.shutdown(ctx)
+	if err := shutdownTracing(ctx); err != nil {
+		klog.V(1).Infof("WARN: failed to flush traces: %v", err)
+	}
+	cancel()
+
+	if err != nil {
+		klog.Infof("subprocess terminated")
+		if v, ok := err.(*exec.ExitError); ok {
+			ec := v.ExitCode()
+			klog.V(1).Infof("exit_code=%d, pid=%d", ec, v.Pid())
+			klog.Flush()
+			os.Exit(ec)
+		} else {
+			klog.V(1).Infof("error not a proper exec.ExitError")
+			klog.Exitf("subprocess exited: %v", err)
+		}
+	}
+	klog.V(1).Infof("subprocess exited successfully")
+}
+
+func ipv6Available() bool {
+	lis, err := net.Listen("tcp6", net.JoinHostPort(net.IPv6loopback.String(), "0"))
+	if err != nil {
+		klog.V(4).Infof("ipv6 stack not available: %v", err)
+		return false
+	}
+	lis.Close()
+	return true
+}
+
+// splitList parses a comma-separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseInternalDomains parses the comma-separated internal domains, and
+// returns the first one and the others.
+func parseInternalDomains(s string) (string, []string, error) {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, v := range splitList(s) {
+		d, err := normalizeDomain(v)
+		if err != nil {
+			return "", nil, err
+		}
+		if seen[d] {
+			return "", nil, fmt.Errorf("domain %q is listed twice", v)
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	if len(domains) == 0 {
+		return "", nil, fmt.Errorf("no internal domain in %q", s)
+	}
+	return domains[0], domains[1:], nil
+}
+
+// parseProjectHashes parses comma-separated NAME=HASH pairs.
+func parseProjectHashes(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, kv := range splitList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in NAME=HASH format", kv)
+		}
+		if err := validateProjectName(parts[0]); err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(parts[0])
+		if err := validateProjectHash(parts[1]); err != nil {
+			return nil, fmt.Errorf("project %q: %w", parts[0], err)
+		}
+		out[name] = parts[1]
+	}
+	return out, nil
+}
+
+// projectHashSetting returns the project hash from the -gcp_project_hash flag,
+// or else the RUNSD_PROJECT_HASH or CLOUD_RUN_PROJECT_HASH environment
+// variables, and where it came from.
+func projectHashSetting(flagValue string, getenv func(string) string) (string, string) {
+	if flagValue != "" {
+		return flagValue, "-gcp_project_hash"
+	}
+	for _, env := range []string{"RUNSD_PROJECT_HASH", "CLOUD_RUN_PROJECT_HASH"} {
+		if v := getenv(env); v != "" {
+			return v, env
+		}
+	}
+	return "", ""
+}
+
+// parseServiceRegions parses comma-separated SERVICE=REGION pairs.
+func parseServiceRegions(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, kv := range splitList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in SERVICE=REGION format", kv)
+		}
+		svc, region := strings.ToLower(parts[0]), strings.ToLower(parts[1])
+		if err := validateServiceName(parts[0]); err != nil {
+			return nil, err
+		}
+		if _, ok := regionCode(region); !ok {
+			return nil, fmt.Errorf("region %q of service %q does not have a region code", parts[1], parts[0])
+		}
+		out[svc] = region
+	}
+	return out, nil
+}
+
+// parseCustomDomains parses comma-separated SERVICE=DOMAIN pairs.
+func parseCustomDomains(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, kv := range splitList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in SERVICE=DOMAIN format", kv)
+		}
+		if err := validateServiceName(parts[0]); err != nil {
+			return nil, err
+		}
+		d, err := normalizeCustomDomain(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		out[strings.ToLower(parts[0])] = d
+	}
+	return out, nil
+}
+
+// validateServiceName checks that the service name is a single dns label.
+func validateServiceName(svc string) error {
+	if _, ok := dns.IsDomainName(svc); !ok || strings.Contains(svc, ".") {
+		return fmt.Errorf("service name %q is not a valid dns label", svc)
+	}
+	return nil
+}
+
+// validateProjectName checks that the project name is a single dns label
+// that cannot be mistaken for a region in the internal names.
+func validateProjectName(name string) error {
+	if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, ".") {
+		return fmt.Errorf("project name %q is not a valid dns label", name)
+	}
+	if _, ok := regionCode(strings.ToLower(name)); ok {
+		return fmt.Errorf("project name %q conflicts with a region name", name)
+	}
+	return nil
+}
+
+// normalizeCustomDomain returns the custom domain of the service without the
+// trailing dot, and checks that it is fully qualified.
+func normalizeCustomDomain(svc, domain string) (string, error) {
+	d, err := normalizeDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	d = strings.TrimSuffix(d, ".")
+	if !strings.Contains(d, ".") {
+		return "", fmt.Errorf("custom domain %q of service %q is not fully qualified", domain, svc)
+	}
+	return d, nil
+}
+
+// proxyListenAddrs returns the addresses for the reverse proxy to listen on.
+// The host must be a loopback address that internal names resolve to. If it
+// is empty or localhost, both loopback interfaces are used.
+func proxyListenAddrs(addr string, ipv6 bool) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return nil, fmt.Errorf("port %q is not valid", port)
+	}
+	switch {
+	case host == "" || host == "localhost":
+		out := []string{net.JoinHostPort(ipv4Loopback.String(), port)}
+		if ipv6 {
+			out = append(out, net.JoinHostPort(net.IPv6loopback.String(), port))
+		}
+		return out, nil
+	case net.ParseIP(host).Equal(ipv4Loopback):
+		return []string{net.JoinHostPort(ipv4Loopback.String(), port)}, nil
+	case net.ParseIP(host).Equal(net.IPv6loopback):
+		if !ipv6 {
+			return nil, fmt.Errorf("ipv6 stack is not available")
+		}
+		return []string{net.JoinHostPort(net.IPv6loopback.String(), port)}, nil
+	default:
+		return nil, fmt.Errorf("host %q is not %s or %s", host, ipv4Loopback, net.IPv6loopback)
+	}
+}
+
+// dnsListenAddrs returns the addresses for the dns server to listen on. The
+// host must be a loopback address, since the programs that use resolv.conf
+// must reach it and nothing else should. If it is empty or localhost, both
+// loopback interfaces are used.
+func dnsListenAddrs(addr string, ipv6 bool) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return nil, fmt.Errorf("port %q is not valid", port)
+	}
+	if host == "" || host == "localhost" {
+		out := []string{net.JoinHostPort(ipv4Loopback.String(), port)}
+		if ipv6 {
+			out = append(out, net.JoinHostPort(net.IPv6loopback.String(), port))
+		}
+		return out, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return nil, fmt.Errorf("host %q is not a loopback address", host)
+	}
+	if ip.To4() == nil && !ipv6 {
+		return nil, fmt.Errorf("ipv6 stack is not available")
+	}
+	return []string{net.JoinHostPort(ip.String(), port)}, nil
+}
+
+// listensIPv6 reports whether one of the addresses is on the ipv6 loopback.
+func listensIPv6(addrs []string) bool {
+	for _, addr := range addrs {
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host).Equal(net.IPv6loopback) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamOptionsFromFlags returns the options of the connections to the
+// services set by the command-line flags.
+func upstreamOptionsFromFlags() (upstreamOptions, error) {
+	o := upstreamOptions{
+		maxIdleConns:        flUpstreamMaxIdleConns,
+		maxIdleConnsPerHost: flUpstreamMaxIdleConnsPerHost,
+		maxConnsPerHost:     flUpstreamMaxConnsPerHost,
+		idleConnTimeout:     flUpstreamIdleConnTimeout,
+		dialTimeout:         flUpstreamDialTimeout,
+		keepAlive:           flUpstreamKeepAlive,
+		http1Hosts:          splitList(flForceHTTP1),
+	}
+	var err error
+	if o.clientCert, err = loadClientCert(flClientCert, flClientKey); err != nil {
+		return upstreamOptions{}, fmt.Errorf("invalid -client_cert or -client_key: %w", err)
+	}
+	if err := o.validate(); err != nil {
+		return upstreamOptions{}, err
+	}
+	return o, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProxyListenAddrs(t *testing.T) {
+	cases := []struct {
+		addr    string
+		ipv6    bool
+		want    []string
+		wantErr bool
+	}{
+		{addr: ":80", ipv6: true, want: []string{"127.0.0.1:80", "[::1]:80"}},
+		{addr: ":80", want: []string{"127.0.0.1:80"}},
+		{addr: "localhost:8080", ipv6: true, want: []string{"127.0.0.1:8080", "[::1]:8080"}},
+		{addr: "127.0.0.1:8080", ipv6: true, want: []string{"127.0.0.1:8080"}},
+		{addr: "[::1]:8080", ipv6: true, want: []string{"[::1]:8080"}},
+		{addr: "[::1]:8080", wantErr: true},
+		{addr: "0.0.0.0:80", wantErr: true},
+		{addr: "10.0.0.1:80", wantErr: true},
+		{addr: "80", wantErr: true},
+		{addr: ":http", wantErr: true},
+		{addr: ":0", wantErr: true},
+		{addr: ":65536", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := proxyListenAddrs(tt.addr, tt.ipv6)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("proxyListenAddrs(%q) error = %v, wantErr = %v", tt.addr, err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("proxyListenAddrs(%q) diff: %s", tt.addr, diff)
+			}
+		})
+	}
+}
+
+func TestDNSListenAddrs(t *testing.T) {
+	cases := []struct {
+		addr    string
+		ipv6    bool
+		want    []string
+		wantErr bool
+	}{
+		{addr: ":53", ipv6: true, want: []string{"127.0.0.1:53", "[::1]:53"}},
+		{addr: ":5353", want: []string{"127.0.0.1:5353"}},
+		{addr: "localhost:53", ipv6: true, want: []string{"127.0.0.1:53", "[::1]:53"}},
+		{addr: "127.0.0.53:53", ipv6: true, want: []string{"127.0.0.53:53"}},
+		{addr: "[::1]:5353", ipv6: true, want: []string{"[::1]:5353"}},
+		{addr: "[::1]:53", wantErr: true},
+		{addr: "0.0.0.0:53", wantErr: true},
+		{addr: "10.0.0.1:53", wantErr: true},
+		{addr: "dns.local:53", wantErr: true},
+		{addr: "53", wantErr: true},
+		{addr: ":domain", wantErr: true},
+		{addr: ":0", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := dnsListenAddrs(tt.addr, tt.ipv6)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dnsListenAddrs(%q) error = %v, wantErr = %v", tt.addr, err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("dnsListenAddrs(%q) diff: %s", tt.addr, diff)
+			}
+		})
+	}
+}
+
+func TestParseCustomDomains(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "payments=Payments.Example.com.", want: map[string]string{"payments": "payments.example.com"}},
+		{in: "payments=localhost", wantErr: true},
+		{in: "payments=-x.example.com", wantErr: true},
+		{in: "a.b=payments.example.com", wantErr: true},
+		{in: "payments", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseCustomDomains(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCustomDomains(%q) error = %v, wantErr = %v", tt.in, err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); tt.want != nil && diff != "" {
+				t.Fatalf("parseCustomDomains(%q) diff: %s", tt.in, diff)
+			}
+		})
+	}
+}
+
+func TestParseServiceRegions(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "payments=us-central1, Auth=Europe-West1", want: map[string]string{"payments": "us-central1", "auth": "europe-west1"}},
+		{in: "payments", wantErr: true},
+		{in: "payments=", wantErr: true},
+		{in: "a.b=us-central1", wantErr: true},
+		{in: "payments=us-mars1", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseServiceRegions(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServiceRegions(%q) error = %v, wantErr = %v", tt.in, err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); tt.want != nil && diff != "" {
+				t.Fatalf("parseServiceRegions(%q) diff: %s", tt.in, diff)
+			}
+		})
+	}
+}
+
+func TestProjectHashSetting(t *testing.T) {
+	tests := []struct {
+		name       string
+		flag       string
+		env        map[string]string
+		want       string
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "unset"},
+		{name: "cloud run env", env: map[string]string{"CLOUD_RUN_PROJECT_HASH": "abc123"}, want: "abc123", wantSource: "CLOUD_RUN_PROJECT_HASH"},
+		{name: "runsd env takes precedence", env: map[string]string{"CLOUD_RUN_PROJECT_HASH": "abc123", "RUNSD_PROJECT_HASH": "def456"}, want: "def456", wantSource: "RUNSD_PROJECT_HASH"},
+		{name: "flag takes precedence", flag: "dpyb4duzqq", env: map[string]string{"RUNSD_PROJECT_HASH": "def456"}, want: "dpyb4duzqq", wantSource: "-gcp_project_hash"},
+		{name: "uppercase", flag: "DPYB4DUZQQ", want: "DPYB4DUZQQ", wantSource: "-gcp_project_hash", wantErr: true},
+		{name: "url pasted", env: map[string]string{"RUNSD_PROJECT_HASH": "foo-dpyb4duzqq-uc.a.run.app"}, want: "foo-dpyb4duzqq-uc.a.run.app", wantSource: "RUNSD_PROJECT_HASH", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, source := projectHashSetting(tt.flag, func(k string) string { return tt.env[k] })
+			if got != tt.want || source != tt.wantSource {
+				t.Fatalf("got hash=%q source=%q, want %q from %q", got, source, tt.want, tt.wantSource)
+			}
+			if got == "" {
+				return
+			}
+			if err := validateProjectHash(got); (err != nil) != tt.wantErr {
+				t.Fatalf("validateProjectHash(%q) err=%v, wantErr=%v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseProjectHashesValidatesHash(t *testing.T) {
+	if _, err := parseProjectHashes("shared=dpyb4duzqq"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseProjectHashes("shared=Not_A_Hash"); err == nil {
+		t.Fatal("expected error for invalid hash")
+	}
+}
+
+func TestParseInternalDomains(t *testing.T) {
+	domain, aliases, err := parseInternalDomains("run.internal, Old.Zone.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "run.internal." {
+		t.Errorf("got domain=%q, want run.internal.", domain)
+	}
+	if diff := cmp.Diff([]string{"old.zone."}, aliases); diff != "" {
+		t.Errorf("aliases (-want,+got):\n%s", diff)
+	}
+	for _, in := range []string{"", ",", ".foo", "a.b,a.b."} {
+		if _, _, err := parseInternalDomains(in); err == nil {
+			t.Errorf("parseInternalDomains(%q) expected error", in)
+		}
+	}
+}
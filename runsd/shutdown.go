@@ -0,0 +1,234 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"k8s.io/klog/v2"
+)
+
+// defaultShutdownGracePeriod matches the time Cloud Run gives the container
+// between SIGTERM and SIGKILL.
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// shutdownLogInterval is how often the in-flight requests are logged during
+// the grace period.
+const shutdownLogInterval = time.Second
+
+// requestTracker counts the in-flight requests, and the streaming (gRPC,
+// upgraded) ones among them. Unlike http.Server.Shutdown, it also sees the
+// requests on hijacked connections such as h2c streams.
+type requestTracker struct {
+	mu      sync.Mutex
+	n       int
+	streams int
+	idle    chan struct{} // closed when n drops to 0, if someone is waiting
+}
+
+func (t *requestTracker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := isStreamingRequest(r) // before the proxy changes the headers
+		t.mu.Lock()
+		t.n++
+		if stream {
+			t.streams++
+			metricActiveStreams.Inc()
+		}
+		metricActiveRequests.Inc()
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			t.n--
+			if stream {
+				t.streams--
+				metricActiveStreams.Dec()
+			}
+			metricActiveRequests.Dec()
+			if t.n == 0 && t.idle != nil {
+				close(t.idle)
+				t.idle = nil
+			}
+			t.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// counts returns the number of in-flight requests, and of the streams among
+// them.
+func (t *requestTracker) counts() (requests, streams int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n, t.streams
+}
+
+// wait blocks until there are no in-flight requests or ctx is done.
+func (t *requestTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.n == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// servers keeps track of the proxy and dns servers to shut down gracefully.
+type servers struct {
+	requests requestTracker
+
+	// baseCtx is the parent of all request contexts, canceled to abort the
+	// requests still running when the grace period is over.
+	baseCtx context.Context
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	http    []*http.Server
+	http3   []*http3.Server
+	dns     []*dns.Server
+	closing chan struct{} // closed when the shutdown starts
+
+	dnsStatus                       listenerStatus
+	dnsRebindBackoff, dnsMaxBackoff time.Duration
+}
+
+func newServers() *servers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &servers{
+		baseCtx:          ctx,
+		cancel:           cancel,
+		closing:          make(chan struct{}),
+		dnsRebindBackoff: defaultDNSRebindBackoff,
+		dnsMaxBackoff:    defaultDNSRebindMaxBackoff,
+	}
+}
+
+// newHTTPServer returns a server whose requests are tracked for shutdown.
+func (s *servers) newHTTPServer(h http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:     h,
+		BaseContext: func(net.Listener) context.Context { return s.baseCtx },
+	}
+	s.mu.Lock()
+	s.http = append(s.http, srv)
+	s.mu.Unlock()
+	return srv
+}
+
+// addDNSServer tracks the server for shutdown, and reports false if the
+// shutdown already started.
+func (s *servers) addDNSServer(srv *dns.Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closing:
+		return false
+	default:
+	}
+	s.dns = append(s.dns, srv)
+	return true
+}
+
+// shutdown stops accepting new connections and waits for the in-flight
+// requests to finish until ctx is done, after which the remaining requests
+// and connections are closed forcibly.
+func (s *servers) shutdown(ctx context.Context) {
+	s.mu.Lock()
+	close(s.closing)
+	httpServers, http3Servers, dnsServers := s.http, s.http3, s.dns
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range dnsServers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				klog.V(4).Infof("[shutdown] dns server %s/%s: %v", srv.Net, srv.Addr, err)
+			}
+		}(srv)
+	}
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				klog.V(4).Infof("[shutdown] http server: %v", err)
+			}
+		}(srv)
+	}
+	for _, srv := range http3Servers {
+		wg.Add(1)
+		go func(srv *http3.Server) {
+			defer wg.Done()
+			// closes the connections itself when ctx is done
+			if err := srv.Shutdown(ctx); err != nil {
+				klog.V(4).Infof("[shutdown] http/3 server: %v", err)
+			}
+		}(srv)
+	}
+
+	if err := s.waitRequests(ctx); err != nil {
+		n, streams := s.requests.counts()
+		klog.V(1).Infof("WARN: grace period is over, aborting %d in-flight requests (%d streams)", n, streams)
+	}
+	s.cancel()
+	for _, srv := range httpServers {
+		srv.Close()
+	}
+	wg.Wait()
+	klog.V(1).Info("servers shut down")
+}
+
+// waitRequests waits for the in-flight requests like requestTracker.wait,
+// logging how many are left every shutdownLogInterval.
+func (s *servers) waitRequests(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.requests.wait(ctx) }()
+	ticker := time.NewTicker(shutdownLogInterval)
+	defer ticker.Stop()
+	for {
+		n, streams := s.requests.counts()
+		if n > 0 {
+			left := "unlimited"
+			if deadline, ok := ctx.Deadline(); ok {
+				left = time.Until(deadline).Truncate(100 * time.Millisecond).String()
+			}
+			klog.V(1).Infof("[shutdown] waiting for %d in-flight requests (%d streams), %s left of the grace period", n, streams, left)
+		}
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startTestServers serves h on a tracked server and returns its url.
+func startTestServers(t *testing.T, h http.Handler) (*servers, string) {
+	t.Helper()
+	srvs := newServers()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := srvs.newHTTPServer(srvs.requests.handler(h))
+	go srv.Serve(lis)
+	return srvs, "http://" + lis.Addr().String()
+}
+
+func TestServersShutdownDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srvs, url := startTestServers(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("ok"))
+	}))
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srvs.shutdown(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("new request accepted during shutdown")
+	}
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+	<-done
+}
+
+func TestServersShutdownAbortsAfterGracePeriod(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	srvs, url := startTestServers(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	srvs.shutdown(ctx)
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request was not aborted")
+	}
+}
+
+func TestRequestTrackerCounts(t *testing.T) {
+	baseRequests, baseStreams := testutil.ToFloat64(metricActiveRequests), testutil.ToFloat64(metricActiveStreams)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	srvs, url := startTestServers(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer srvs.shutdown(context.Background())
+
+	done := make(chan struct{}, 2)
+	for _, ct := range []string{"text/plain", "application/grpc"} {
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		req.Header.Set("content-type", ct)
+		go func() {
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	if n, streams := srvs.requests.counts(); n != 2 || streams != 1 {
+		t.Fatalf("got requests=%d streams=%d, want 2 and 1", n, streams)
+	}
+	if got := testutil.ToFloat64(metricActiveRequests) - baseRequests; got != 2 {
+		t.Fatalf("got active_requests=%v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metricActiveStreams) - baseStreams; got != 1 {
+		t.Fatalf("got active_streams=%v, want 1", got)
+	}
+
+	close(release)
+	<-done
+	<-done
+	if err := srvs.requests.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, streams := srvs.requests.counts(); n != 0 || streams != 0 {
+		t.Fatalf("got requests=%d streams=%d after the requests finished", n, streams)
+	}
+	if got := testutil.ToFloat64(metricActiveRequests) - baseRequests; got != 0 {
+		t.Fatalf("got active_requests=%v after the requests finished", got)
+	}
+}
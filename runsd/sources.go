@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// defaultAllowSources are the addresses the proxy accepts requests from by
+// default: the loopback interfaces, like the addresses it listens on.
+const defaultAllowSources = "127.0.0.0/8,::1/128"
+
+// parseSourceCIDRs parses comma-separated CIDRs, or IP addresses that are
+// taken as single address CIDRs.
+func parseSourceCIDRs(s string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range splitList(s) {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a CIDR or an IP address", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or an IP address", v)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// remoteIP parses the IP address in the RemoteAddr of a request, which is in
+// host:port format (with an optional IPv6 zone).
+func remoteIP(remoteAddr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed remote address %q: %w", remoteAddr, err)
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("malformed ip in remote address %q", remoteAddr)
+	}
+	return ip, nil
+}
+
+// allowSources responds with 403 to the requests that do not come from an
+// address in the allowed networks. If there are none, all are allowed.
+func allowSources(allowed []*net.IPNet, next http.Handler) http.Handler {
+	if len(allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := remoteIP(r.RemoteAddr)
+		if err == nil {
+			for _, n := range allowed {
+				if n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			err = fmt.Errorf("%s is not in -allow_source", ip)
+		}
+		klog.V(1).Infof("WARN: rejecting request to host=%s from addr=%s: %v", urlHost(r), r.RemoteAddr, err)
+		writeError(w, r, http.StatusForbidden, fmt.Sprintf("runsd does not accept requests from %s", r.RemoteAddr))
+	})
+}
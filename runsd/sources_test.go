@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseSourceCIDRs(t *testing.T) {
+	got, err := parseSourceCIDRs("127.0.0.0/8, ::1/128,10.1.2.3,fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, n := range got {
+		s = append(s, n.String())
+	}
+	want := []string{"127.0.0.0/8", "::1/128", "10.1.2.3/32", "fd00::1/128"}
+	if len(s) != len(want) {
+		t.Fatalf("got %v, want %v", s, want)
+	}
+	for i := range want {
+		if s[i] != want[i] {
+			t.Fatalf("got %v, want %v", s, want)
+		}
+	}
+	for _, in := range []string{"localhost", "10.0.0.0/33", "10.0.0/8"} {
+		if _, err := parseSourceCIDRs(in); err == nil {
+			t.Errorf("parseSourceCIDRs(%q) expected error", in)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "127.0.0.1:51234", want: "127.0.0.1"},
+		{in: "[::1]:51234", want: "::1"},
+		{in: "[fe80::1%eth0]:51234", want: "fe80::1"},
+		{in: "[::ffff:127.0.0.1]:51234", want: "127.0.0.1"},
+		{in: "127.0.0.1", wantErr: true},
+		{in: "localhost:80", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := remoteIP(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("remoteIP(%q) err=%v, wantErr=%v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("remoteIP(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAllowSources(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	defaults, err := parseSourceCIDRs(defaultAllowSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := parseSourceCIDRs("10.8.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		allowed    string
+		remoteAddr string
+		want       int
+	}{
+		{name: "ipv4 loopback", allowed: "default", remoteAddr: "127.0.0.1:40000", want: http.StatusOK},
+		{name: "other ipv4 loopback", allowed: "default", remoteAddr: "127.0.0.53:40000", want: http.StatusOK},
+		{name: "ipv6 loopback", allowed: "default", remoteAddr: "[::1]:40000", want: http.StatusOK},
+		{name: "mapped ipv4 loopback", allowed: "default", remoteAddr: "[::ffff:127.0.0.1]:40000", want: http.StatusOK},
+		{name: "private address", allowed: "default", remoteAddr: "10.8.1.2:40000", want: http.StatusForbidden},
+		{name: "malformed address", allowed: "default", remoteAddr: "garbage", want: http.StatusForbidden},
+		{name: "in custom cidr", allowed: "custom", remoteAddr: "10.8.1.2:40000", want: http.StatusOK},
+		{name: "loopback not in custom cidr", allowed: "custom", remoteAddr: "127.0.0.1:40000", want: http.StatusForbidden},
+		{name: "no restriction", allowed: "", remoteAddr: "192.0.2.1:40000", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			switch tt.allowed {
+			case "default":
+				rp.allowSources = defaults
+			case "custom":
+				rp.allowSources = custom
+			}
+			var up bool
+			h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				up = true
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+			}))
+			req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got status=%d, want %d (body=%q)", rec.Code, tt.want, rec.Body.String())
+			}
+			if up != (tt.want == http.StatusOK) {
+				t.Fatalf("upstream called=%v for status=%d", up, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerSplitKey is the request header that makes the traffic split sticky:
+// the requests with the same value go to the same variant of the service.
+// It is not forwarded to the service.
+const headerSplitKey = "X-Runsd-Split-Key"
+
+// splitStable is the name of the variant of a traffic split that is the
+// untagged URL of the service.
+const splitStable = "stable"
+
+// trafficSplit has the weights of the variants of a service: its untagged
+// URL (tag "") and its revision tags.
+type trafficSplit struct {
+	variants []splitVariant
+	total    int
+}
+
+type splitVariant struct {
+	tag    string
+	weight int
+}
+
+// splitter chooses the variants of the services with a traffic split.
+type splitter struct {
+	splits map[string]trafficSplit // keyed by service name
+
+	mu  sync.Mutex // guards rnd, which is not safe for concurrent use
+	rnd *rand.Rand
+}
+
+func newSplitter(splits map[string]trafficSplit) *splitter {
+	return &splitter{splits: splits, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// choose returns the revision tag (or "" for the untagged URL) to send the
+// request to the service to, and whether the service has a traffic split. The
+// variant is random by weight, or derived from the key if it is not empty.
+func (s *splitter) choose(service, key string) (string, bool) {
+	sp, ok := s.splits[service]
+	if !ok {
+		return "", false
+	}
+	var n int
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(sp.total))
+	} else {
+		s.mu.Lock()
+		n = s.rnd.Intn(sp.total)
+		s.mu.Unlock()
+	}
+	for _, v := range sp.variants {
+		if n < v.weight {
+			return v.tag, true
+		}
+		n -= v.weight
+	}
+	return "", true // not reached, the weights add up to total
+}
+
+// parseSplits parses comma-separated SERVICE=VARIANT:WEIGHT,VARIANT:WEIGHT,...
+// traffic splits, where VARIANT is a revision tag or "stable" for the
+// untagged URL (e.g. hello=stable:90,canary:10,world=stable:50,green:50).
+func parseSplits(s string) (map[string]trafficSplit, error) {
+	out := make(map[string]trafficSplit)
+	var svc string
+	seen := make(map[string]bool) // variants of svc
+	for _, item := range splitList(s) {
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			if err := validateServiceName(parts[0]); err != nil {
+				return nil, err
+			}
+			svc = strings.ToLower(parts[0])
+			if _, ok := out[svc]; ok {
+				return nil, fmt.Errorf("service %q is listed twice", parts[0])
+			}
+			out[svc] = trafficSplit{}
+			seen = make(map[string]bool)
+			item = parts[1]
+		} else if svc == "" {
+			return nil, fmt.Errorf("%q is not in SERVICE=VARIANT:WEIGHT format", item)
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q of service %q is not in VARIANT:WEIGHT format", item, svc)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != splitStable && (!dnsLabel.MatchString(name) || strings.Contains(name, "--")) {
+			return nil, fmt.Errorf("variant %q of service %q is not %q or a valid revision tag", parts[0], svc, splitStable)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("variant %q of service %q is listed twice", parts[0], svc)
+		}
+		seen[name] = true
+		w, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("weight %q of variant %q of service %q is not a non-negative integer", parts[1], parts[0], svc)
+		}
+		tag := name
+		if name == splitStable {
+			tag = ""
+		}
+		sp := out[svc]
+		sp.variants = append(sp.variants, splitVariant{tag: tag, weight: w})
+		sp.total += w
+		out[svc] = sp
+	}
+	for svc, sp := range out {
+		if sp.total == 0 {
+			return nil, fmt.Errorf("the weights of service %q add up to 0", svc)
+		}
+	}
+	return out, nil
+}
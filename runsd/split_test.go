@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSplits(t *testing.T) {
+	got, err := parseSplits("Hello=stable:90, Canary:10,world=blue:1,green:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]trafficSplit{
+		"hello": {variants: []splitVariant{{"", 90}, {"canary", 10}}, total: 100},
+		"world": {variants: []splitVariant{{"blue", 1}, {"green", 0}}, total: 1},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(trafficSplit{}, splitVariant{})); diff != "" {
+		t.Fatalf("parseSplits() (-want,+got):\n%s", diff)
+	}
+	for _, in := range []string{
+		"stable:90",                 // no service
+		"foo=stable",                // no weight
+		"foo=stable:x",              // bad weight
+		"foo=stable:-1",             // negative weight
+		"foo=stable:0,canary:0",     // all zero
+		"foo=stable:1,stable:2",     // duplicate variant
+		"foo=a--b:1",                // bad tag
+		"foo=-a:1",                  // bad tag
+		"a.b=stable:1",              // bad service
+		"foo=stable:1,foo=canary:1", // duplicate service
+	} {
+		if _, err := parseSplits(in); err == nil {
+			t.Errorf("parseSplits(%q) expected error", in)
+		}
+	}
+}
+
+func TestSplitterDistribution(t *testing.T) {
+	s := newSplitter(map[string]trafficSplit{
+		"foo": {variants: []splitVariant{{"", 90}, {"canary", 10}, {"off", 0}}, total: 100},
+	})
+	const n = 10000
+	for _, sticky := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sticky=%v", sticky), func(t *testing.T) {
+			got := make(map[string]int)
+			for i := 0; i < n; i++ {
+				var key string
+				if sticky {
+					key = fmt.Sprintf("user-%d", i)
+				}
+				tag, ok := s.choose("foo", key)
+				if !ok {
+					t.Fatal("foo has no split")
+				}
+				got[tag]++
+			}
+			if got["off"] != 0 {
+				t.Errorf("variant of weight 0 got %d requests", got["off"])
+			}
+			// within 5 standard deviations of the expected 1000 of n
+			if c := got["canary"]; math.Abs(float64(c)-n*0.1) > 5*math.Sqrt(n*0.1*0.9) {
+				t.Errorf("canary got %d of %d requests, want about %d", c, n, n/10)
+			}
+		})
+	}
+	if _, ok := s.choose("bar", ""); ok {
+		t.Error("bar has a split")
+	}
+}
+
+func TestReverseProxySplit(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.customDomains = map[string]string{"bar": "bar.example.com"}
+	rp.splitter = newSplitter(map[string]trafficSplit{
+		"foo": {variants: []splitVariant{{"", 50}, {"canary", 50}}, total: 100},
+		"bar": {variants: []splitVariant{{"canary", 1}}, total: 1},
+	})
+	h := rp.newReverseProxyHandler(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if v := req.Header.Get(headerSplitKey); v != "" {
+			t.Errorf("%s header was forwarded: %q", headerSplitKey, v)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Upstream": {req.URL.Host}}, Body: http.NoBody, Request: req}, nil
+	}))
+	do := func(host, key string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if key != "" {
+			req.Header.Set(headerSplitKey, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("host=%s: got status=%d (body=%q)", host, rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("Upstream")
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		got[do("foo", "")] = true
+	}
+	if diff := cmp.Diff(map[string]bool{"foo-hash-uc.a.run.app": true, "canary---foo-hash-uc.a.run.app": true}, got); diff != "" {
+		t.Errorf("upstream hosts of foo (-want,+got):\n%s", diff)
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		first := do("foo", key)
+		for j := 0; j < 5; j++ {
+			if h := do("foo", key); h != first {
+				t.Fatalf("key=%s: got upstream host=%s, previously %s", key, h, first)
+			}
+		}
+	}
+
+	for host, want := range map[string]string{
+		"green.foo": "green---foo-hash-uc.a.run.app", // explicit tag
+		"bar":       "bar.example.com",               // custom domain
+	} {
+		if got := do(host, ""); got != want {
+			t.Errorf("host=%s: got upstream host=%s, want %s", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+var errUpstreamTimeout = errors.New("upstream request timed out")
+
+// timeoutTransport cancels upstream requests that do not complete (including
+// reading the response body) within the timeout, or the timeout of their
+// service in services. Streaming requests and responses (gRPC, server-sent
+// events, upgrades) are exempt, since they are expected to stay open; this is
+// also why responses are flushed immediately.
+type timeoutTransport struct {
+	next     http.RoundTripper
+	timeout  time.Duration
+	services map[string]time.Duration // keyed by service name, 0 for none
+}
+
+var _ http.Flusher = timeoutTransport{} // ensure it's a Flusher
+
+func (t timeoutTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := t.timeout
+	if target, ok := targetFromContext(req.Context()); ok {
+		if d, ok := t.services[target.service]; ok {
+			timeout = d
+		}
+	}
+	if timeout <= 0 || isStreamingRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var (
+		mu       sync.Mutex
+		timedOut bool
+	)
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		klog.V(4).Infof("[proxy] request to url=%s id=%s timed out after %s", req.URL, requestID(req.Context()), timeout)
+		cancel()
+	})
+	didTimeout := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return timedOut
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if didTimeout() {
+			return nil, fmt.Errorf("%w after %s: %v", errUpstreamTimeout, timeout, err)
+		}
+		return nil, err
+	}
+	if isStreamingResponse(resp) {
+		timer.Stop()
+		resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: func() {
+		timer.Stop()
+		cancel()
+	}}
+	return resp, nil
+}
+
+func isStreamingRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("content-type"), "application/grpc") ||
+		req.Header.Get("upgrade") != ""
+}
+
+func isStreamingResponse(resp *http.Response) bool {
+	ct := resp.Header.Get("content-type")
+	return resp.StatusCode == http.StatusSwitchingProtocols ||
+		strings.HasPrefix(ct, "application/grpc") ||
+		strings.HasPrefix(ct, "text/event-stream")
+}
+
+// cancelOnCloseBody releases the request context once the body is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// proxyErrorHandler reports upstream failures with writeError, with a 504 for
+// timed out requests.
+func proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	code := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, errUpstreamTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		code = http.StatusGatewayTimeout // incl. dial and tls handshake timeouts
+	}
+	id := requestID(req.Context())
+	if limit, ok := bodyTooLarge(req.Context()); ok {
+		klog.V(4).Infof("[proxy] request body to host=%s id=%s exceeded limit=%d", req.URL.Host, id, limit)
+		writeBodyTooLarge(w, req, limit)
+		return
+	}
+	klog.V(1).Infof("WARN: proxy error for host=%s id=%s: %v", req.URL.Host, id, err)
+	writeError(w, req, code, fmt.Sprintf("runsd failed to proxy the request: %v", err))
+}
+
+// parseServiceTimeouts parses comma-separated SERVICE=DURATION pairs, where a
+// DURATION of 0 exempts the service from the timeout.
+func parseServiceTimeouts(s string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	for _, kv := range splitList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in SERVICE=DURATION format", kv)
+		}
+		svc := strings.ToLower(parts[0])
+		if err := validateServiceName(svc); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("timeout %q of service %q is not a non-negative duration", parts[1], parts[0])
+		}
+		out[svc] = d
+	}
+	return out, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	// slowTransport responds after the delay, or fails when the request
+	// context is canceled.
+	slowTransport := func(delay time.Duration, contentType string) http.RoundTripper {
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			select {
+			case <-time.After(delay):
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": {contentType}},
+					Body:       ioutil.NopCloser(strings.NewReader("ok")),
+					Request:    req,
+				}, nil
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		})
+	}
+
+	cases := []struct {
+		name        string
+		delay       time.Duration
+		reqHeaders  map[string]string
+		contentType string
+		wantCode    int
+	}{
+		{name: "fast", delay: 0, contentType: "text/plain", wantCode: http.StatusOK},
+		{name: "slow", delay: time.Second, contentType: "text/plain", wantCode: http.StatusGatewayTimeout},
+		{name: "slow grpc", delay: 100 * time.Millisecond, reqHeaders: map[string]string{"content-type": "application/grpc"},
+			contentType: "application/grpc", wantCode: http.StatusOK},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.upstreamRetries = 0
+			rp.upstreamTimeout = 20 * time.Millisecond
+			h := rp.newReverseProxyHandler(slowTransport(tt.delay, tt.contentType))
+
+			req := httptest.NewRequest(http.MethodGet, "http://foo/", nil)
+			for k, v := range tt.reqHeaders {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body: %s)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServiceTimeouts(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       ioutil.NopCloser(strings.NewReader("ok")),
+				Request:    req,
+			}, nil
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	})
+
+	cases := []struct {
+		name     string
+		global   time.Duration
+		services map[string]time.Duration
+		host     string
+		wantCode int
+	}{
+		{name: "longer than global", global: 20 * time.Millisecond, services: map[string]time.Duration{"foo": time.Minute},
+			host: "foo", wantCode: http.StatusOK},
+		{name: "shorter than global", global: time.Minute, services: map[string]time.Duration{"foo": 20 * time.Millisecond},
+			host: "foo", wantCode: http.StatusGatewayTimeout},
+		{name: "exempt", global: 20 * time.Millisecond, services: map[string]time.Duration{"foo": 0},
+			host: "foo", wantCode: http.StatusOK},
+		{name: "other service", global: 20 * time.Millisecond, services: map[string]time.Duration{"foo": time.Minute},
+			host: "bar", wantCode: http.StatusGatewayTimeout},
+		{name: "other region", global: 20 * time.Millisecond, services: map[string]time.Duration{"foo": time.Minute},
+			host: "foo.europe-west1", wantCode: http.StatusOK},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.upstreamRetries = 0
+			rp.upstreamTimeout = tt.global
+			rp.serviceTimeouts = tt.services
+			h := rp.newReverseProxyHandler(tr)
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status=%d, want %d (body: %s)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseServiceTimeouts(t *testing.T) {
+	got, err := parseServiceTimeouts("Reports=5m, cache=500ms,stream=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Duration{"reports": 5 * time.Minute, "cache": 500 * time.Millisecond, "stream": 0}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("parseServiceTimeouts() (-want,+got):\n%s", diff)
+	}
+	for _, in := range []string{"foo", "foo=", "=1s", "foo=1", "foo=x", "foo=-1s", "a.b=1s"} {
+		if _, err := parseServiceTimeouts(in); err == nil {
+			t.Errorf("parseServiceTimeouts(%q) expected error", in)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// tokenExpiryMargin is how long before its expiry a cached token is
+	// considered stale and is fetched again on the request path.
+	tokenExpiryMargin = 5 * time.Minute
+
+	// defaultTokenRefreshAhead is how long before expiry tokens are refreshed
+	// in the background (a quarter of the 1h identity token lifetime).
+	defaultTokenRefreshAhead = 15 * time.Minute
+
+	// defaultTokenRefreshJitter is the fraction of the refresh-ahead time
+	// the background refreshes are randomly moved by, so that the tokens
+	// fetched together (e.g. at startup) are not refreshed together.
+	defaultTokenRefreshJitter = 0.2
+
+	// minTokenRefreshInterval prevents tight loops when background refreshes
+	// keep failing.
+	minTokenRefreshInterval = 10 * time.Second
+)
+
+type cachedToken struct {
+	lastUsed int64 // unix nanos, accessed atomically
+
+	// fields below are guarded by tokenCache.mu
+	token  string
+	issued time.Time
+	expiry time.Time
+}
+
+// tokenCache caches identity tokens (or access tokens, with
+// -token_type=access) per audience and refreshes them in the background before
+// they expire. Audiences that are not used for twice the token lifetime are
+// evicted. It is safe for concurrent use.
+type tokenCache struct {
+	refreshAhead time.Duration
+	jitter       float64 // fraction of refreshAhead the refreshes are randomly moved by, in [0,1]
+	dir          string  // if set, tokens are also kept in files in it to be reused after restarts
+
+	fetch  func(audience string) (string, error)
+	expiry func(token string) (time.Time, error)
+	now    func() time.Time
+	after  func(time.Duration) <-chan time.Time
+	rand   func() float64
+
+	mu     sync.RWMutex
+	tokens map[string]*cachedToken
+}
+
+func newTokenCache(refreshAhead time.Duration) *tokenCache {
+	return &tokenCache{
+		refreshAhead: refreshAhead,
+		fetch:        identityToken,
+		expiry:       tokenExpiry,
+		now:          time.Now,
+		after:        time.After,
+		rand:         rand.Float64,
+		tokens:       make(map[string]*cachedToken),
+	}
+}
+
+// get returns a token for the audience from the cache, or fetches a new one
+// if there is no cached token or the cached one is about to expire. The
+// returned bool indicates whether the token was served from the cache.
+func (c *tokenCache) get(audience string) (string, bool, error) {
+	now := c.now()
+	c.mu.RLock()
+	e, ok := c.tokens[audience]
+	var tok string
+	var exp time.Time
+	if ok {
+		tok, exp = e.token, e.expiry
+	}
+	c.mu.RUnlock()
+	if ok {
+		atomic.StoreInt64(&e.lastUsed, now.UnixNano())
+		if now.Add(tokenExpiryMargin).Before(exp) {
+			klog.V(6).Infof("[tokens] cache hit for audience=%s", audience)
+			metricTokenCache.hit()
+			return tok, true, nil
+		}
+	}
+	metricTokenCache.miss()
+
+	klog.V(5).Infof("[tokens] fetching new token for audience=%s", audience)
+	tok, err := c.fetchToken(audience)
+	if err != nil {
+		return "", false, err
+	}
+	exp, err = c.expiry(tok)
+	if err != nil {
+		klog.V(4).Infof("[tokens] WARN: not caching token for audience=%s: %v", audience, err)
+		return tok, false, nil
+	}
+
+	c.persist(audience, tok)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok = c.tokens[audience]
+	if !ok {
+		e = &cachedToken{lastUsed: now.UnixNano()}
+		c.tokens[audience] = e
+		go c.refreshLoop(audience, e)
+	}
+	e.token, e.issued, e.expiry = tok, now, exp
+	return tok, false, nil
+}
+
+// refreshLoop keeps refreshing the cached token for the audience until it
+// becomes idle. Failed refreshes leave the existing token in place.
+func (c *tokenCache) refreshLoop(audience string, e *cachedToken) {
+	for {
+		c.mu.RLock()
+		lifetime := e.expiry.Sub(e.issued)
+		wait := e.expiry.Sub(c.now()) - c.jitteredRefreshAhead()
+		c.mu.RUnlock()
+		if wait < minTokenRefreshInterval {
+			wait = minTokenRefreshInterval
+		}
+		<-c.after(wait)
+
+		now := c.now()
+		if idle := now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastUsed))); idle > 2*lifetime {
+			klog.V(5).Infof("[tokens] evicting idle token for audience=%s (idle=%s)", audience, idle.Truncate(time.Second))
+			c.mu.Lock()
+			delete(c.tokens, audience)
+			c.mu.Unlock()
+			return
+		}
+
+		klog.V(5).Infof("[tokens] refreshing token for audience=%s", audience)
+		tok, err := c.fetchToken(audience)
+		if err != nil {
+			klog.V(1).Infof("WARN: background token refresh failed for audience=%s: %v", audience, err)
+			continue
+		}
+		exp, err := c.expiry(tok)
+		if err != nil {
+			klog.V(1).Infof("WARN: background token refresh for audience=%s returned bad token: %v", audience, err)
+			continue
+		}
+		c.persist(audience, tok)
+		c.mu.Lock()
+		e.token, e.issued, e.expiry = tok, now, exp
+		c.mu.Unlock()
+	}
+}
+
+// jitteredRefreshAhead returns how long before its expiry to refresh a token:
+// refreshAhead, moved earlier or later by up to jitter of it. It does not go
+// below tokenExpiryMargin (unless refreshAhead does), since the token would
+// then be fetched on the request path, let alone past the expiry.
+func (c *tokenCache) jitteredRefreshAhead() time.Duration {
+	if c.jitter <= 0 {
+		return c.refreshAhead
+	}
+	d := c.refreshAhead + time.Duration((2*c.rand()-1)*c.jitter*float64(c.refreshAhead))
+	floor := tokenExpiryMargin
+	if c.refreshAhead < floor {
+		floor = c.refreshAhead
+	}
+	if d < floor {
+		d = floor
+	}
+	return d
+}
+
+func (c *tokenCache) fetchToken(audience string) (string, error) {
+	metricTokenFetches.Inc()
+	tok, err := c.fetch(audience)
+	if err != nil {
+		metricTokenFetchFailures.Inc()
+	} else {
+		metricLastTokenFetchSuccess.SetToCurrentTime()
+	}
+	return tok, err
+}
+
+// tokenExpiry parses the "exp" claim of the JWT without verifying it.
+func tokenExpiry(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a jwt (has %d segments)", len(parts))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode jwt payload: %w", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse jwt claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("jwt has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
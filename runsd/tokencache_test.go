@@ -0,0 +1,268 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".c2ln"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(1620000000, 0)
+	got, err := tokenExpiry(testJWT(exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(exp) {
+		t.Fatalf("tokenExpiry() = %v, want %v", got, exp)
+	}
+
+	for _, in := range []string{"", "foo", "a.b.c", "a." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".c"} {
+		if _, err := tokenExpiry(in); err == nil {
+			t.Errorf("tokenExpiry(%q) expected error", in)
+		}
+	}
+}
+
+// fakeClock is a manually advanced clock whose timers are handed to the test
+// over a channel.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers chan fakeTimer
+}
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{t: t, timers: make(chan fakeTimer, 10)}
+}
+
+func (f *fakeClock) now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = f.t.Add(d)
+}
+
+func (f *fakeClock) after(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time)
+	f.timers <- fakeTimer{d: d, ch: ch}
+	return ch
+}
+
+// nextTimer waits for the refresh loop to schedule a timer.
+func (f *fakeClock) nextTimer(t *testing.T) fakeTimer {
+	t.Helper()
+	select {
+	case ft := <-f.timers:
+		return ft
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for refresh to be scheduled")
+	}
+	return fakeTimer{}
+}
+
+type fakeFetcher struct {
+	mu      sync.Mutex
+	clock   *fakeClock
+	fetches map[string]int
+	err     error
+}
+
+func (f *fakeFetcher) fetch(aud string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return "", f.err
+	}
+	f.fetches[aud]++
+	return testJWT(f.clock.now().Add(time.Hour)), nil
+}
+
+func (f *fakeFetcher) count(aud string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[aud]
+}
+
+func newTestTokenCache() (*tokenCache, *fakeClock, *fakeFetcher) {
+	clock := newFakeClock(time.Unix(1620000000, 0))
+	f := &fakeFetcher{clock: clock, fetches: map[string]int{}}
+	c := newTokenCache(defaultTokenRefreshAhead)
+	c.now, c.after, c.fetch = clock.now, clock.after, f.fetch
+	return c, clock, f
+}
+
+func TestTokenCache(t *testing.T) {
+	c, clock, f := newTestTokenCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.get("https://a"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	before := f.count("https://a")
+
+	if _, _, err := c.get("https://a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("https://a"); got != before {
+		t.Fatalf("expected cached token to be used, got %d fetches (was %d)", got, before)
+	}
+	if _, _, err := c.get("https://b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("https://b"); got != 1 {
+		t.Fatalf("expected one fetch for a different audience, got %d", got)
+	}
+
+	// move into the expiry margin without letting the background refresh run
+	clock.advance(time.Hour - tokenExpiryMargin + time.Second)
+	if _, _, err := c.get("https://a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("https://a"); got != before+1 {
+		t.Fatalf("expected token to be refetched near expiry, got %d fetches (was %d)", got, before)
+	}
+}
+
+func TestTokenCacheBackgroundRefresh(t *testing.T) {
+	c, clock, f := newTestTokenCache()
+
+	tok, _, err := c.get("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft := clock.nextTimer(t)
+	if want := time.Hour - defaultTokenRefreshAhead; ft.d != want {
+		t.Fatalf("refresh scheduled in %v, want %v", ft.d, want)
+	}
+
+	// refresh succeeds
+	clock.advance(ft.d)
+	ft.ch <- clock.now()
+	ft = clock.nextTimer(t)
+	if got := f.count("https://a"); got != 2 {
+		t.Fatalf("expected background refresh, got %d fetches", got)
+	}
+	tok2, cached, err := c.get("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok2 == tok || !cached {
+		t.Fatal("expected refreshed token to be served from cache")
+	}
+	if got := f.count("https://a"); got != 2 {
+		t.Fatalf("expected hot path to use refreshed token, got %d fetches", got)
+	}
+
+	// refresh fails, still-valid token is kept
+	f.mu.Lock()
+	f.err = fmt.Errorf("metadata server unavailable")
+	f.mu.Unlock()
+	clock.advance(ft.d)
+	ft.ch <- clock.now()
+	ft = clock.nextTimer(t)
+	if ft.d != minTokenRefreshInterval {
+		t.Fatalf("retry scheduled in %v, want %v", ft.d, minTokenRefreshInterval)
+	}
+	if got, _, err := c.get("https://a"); err != nil {
+		t.Fatalf("expected cached token after failed refresh, got err: %v", err)
+	} else if got != tok2 {
+		t.Fatal("expected previous token to be served after failed refresh")
+	}
+
+	// audience goes idle and is evicted
+	clock.advance(3 * time.Hour)
+	ft.ch <- clock.now()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.RLock()
+		n := len(c.tokens)
+		c.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle token was not evicted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJitteredRefreshAhead(t *testing.T) {
+	tests := []struct {
+		name         string
+		refreshAhead time.Duration
+		jitter       float64
+		rand         float64
+		want         time.Duration
+	}{
+		{name: "no jitter", refreshAhead: 15 * time.Minute, jitter: 0, rand: 0, want: 15 * time.Minute},
+		{name: "earliest", refreshAhead: 15 * time.Minute, jitter: 0.2, rand: 1, want: 18 * time.Minute},
+		{name: "middle", refreshAhead: 15 * time.Minute, jitter: 0.2, rand: 0.5, want: 15 * time.Minute},
+		{name: "latest", refreshAhead: 15 * time.Minute, jitter: 0.2, rand: 0, want: 12 * time.Minute},
+		{name: "not into the expiry margin", refreshAhead: 15 * time.Minute, jitter: 1, rand: 0, want: tokenExpiryMargin},
+		{name: "short refresh ahead is not moved later", refreshAhead: time.Minute, jitter: 1, rand: 0, want: time.Minute},
+		{name: "short refresh ahead is moved earlier", refreshAhead: time.Minute, jitter: 1, rand: 1, want: 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTokenCache(tt.refreshAhead)
+			c.jitter = tt.jitter
+			c.rand = func() float64 { return tt.rand }
+			if got := c.jitteredRefreshAhead(); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCacheJitteredRefresh(t *testing.T) {
+	c, clock, _ := newTestTokenCache()
+	c.jitter = 0.2
+	c.rand = func() float64 { return 0.75 }
+
+	if _, _, err := c.get("https://a"); err != nil {
+		t.Fatal(err)
+	}
+	ft := clock.nextTimer(t)
+	if want := time.Hour - defaultTokenRefreshAhead - defaultTokenRefreshAhead/10; ft.d != want {
+		t.Fatalf("refresh scheduled in %v, want %v", ft.d, want)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// diskToken is the format of the token files in tokenCache.dir, named after
+// the hash of the audience.
+type diskToken struct {
+	Audience string `json:"audience"`
+	Token    string `json:"token"`
+}
+
+func tokenFile(dir, audience string) string {
+	h := sha256.Sum256([]byte(audience))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// persist writes the token of the audience to the cache directory, readable
+// only by the current user. Failures are logged since the token is still
+// cached in memory.
+func (c *tokenCache) persist(audience, tok string) {
+	if c.dir == "" {
+		return
+	}
+	if err := writeTokenFile(c.dir, audience, tok); err != nil {
+		klog.V(1).Infof("WARN: failed to write token to cache dir for audience=%s: %v", audience, err)
+	}
+}
+
+func writeTokenFile(dir, audience, tok string) error {
+	b, err := json.Marshal(diskToken{Audience: audience, Token: tok})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".token-") // created with 0600
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after the rename
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), tokenFile(dir, audience))
+}
+
+// loadDir adds the tokens in the cache directory that are not about to
+// expire to the cache, and removes the others. Files that other users can
+// access are ignored.
+func (c *tokenCache) loadDir() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create token cache dir: %w", err)
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read token cache dir: %w", err)
+	}
+	now := c.now()
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.dir, fi.Name())
+		if fi.Mode().Perm()&0077 != 0 {
+			klog.V(1).Infof("WARN: ignoring token cache file %s with permissions %s, expected 0600", path, fi.Mode().Perm())
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read token cache file: %w", err)
+		}
+		var t diskToken
+		if err := json.Unmarshal(b, &t); err != nil || t.Audience == "" || path != tokenFile(c.dir, t.Audience) {
+			klog.V(1).Infof("WARN: ignoring malformed token cache file %s", path)
+			continue
+		}
+		exp, err := c.expiry(t.Token)
+		if err != nil || !now.Add(tokenExpiryMargin).Before(exp) {
+			klog.V(5).Infof("[tokens] removing expired token cache file for audience=%s", t.Audience)
+			os.Remove(path)
+			continue
+		}
+		klog.V(5).Infof("[tokens] loaded cached token for audience=%s expiry=%s", t.Audience, exp)
+		c.mu.Lock()
+		if _, ok := c.tokens[t.Audience]; !ok {
+			e := &cachedToken{lastUsed: now.UnixNano(), token: t.Token, issued: now, expiry: exp}
+			c.tokens[t.Audience] = e
+			go c.refreshLoop(t.Audience, e)
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, clock, f := newTestTokenCache()
+	c.dir = dir
+	if err := c.loadDir(); err != nil {
+		t.Fatal(err)
+	}
+	tok, _, err := c.get("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(tokenFile(dir, "https://a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("token file has permissions %s, want 0600", perm)
+	}
+
+	// expired, and readable by others
+	if err := writeTokenFile(dir, "https://old", testJWT(clock.now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTokenFile(dir, "https://b", testJWT(clock.now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tokenFile(dir, "https://b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a restart
+	c2 := newTokenCache(defaultTokenRefreshAhead)
+	c2.now, c2.after, c2.fetch, c2.dir = clock.now, clock.after, f.fetch, dir
+	if err := c2.loadDir(); err != nil {
+		t.Fatal(err)
+	}
+	got, cached, err := c2.get("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != tok || !cached || f.count("https://a") != 1 {
+		t.Fatalf("got cached=%v fetches=%d, want the token from disk", cached, f.count("https://a"))
+	}
+	for _, aud := range []string{"https://old", "https://b"} {
+		if _, cached, err := c2.get(aud); err != nil || cached || f.count(aud) != 1 {
+			t.Errorf("audience=%s: got cached=%v fetches=%d err=%v, want a new token", aud, cached, f.count(aud), err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaults of http.DefaultTransport
+const (
+	defaultUpstreamMaxIdleConns        = 100
+	defaultUpstreamMaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	defaultUpstreamIdleConnTimeout     = 90 * time.Second
+	defaultUpstreamKeepAlive           = 30 * time.Second
+)
+
+// defaultUpstreamDialTimeout is shorter than http.DefaultTransport's 30s,
+// but leaves time for the frontends of cold services to accept connections.
+const defaultUpstreamDialTimeout = 10 * time.Second
+
+// upstreamOptions configures the connection pool of the transport to the
+// Cloud Run services.
+type upstreamOptions struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int // 0 for no limit
+	idleConnTimeout     time.Duration
+	dialTimeout         time.Duration // 0 for no timeout
+	keepAlive           time.Duration // 0 for the default, negative to disable
+
+	http1Hosts []string // upstream hosts to connect to over HTTP/1.1 only
+
+	// clientCert is presented to the backends that request a client
+	// certificate (e.g. custom domains requiring mTLS), if set.
+	clientCert *tls.Certificate
+}
+
+func (o upstreamOptions) validate() error {
+	if o.maxIdleConns < 0 || o.maxIdleConnsPerHost < 0 || o.maxConnsPerHost < 0 {
+		return fmt.Errorf("connection limits cannot be negative")
+	}
+	if o.idleConnTimeout < 0 {
+		return fmt.Errorf("idle connection timeout %v is negative", o.idleConnTimeout)
+	}
+	if o.dialTimeout < 0 {
+		return fmt.Errorf("dial timeout %v is negative", o.dialTimeout)
+	}
+	return nil
+}
+
+// newUpstreamTransport returns a copy of http.DefaultTransport with the
+// connection pool and dialer options. Cloning keeps ForceAttemptHTTP2, so that the
+// requests to the *.a.run.app backends still negotiate HTTP/2.
+func newUpstreamTransport(o upstreamOptions) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConns = o.maxIdleConns
+	tr.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	tr.MaxConnsPerHost = o.maxConnsPerHost
+	tr.IdleConnTimeout = o.idleConnTimeout
+	tr.DialContext = (&net.Dialer{
+		Timeout:   o.dialTimeout,
+		KeepAlive: o.keepAlive,
+	}).DialContext
+	if o.clientCert != nil {
+		tr.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*o.clientCert}}
+	}
+	return tr
+}
+
+// loadClientCert loads the PEM client certificate and key for upstreamOptions,
+// which must be set together.
+func loadClientCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the client certificate and key must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// newUpstreamRoundTripper returns the transport to the upstream services,
+// which connects to the http1Hosts over HTTP/1.1 only.
+func newUpstreamRoundTripper(o upstreamOptions) http.RoundTripper {
+	tr := newUpstreamTransport(o)
+	if len(o.http1Hosts) == 0 {
+		return tr
+	}
+	h1 := newUpstreamTransport(o)
+	h1.ForceAttemptHTTP2 = false
+	h1.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper) // non-nil disables HTTP/2
+	hosts := make(map[string]bool)
+	for _, h := range o.http1Hosts {
+		hosts[strings.ToLower(h)] = true
+	}
+	return http1HostsTransport{next: tr, http1: h1, hosts: hosts}
+}
+
+// http1HostsTransport sends the requests to the hosts (with or without the
+// port) over the http1 transport, e.g. for backends that advertise h2 but do
+// not handle it correctly. Other backends still negotiate the protocol with
+// ALPN, which already falls back to HTTP/1.1 for the servers without h2.
+type http1HostsTransport struct {
+	next  *http.Transport
+	http1 *http.Transport
+	hosts map[string]bool
+}
+
+func (t http1HostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil && !t.hosts[host] {
+		host = h
+	}
+	if t.hosts[host] {
+		return t.http1.RoundTrip(req)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,300 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamTransport(t *testing.T) {
+	tr := newUpstreamTransport(upstreamOptions{
+		maxIdleConns:        500,
+		maxIdleConnsPerHost: 50,
+		maxConnsPerHost:     200,
+		idleConnTimeout:     time.Minute,
+	})
+	if tr.MaxIdleConns != 500 || tr.MaxIdleConnsPerHost != 50 || tr.MaxConnsPerHost != 200 || tr.IdleConnTimeout != time.Minute {
+		t.Fatalf("pool options not set: %+v", tr)
+	}
+	if tr == http.DefaultTransport {
+		t.Fatal("http.DefaultTransport was modified")
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	tr.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got proto=%s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestUpstreamOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      upstreamOptions
+		wantErr bool
+	}{
+		{name: "defaults", in: upstreamOptions{maxIdleConns: defaultUpstreamMaxIdleConns, maxIdleConnsPerHost: defaultUpstreamMaxIdleConnsPerHost, idleConnTimeout: defaultUpstreamIdleConnTimeout}},
+		{name: "zero", in: upstreamOptions{}},
+		{name: "negative limit", in: upstreamOptions{maxConnsPerHost: -1}, wantErr: true},
+		{name: "negative timeout", in: upstreamOptions{idleConnTimeout: -time.Second}, wantErr: true},
+		{name: "negative dial timeout", in: upstreamOptions{dialTimeout: -time.Second}, wantErr: true},
+		{name: "keep-alive disabled", in: upstreamOptions{keepAlive: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.in.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() err=%v, wantErr=%v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamForceHTTP1(t *testing.T) {
+	newServer := func() *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		return srv
+	}
+	h1Srv, h2Srv := newServer(), newServer()
+	defer h1Srv.Close()
+	defer h2Srv.Close()
+
+	h1Host := strings.TrimPrefix(h1Srv.URL, "https://")
+	rt := newUpstreamRoundTripper(upstreamOptions{http1Hosts: []string{h1Host}})
+	tr, ok := rt.(http1HostsTransport)
+	if !ok {
+		t.Fatalf("got transport %T, want http1HostsTransport", rt)
+	}
+	tlsConfig := h1Srv.Client().Transport.(*http.Transport).TLSClientConfig
+	tr.next.TLSClientConfig = tlsConfig.Clone()
+	tr.http1.TLSClientConfig = tlsConfig.Clone()
+
+	tests := []struct {
+		url       string
+		wantMajor int
+	}{
+		{url: h1Srv.URL, wantMajor: 1},
+		{url: h2Srv.URL, wantMajor: 2},
+	}
+	for _, tt := range tests {
+		resp, err := (&http.Client{Transport: tr}).Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tt.wantMajor {
+			t.Fatalf("url=%s: got proto=%s, want HTTP/%d", tt.url, resp.Proto, tt.wantMajor)
+		}
+	}
+}
+
+// writeTestClientCert writes a self-signed client certificate and its key to
+// dir, and returns their paths and the certificate.
+func writeTestClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "runsd-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestUpstreamClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, cert := writeTestClientCert(t, dir)
+
+	for _, files := range [][2]string{{certFile, ""}, {"", keyFile}, {keyFile, certFile}} {
+		if _, err := loadClientCert(files[0], files[1]); err == nil {
+			t.Errorf("loadClientCert(%q, %q) expected error", files[0], files[1])
+		}
+	}
+	clientCert, err := loadClientCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotAuthz string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthz = r.Header.Get("Authorization")
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	backend.StartTLS()
+	defer backend.Close()
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.customDomains = map[string]string{"payments": "payments.example.com"}
+	rp.tokenSource = func(string) (string, error) { return "token", nil }
+	send := func(clientCert *tls.Certificate) int {
+		tr := newUpstreamTransport(upstreamOptions{clientCert: clientCert})
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = new(tls.Config)
+		}
+		tr.TLSClientConfig.InsecureSkipVerify = true
+		tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		}
+		rec := httptest.NewRecorder()
+		rp.newReverseProxyHandler(tr).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://payments/", nil))
+		return rec.Code
+	}
+
+	if code := send(nil); code != http.StatusBadGateway {
+		t.Fatalf("without client cert: got status=%d, want 502", code)
+	}
+	if code := send(clientCert); code != http.StatusOK {
+		t.Fatalf("with client cert: got status=%d, want 200", code)
+	}
+	if gotAuthz != "Bearer token" {
+		t.Fatalf("got authorization=%q, want the identity token too", gotAuthz)
+	}
+}
+
+// newFullListener returns the address of a listener that never accepts and
+// whose accept queue is full, so that connecting to it hangs.
+func newFullListener(t *testing.T) (string, func()) {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	closeFn := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+		syscall.Close(fd)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		closeFn()
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		closeFn()
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		closeFn()
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+		if i == 10 {
+			closeFn()
+			t.Skip("cannot fill the accept queue of the listener")
+		}
+	}
+	return addr, closeFn
+}
+
+func TestUpstreamDialTimeout(t *testing.T) {
+	addr, closeFn := newFullListener(t)
+	defer closeFn()
+
+	tr := newUpstreamTransport(upstreamOptions{dialTimeout: 100 * time.Millisecond})
+	dial := tr.DialContext
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.upstreamRetries = 0
+	rp.tokenSource = func(string) (string, error) { return "token", nil }
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		rp.newReverseProxyHandler(tr).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://foo/", nil))
+		done <- rec.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusGatewayTimeout {
+			t.Fatalf("got status=%d, want 504", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not time out")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// upgradeTransport closes upgraded (e.g. WebSocket) connections once no data
+// is sent in either direction for idleTimeout. The upgrade itself is handled
+// by httputil.ReverseProxy, which tunnels the connection once the upstream
+// responds with 101 Switching Protocols.
+type upgradeTransport struct {
+	next        http.RoundTripper
+	idleTimeout time.Duration
+}
+
+var _ http.Flusher = upgradeTransport{} // ensure it's a Flusher
+
+func (u upgradeTransport) Flush() {
+	if v, ok := u.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (u upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.next.RoundTrip(req)
+	if err != nil || u.idleTimeout <= 0 || resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return resp, err
+	}
+	klog.V(5).Infof("[proxy] upgraded connection to host=%s id=%s (protocol=%s)", req.URL.Host, requestID(req.Context()), resp.Header.Get("upgrade"))
+	resp.Body = newIdleTimeoutConn(rwc, u.idleTimeout, req.URL.Host)
+	return resp, nil
+}
+
+// idleTimeoutConn closes the underlying connection if it is not read from or
+// written to for the timeout.
+type idleTimeoutConn struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+	timer   *time.Timer
+	once    sync.Once
+}
+
+func newIdleTimeoutConn(rwc io.ReadWriteCloser, timeout time.Duration, host string) *idleTimeoutConn {
+	c := &idleTimeoutConn{ReadWriteCloser: rwc, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		klog.V(4).Infof("[proxy] closing upgraded connection to host=%s, idle for %s", host, timeout)
+		c.close()
+	})
+	return c
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.close()
+}
+
+func (c *idleTimeoutConn) close() error {
+	var err error
+	c.once.Do(func() { err = c.ReadWriteCloser.Close() })
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runsd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeServer starts a TLS server that accepts websocket upgrades
+// and echoes back everything it receives. Handshake authorization headers are
+// sent to authz.
+func newEchoUpgradeServer(t *testing.T, authz chan<- string) *httptest.Server {
+	t.Helper()
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("upgrade") != "websocket" {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		authz <- r.Header.Get("authorization")
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// newUpgradeTestProxy starts a proxy that sends all requests to the backend.
+func newUpgradeTestProxy(t *testing.T, backend *httptest.Server, idleTimeout time.Duration) *httptest.Server {
+	t.Helper()
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.upgradeIdleTimeout = idleTimeout
+	return httptest.NewServer(rp.newReverseProxyHandler(tr))
+}
+
+func dialUpgrade(t *testing.T, proxy *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: foo\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status=%d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn, br
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	authz := make(chan string, 1)
+	backend := newEchoUpgradeServer(t, authz)
+	defer backend.Close()
+	proxy := newUpgradeTestProxy(t, backend, 0)
+	defer proxy.Close()
+
+	conn, br := dialUpgrade(t, proxy)
+	defer conn.Close()
+	if got := <-authz; got != "Bearer token" {
+		t.Fatalf("handshake authorization=%q, want %q", got, "Bearer token")
+	}
+
+	for _, msg := range []string{"hello\n", "world\n"} {
+		fmt.Fprint(conn, msg)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Fatalf("echo got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	backend := newEchoUpgradeServer(t, make(chan string, 1))
+	defer backend.Close()
+	proxy := newUpgradeTestProxy(t, backend, 50*time.Millisecond)
+	defer proxy.Close()
+
+	conn, br := dialUpgrade(t, proxy)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle connection to be closed, got err=%v", err)
+	}
+}